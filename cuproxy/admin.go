@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/fasthttp/router"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+
+	"github.com/tuupke/pixie/env"
+	"github.com/tuupke/pixie/lifecycle"
+)
+
+var (
+	adminListen      = env.String("ADMIN_LISTEN")
+	adminCredentials = env.String("ADMIN_BASIC_AUTH")
+)
+
+// adminRouter constructs the routes of the admin listener.
+func adminRouter() *router.Router {
+	routes := router.New()
+	routes.PanicHandler = func(ctx *fasthttp.RequestCtx, i interface{}) {
+		zlog.Warn().Interface("error", i).Bytes("url", ctx.URI().FullURI()).Msg("admin request failed")
+	}
+
+	routes.GET("/jobs", listJobs)
+	routes.GET("/jobs/{id}", getJob)
+	routes.GET("/held", listHeld)
+	routes.GET("/held/{id}/document", heldDocument)
+	routes.POST("/held/{id}/{action}", heldAction)
+	routes.GET("/deliver", deliver)
+	routes.POST("/deliver", deliver)
+	routes.GET("/deliver/{seq}/{job}/{team:*}", deliver)
+	routes.GET("/props", listProps)
+	routes.GET("/props/{id}", getProps)
+	routes.PATCH("/props/{id}", patchProps)
+	routes.DELETE("/props/{id}/keys/{key}", deletePropsKey)
+	routes.GET("/props/{id}/banner", propsBanner)
+	routes.POST("/props/{id}/refresh", refreshProps)
+	routes.POST("/props/{id}/render", renderProps)
+	routes.GET("/preview", previewBanner)
+	routes.POST("/preview", previewBanner)
+
+	return routes
+}
+
+// serveAdmin starts the admin listener, when configured.
+func serveAdmin() {
+	if adminListen == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", adminListen)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("listen", adminListen).Msg("admin listener cannot be started")
+	}
+
+	lifecycle.EFinally(ln.Close)
+	go fasthttp.Serve(ln, adminAuth(adminRouter().Handler))
+	zlog.Info().Str("listen", adminListen).Msg("started admin listener")
+}
+
+// adminAuth requires the basic-auth credentials configured in ADMIN_BASIC_AUTH,
+// formatted as "username:password". Without credentials, no authentication is
+// required.
+func adminAuth(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if adminCredentials == "" {
+		return h
+	}
+
+	username, password, _ := strings.Cut(adminCredentials, ":")
+	return func(ctx *fasthttp.RequestCtx) {
+		ok, user, pass := decodeBasicAuth(ctx.Request.Header.Peek("Authorization"))
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			ctx.Response.Header.Set("WWW-Authenticate", `Basic realm="CUProxy"`)
+			ctx.SetStatusCode(http.StatusUnauthorized)
+			return
+		}
+
+		h(ctx)
+	}
+}
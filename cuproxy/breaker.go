@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/puzpuzpuz/xsync"
+	"github.com/rs/zerolog"
+
+	"github.com/tuupke/pixie/env"
+)
+
+var (
+	webhookRetries         = env.IntFb("WEBHOOK_RETRIES", 0)
+	webhookRetryDelay      = env.DurationFb("WEBHOOK_RETRY_DELAY", time.Second)
+	webhookRetryMaxDelay   = env.DurationFb("WEBHOOK_RETRY_MAX_DELAY", 10*time.Second)
+	webhookBreakerFailures = env.IntFb("WEBHOOK_BREAKER_FAILURES", 5)
+	webhookBreakerCooldown = env.DurationFb("WEBHOOK_BREAKER_COOLDOWN", 30*time.Second)
+
+	// breakers contains the circuit breaker of every webhook, by name and url.
+	breakers = xsync.NewMapOf[*breaker]()
+
+	errBreakerOpen = errors.New("circuit breaker is open")
+)
+
+type (
+	// breaker is the circuit breaker of a webhook. After a number of
+	// consecutive failures, the webhook is no longer called until the cooldown
+	// has passed. Then a single call is let through, which closes the breaker on
+	// success and opens it again on failure.
+	breaker struct {
+		mu       sync.Mutex
+		failures int
+		openTill time.Time
+		probing  bool
+	}
+
+	// statusError is returned for webhook responses without a 2xx status-code.
+	statusError struct {
+		code int
+	}
+)
+
+func (err statusError) Error() string {
+	return fmt.Sprintf("non-successfull status code received (%v)", err.code)
+}
+
+// retryable returns whether the webhook can be retried after the error. Client
+// errors and refused responses are not retried.
+func retryable(err error) bool {
+	var status statusError
+	switch {
+	case errors.As(err, &status):
+		return status.code >= http.StatusInternalServerError || status.code == http.StatusTooManyRequests
+	case errors.Is(err, errInvalidSignature), errors.Is(err, errBreakerOpen), errors.Is(err, context.Canceled):
+		return false
+	}
+
+	return true
+}
+
+// retryDelay returns the delay before the attempt, doubling the
+// WEBHOOK_RETRY_DELAY for every attempt up to WEBHOOK_RETRY_MAX_DELAY.
+func retryDelay(attempt int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < attempt && delay < webhookRetryMaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, webhookRetryMaxDelay)
+}
+
+// breaker returns the circuit breaker of the endpoint.
+func (ep endpoint) breaker() *breaker {
+	// LoadOrCompute of this xsync version returns another value than it stores
+	b, _ := breakers.LoadOrStore(ep.name+" "+ep.method+" "+ep.url, new(breaker))
+	return b
+}
+
+// allow returns whether the webhook can be called. When the cooldown of an open
+// breaker has passed, only one caller is allowed to probe the webhook.
+func (b *breaker) allow(now time.Time) bool {
+	if webhookBreakerFailures <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < webhookBreakerFailures {
+		return true
+	}
+
+	if now.Before(b.openTill) || b.probing {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// record records the result of calling the webhook, and returns whether the
+// breaker opened.
+func (b *breaker) record(log zerolog.Logger, err error, now time.Time) (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	var status statusError
+	if err != nil && !retryable(err) && !errors.As(err, &status) {
+		// Refused responses and cancelled calls say nothing about the health of
+		// the webhook, the failures are kept as-is.
+		return false
+	}
+
+	if err == nil || !retryable(err) {
+		// Only failures of the webhook itself count, e.g. a 404 does not
+		if err == nil && b.failures >= webhookBreakerFailures && webhookBreakerFailures > 0 {
+			log.Info().Msg("webhook recovered, closing circuit breaker")
+		}
+
+		b.failures = 0
+		return false
+	}
+
+	b.failures++
+	if webhookBreakerFailures > 0 && b.failures >= webhookBreakerFailures {
+		b.openTill = now.Add(webhookBreakerCooldown)
+		log.Warn().Err(err).Int("failures", b.failures).Time("until", b.openTill).Msg("opened circuit breaker of webhook")
+		return true
+	}
+
+	return false
+}
+
+// call executes the request of the endpoint, guarded by its circuit breaker.
+// Retryable failures are retried with backoff, as long as the breaker allows.
+func (ep endpoint) call(ctx context.Context, log zerolog.Logger, data *Props) (respBody io.ReadCloser, respType string, loaded bool, err error) {
+	retries := webhookRetries
+	if ep.retries != nil {
+		retries = *ep.retries
+	}
+
+	b := ep.breaker()
+	for attempt := 0; ; attempt++ {
+		if !b.allow(time.Now()) {
+			err = fmt.Errorf("not calling webhook '%v'; %w", ep.name, errBreakerOpen)
+			observeWebhook(ep.name, 0, false, err)
+			return nil, "", false, err
+		}
+
+		start := time.Now()
+		respBody, respType, loaded, err = ep.executeRequest(ctx, log, data)
+		observeWebhook(ep.name, time.Since(start), loaded, err)
+		if b.record(log, err, time.Now()) || err == nil || !retryable(err) || attempt >= retries {
+			return
+		}
+
+		delay := retryDelay(attempt + 1)
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("delay", delay).Msg("retrying webhook")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, "", false, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRetryable(t *testing.T) {
+	for err, expected := range map[error]bool{
+		statusError{code: http.StatusBadGateway}:      true,
+		statusError{code: http.StatusTooManyRequests}: true,
+		statusError{code: http.StatusNotFound}:        false,
+		errors.New("connection refused"):              true,
+		errInvalidSignature:                           false,
+		errBreakerOpen:                                false,
+		context.Canceled:                              false,
+	} {
+		assert.Equal(t, expected, retryable(err), err.Error())
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, webhookRetryDelay, retryDelay(1))
+	assert.Equal(t, 2*webhookRetryDelay, retryDelay(2))
+	assert.Equal(t, 8*webhookRetryDelay, retryDelay(4))
+	assert.Equal(t, webhookRetryMaxDelay, retryDelay(20))
+}
+
+func TestBreaker(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	failure := statusError{code: http.StatusServiceUnavailable}
+
+	for i := 1; i < webhookBreakerFailures; i++ {
+		assert.False(t, b.record(zlog.Logger, failure, now))
+		assert.True(t, b.allow(now))
+	}
+
+	// Refused responses and cancelled calls do not reset the failures
+	assert.False(t, b.record(zlog.Logger, errInvalidSignature, now))
+	assert.False(t, b.record(zlog.Logger, context.Canceled, now))
+	assert.True(t, b.record(zlog.Logger, failure, now))
+	assert.False(t, b.allow(now))
+	assert.False(t, b.allow(now.Add(webhookBreakerCooldown-time.Second)))
+
+	// After the cooldown a single probe is allowed
+	later := now.Add(webhookBreakerCooldown)
+	assert.True(t, b.allow(later))
+	assert.False(t, b.allow(later), "only one probe at a time")
+	assert.True(t, b.record(zlog.Logger, failure, later), "a failing probe opens the breaker again")
+	assert.False(t, b.allow(later))
+
+	later = later.Add(webhookBreakerCooldown)
+	assert.True(t, b.allow(later))
+	assert.False(t, b.record(zlog.Logger, nil, later))
+	assert.True(t, b.allow(later))
+}
+
+func TestBreakerWebhook(t *testing.T) {
+	webhookRetryDelay = time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = time.Second })
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	data := Load(net.ParseIP("10.11.0.4"), map[string]string{}, "breaker")
+	retries := 2 * webhookBreakerFailures
+	ep := endpoint{name: "dead", method: http.MethodGet, url: srv.URL, retries: &retries}
+	_, _, _, err := ep.call(context.Background(), zlog.Logger, data)
+	assert.Equal(t, statusError{code: http.StatusServiceUnavailable}, err)
+	assert.EqualValues(t, webhookBreakerFailures, calls.Load(), "retries stop once the breaker opens")
+
+	_, _, _, err = ep.call(context.Background(), zlog.Logger, data)
+	assert.ErrorIs(t, err, errBreakerOpen)
+	assert.EqualValues(t, webhookBreakerFailures, calls.Load(), "an open breaker does not call the webhook")
+
+	// Other webhooks are not affected
+	ep.name, ep.retries = "other", nil
+	_, _, _, err = ep.call(context.Background(), zlog.Logger, data)
+	assert.Equal(t, statusError{code: http.StatusServiceUnavailable}, err)
+}
+
+func TestBreakerVerifiedWebhook(t *testing.T) {
+	testSecret(t, true)
+	webhookRetryDelay = time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = time.Second })
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	// Failing webhooks do not sign their response, the status is what counts
+	data := Load(net.ParseIP("10.11.0.5"), map[string]string{}, "breaker-verified")
+	retries := 2 * webhookBreakerFailures
+	ep := endpoint{name: "unsigned", method: http.MethodGet, url: srv.URL, retries: &retries}
+	_, _, _, err := ep.call(context.Background(), zlog.Logger, data)
+	assert.Equal(t, statusError{code: http.StatusTooManyRequests}, err)
+	assert.EqualValues(t, webhookBreakerFailures, calls.Load(), "the unsigned failures are retried until the breaker opens")
+
+	_, _, _, err = ep.call(context.Background(), zlog.Logger, data)
+	assert.ErrorIs(t, err, errBreakerOpen)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	pdfLocation = t.TempDir()
+	var calls atomic.Int32
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"team_name": "Seven"}`))
+	}))
+	defer srv.Close()
+
+	old := toCall
+	toCall = endpointsSet{{{name: "team", method: http.MethodGet, url: srv.URL}}}
+	t.Cleanup(func() {
+		toCall, dataFreshFor, dataMaxStaleness = old, 0, 0
+	})
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/printers/stale-while-revalidate")
+	load := func() *Props {
+		v := loadValues(zlog.Logger, ctx, 1)
+		_, err := v.pdfPromise.Await(context.Background())
+		require.NoError(t, err)
+		return v.data
+	}
+
+	// The initial load is awaited
+	data := load()
+	name, _ := data.Load("team_name")
+	assert.Equal(t, "Seven", name)
+	_, validated := data.Staleness()
+	assert.True(t, validated)
+	fresh, await := data.revalidation()
+	assert.False(t, fresh)
+	assert.False(t, await)
+
+	// Fresh data is not revalidated
+	dataFreshFor = time.Hour
+	load()
+	assert.EqualValues(t, 1, calls.Load())
+
+	// Failing revalidations keep the stale data
+	dataFreshFor = 0
+	down.Store(true)
+	age, _ := data.Staleness()
+	load()
+	assert.EqualValues(t, 2, calls.Load())
+	name, _ = data.Load("team_name")
+	assert.Equal(t, "Seven", name)
+	stale, _ := data.Staleness()
+	assert.Greater(t, stale, age, "failing revalidations do not refresh the data")
+
+	// Too stale data must be revalidated before it is used
+	dataMaxStaleness = time.Nanosecond
+	_, await = data.revalidation()
+	assert.True(t, await)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/puzpuzpuz/xsync"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/tuupke/pixie/env"
+)
+
+var (
+	cacheExpiry = env.DurationFb("CACHE_EXPIRY", 24*time.Hour)
+
+	// cache is the ledger, once the cache tables are migrated.
+	cache *gorm.DB
+
+	// persistedProps contains the Props loaded from the ledger, by their cache
+	// key. They are restored when the Props are first used.
+	persistedProps = xsync.NewMapOf[cachedProps]()
+
+	// bannerMetadata contains the metadata of the rendered banners, by the
+	// cache key of their Props.
+	bannerMetadata = xsync.NewMapOf[cachedBanner]()
+)
+
+type (
+	// cachedProps are the persisted Props. The key is hashed, as the Props are
+	// keyed by the basic-auth credentials.
+	cachedProps struct {
+		Key        string `gorm:"primaryKey"`
+		IP         string
+		Identity   string
+		Data       kvs
+		Overrides  kvs
+		LatestData time.Time
+		Validated  time.Time
+		UpdatedAt  time.Time `gorm:"index"`
+	}
+
+	// cachedEtag is a persisted etagPair, by the hashed url.
+	cachedEtag struct {
+		Key       string `gorm:"primaryKey"`
+		ETag      string
+		Date      string
+		UpdatedAt time.Time `gorm:"index"`
+	}
+
+	// cachedBanner is the metadata of the banner rendered for Props. Banners are
+	// stored by ip, the hash ensures a banner is only reused by the Props which
+	// rendered it.
+	cachedBanner struct {
+		Key       string `gorm:"primaryKey"`
+		File      string
+		Hash      string
+		UpdatedAt time.Time `gorm:"index"`
+	}
+)
+
+// cacheKey hashes the key of a cached value.
+func cacheKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// persisting returns whether the caches are persisted.
+func persisting() bool {
+	return cache != nil
+}
+
+// openCache migrates the cache tables in the ledger, removes the expired
+// entries and loads the remainder.
+func openCache(log zerolog.Logger) error {
+	if ledger == nil || cacheExpiry <= 0 {
+		return nil
+	}
+
+	if err := ledger.AutoMigrate(&cachedProps{}, &cachedEtag{}, &cachedBanner{}); err != nil {
+		return fmt.Errorf("cannot migrate cache; %w", err)
+	}
+
+	expired := time.Now().Add(-cacheExpiry)
+	for _, model := range []any{&cachedProps{}, &cachedEtag{}, &cachedBanner{}} {
+		if err := ledger.Where("updated_at < ?", expired).Delete(model).Error; err != nil {
+			return fmt.Errorf("cannot expire cache; %w", err)
+		}
+	}
+
+	var props []cachedProps
+	var etags []cachedEtag
+	var banners []cachedBanner
+	for _, rows := range []any{&props, &etags, &banners} {
+		if err := ledger.Find(rows).Error; err != nil {
+			return fmt.Errorf("cannot load cache; %w", err)
+		}
+	}
+
+	for _, p := range props {
+		persistedProps.Store(p.Key, p)
+	}
+
+	for _, e := range etags {
+		etagCache.Store(e.Key, etagPair{Key: e.ETag, Date: e.Date})
+	}
+
+	for _, b := range banners {
+		bannerMetadata.Store(b.Key, b)
+	}
+
+	log.Info().Int("props", len(props)).Int("etags", len(etags)).Int("banners", len(banners)).Dur("expiry", cacheExpiry).Msg("loaded cache")
+	cache = ledger
+	return nil
+}
+
+// restore restores the persisted data of the Props, if any. Data which is
+// already present, i.e. from the request, is kept.
+func (p *Props) restore() {
+	cached, ok := persistedProps.LoadAndDelete(p.key)
+	if !ok {
+		return
+	}
+
+	for k, v := range cached.Data {
+		p.LoadOrStore(k, v)
+	}
+
+	for k, v := range cached.Overrides {
+		p.overrides.Store(k, v)
+		p.Store(k, v)
+	}
+
+	if !cached.LatestData.IsZero() {
+		p.latestData.Store(cached.LatestData.UnixNano())
+	}
+	if !cached.Validated.IsZero() {
+		p.validated.Store(cached.Validated.UnixNano())
+	}
+}
+
+// persistProps stores the Props in the ledger. Failing to do so only affects
+// the first job after a restart.
+func persistProps(log zerolog.Logger, p *Props) {
+	if !persisting() {
+		return
+	}
+
+	cached := cachedProps{Key: p.key, IP: p.ip.String(), Identity: p.identity, Data: p.Snapshot(), Overrides: p.Overrides(), LatestData: p.LatestData()}
+	if validated := p.validated.Load(); validated != 0 {
+		cached.Validated = time.Unix(0, validated)
+	}
+
+	persist(log, &cached, "persisted banner-data")
+}
+
+// persist inserts, or updates, the cached value in the ledger.
+func persist(log zerolog.Logger, value any, msg string) {
+	log.Err(cache.Clauses(clause.OnConflict{UpdateAll: true}).Create(value).Error).Msg(msg)
+}
+
+// storeEtag caches, and persists, the etag of the url.
+func storeEtag(log zerolog.Logger, url string, etag etagPair) {
+	key := cacheKey(url)
+	etagCache.Store(key, etag)
+	if persisting() {
+		persist(log, &cachedEtag{Key: key, ETag: etag.Key, Date: etag.Date}, "persisted etag")
+	}
+}
+
+// loadEtag returns the cached etag of the url.
+func loadEtag(url string) (etagPair, bool) {
+	return etagCache.Load(cacheKey(url))
+}
+
+// bannerValid returns whether the banner file was rendered for the Props, and
+// has not changed since.
+func bannerValid(p *Props, file *os.File) bool {
+	meta, ok := bannerMetadata.Load(p.key)
+	if !ok || meta.File != file.Name() {
+		return false
+	}
+
+	hash, err := hashReader(file)
+	_, _ = file.Seek(0, 0)
+	return err == nil && hash == meta.Hash
+}
+
+// storeBanner records, and persists, the metadata of the banner rendered for
+// the Props.
+func storeBanner(log zerolog.Logger, p *Props, file *os.File) {
+	if _, err := file.Seek(0, 0); err != nil {
+		log.Err(err).Msg("cannot hash banner")
+		return
+	}
+
+	hash, err := hashReader(file)
+	_, _ = file.Seek(0, 0)
+	if err != nil {
+		log.Err(err).Msg("cannot hash banner")
+		return
+	}
+
+	meta := cachedBanner{Key: p.key, File: file.Name(), Hash: hash}
+	bannerMetadata.Store(p.key, meta)
+	if persisting() {
+		persist(log, &meta, "persisted banner metadata")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/puzpuzpuz/xsync"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCache opens the cache in a new ledger, for the duration of the test.
+func testCache(t *testing.T) {
+	t.Helper()
+	testLedger(t)
+	require.NoError(t, openCache(zlog.Logger))
+	require.True(t, persisting())
+	t.Cleanup(func() { cache = nil })
+}
+
+// restart forgets all in-memory caches, and loads them from the ledger.
+func restart(t *testing.T, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		(*xsync.MapOf[string, *Props])(props).Delete(key)
+	}
+
+	persistedProps = xsync.NewMapOf[cachedProps]()
+	etagCache = xsync.NewMapOf[etagPair]()
+	bannerMetadata = xsync.NewMapOf[cachedBanner]()
+	require.NoError(t, openCache(zlog.Logger))
+}
+
+func TestPersistedCache(t *testing.T) {
+	testCache(t)
+	ip := net.ParseIP("10.12.0.1")
+
+	data := Load(ip, map[string]string{"requesting_ip": ip.String()}, "team7", "secret")
+	data.Store("team_name", "Seven")
+	data.latestData.Store(time.Now().Add(-time.Minute).UnixNano())
+	data.validated.Store(time.Now().Add(-time.Minute).UnixNano())
+	persistProps(zlog.Logger, data)
+	storeEtag(zlog.Logger, "http://dj/teams/7", etagPair{Key: `"v1"`, Date: "yesterday"})
+
+	banner, err := os.Create(t.TempDir() + "/" + ip.String() + ".pdf")
+	require.NoError(t, err)
+	defer banner.Close()
+	_, err = banner.WriteString("%PDF-banner")
+	require.NoError(t, err)
+	storeBanner(zlog.Logger, data, banner)
+
+	// Credentials are never persisted
+	var keys []string
+	require.NoError(t, cache.Model(&cachedProps{}).Pluck("key", &keys).Error)
+	assert.Equal(t, []string{data.key}, keys)
+	assert.NotContains(t, keys[0], "secret")
+
+	restart(t, propsKey(ip.To4(), []string{"team7", "secret"}))
+
+	restored := Load(ip, map[string]string{"requesting_ip": ip.String()}, "team7", "secret")
+	require.NotSame(t, data, restored)
+	name, _ := restored.Load("team_name")
+	assert.Equal(t, "Seven", name)
+	assert.WithinDuration(t, data.LatestData(), restored.LatestData(), 0)
+	age, validated := restored.Staleness()
+	assert.True(t, validated)
+	assert.InDelta(t, time.Minute, age, float64(time.Second))
+	fresh, await := restored.revalidation()
+	assert.False(t, fresh)
+	assert.False(t, await, "restored data is used while it is revalidated")
+
+	etag, ok := loadEtag("http://dj/teams/7")
+	assert.True(t, ok)
+	assert.Equal(t, etagPair{Key: `"v1"`, Date: "yesterday"}, etag)
+
+	assert.True(t, bannerValid(restored, banner))
+
+	// Others using the same ip do not reuse the banner, nor do changed banners
+	other := Load(ip, nil, "team8", "secret")
+	assert.False(t, bannerValid(other, banner))
+	_, err = banner.WriteAt([]byte("changed"), 0)
+	require.NoError(t, err)
+	assert.False(t, bannerValid(restored, banner))
+}
+
+func TestCacheExpiry(t *testing.T) {
+	testCache(t)
+	old := time.Now().Add(-cacheExpiry - time.Hour)
+	require.NoError(t, cache.Create(&cachedProps{Key: "expired", Data: kvs{"a": "b"}, UpdatedAt: old}).Error)
+	require.NoError(t, cache.Create(&cachedEtag{Key: "expired", ETag: "x", UpdatedAt: old}).Error)
+	require.NoError(t, cache.Create(&cachedProps{Key: "recent", Data: kvs{"a": "b"}}).Error)
+
+	restart(t)
+	_, ok := persistedProps.Load("expired")
+	assert.False(t, ok)
+	_, ok = etagCache.Load("expired")
+	assert.False(t, ok)
+	_, ok = persistedProps.Load("recent")
+	assert.True(t, ok)
+
+	var count int64
+	require.NoError(t, cache.Model(&cachedProps{}).Count(&count).Error)
+	assert.EqualValues(t, 1, count, "expired entries are removed")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/puzpuzpuz/xsync"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+
+	"github.com/tuupke/pixie/crud"
+)
+
+// propsView is the admin representation of the Props of a client.
+type propsView struct {
+	ID         string            `json:"id"`
+	IP         string            `json:"ip"`
+	Identity   string            `json:"identity"`
+	Keys       int               `json:"keys"`
+	Data       map[string]string `json:"data,omitempty"`
+	Overrides  map[string]string `json:"overrides,omitempty"`
+	LatestData *time.Time        `json:"latest_data,omitempty"`
+	Validated  *time.Time        `json:"validated,omitempty"`
+	Banner     string            `json:"banner,omitempty"`
+}
+
+// view returns the admin representation of the Props, the key-value pairs are
+// only included when detailed.
+func (p *Props) view(detailed bool) propsView {
+	v := propsView{ID: p.key, IP: p.ip.String(), Identity: p.identity, Keys: p.Size()}
+	if latest := p.LatestData(); !latest.IsZero() {
+		v.LatestData = &latest
+	}
+
+	if validated := p.validated.Load(); validated != 0 {
+		t := time.Unix(0, validated)
+		v.Validated = &t
+	}
+
+	if meta, ok := bannerMetadata.Load(p.key); ok {
+		v.Banner = meta.File
+	}
+
+	if detailed {
+		v.Data, v.Overrides = p.Snapshot(), p.Overrides()
+	}
+
+	return v
+}
+
+// allProps returns all Props, ordered by ip and identity.
+func allProps() []*Props {
+	var all []*Props
+	(*xsync.MapOf[string, *Props])(props).Range(func(_ string, p *Props) bool {
+		all = append(all, p)
+		return true
+	})
+
+	slices.SortFunc(all, func(a, b *Props) int {
+		if c := strings.Compare(a.ip.String(), b.ip.String()); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.identity, b.identity)
+	})
+
+	return all
+}
+
+// loadProps retrieves the Props referenced by the id in the url.
+func loadProps(ctx *fasthttp.RequestCtx) *Props {
+	id := fmt.Sprint(ctx.UserValue("id"))
+	for _, p := range allProps() {
+		if p.key == id {
+			return p
+		}
+	}
+
+	crud.HandleError(ctx, http.StatusNotFound, fmt.Errorf("unknown client '%v'", id))
+	return nil
+}
+
+// listProps lists the Props of all clients, optionally filtered by the ip and
+// identity parameters.
+func listProps(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	ip, identity := string(args.Peek("ip")), string(args.Peek("identity"))
+
+	views := make([]propsView, 0)
+	for _, p := range allProps() {
+		if (ip == "" || sameIP(p.ip, ip)) && (identity == "" || p.identity == identity) {
+			views = append(views, p.view(false))
+		}
+	}
+
+	crud.Respond(ctx, views)
+}
+
+// getProps shows the key-value pairs of a single client.
+func getProps(ctx *fasthttp.RequestCtx) {
+	crud.Respond(ctx, loadProps(ctx).view(true))
+}
+
+// propsBanner streams the banner last rendered for the client.
+func propsBanner(ctx *fasthttp.RequestCtx) {
+	p := loadProps(ctx)
+	meta, ok := bannerMetadata.Load(p.key)
+	if !ok {
+		crud.HandleError(ctx, http.StatusNotFound, fmt.Errorf("no banner rendered"))
+	}
+
+	f, err := os.Open(meta.File)
+	crud.HandleError(ctx, http.StatusNotFound, err)
+	if !bannerValid(p, f) {
+		_ = f.Close()
+		crud.HandleError(ctx, http.StatusNotFound, fmt.Errorf("banner was replaced, render it again"))
+	}
+
+	ctx.SetContentType(formatPDF)
+	ctx.SetBodyStream(f, -1)
+}
+
+// patchProps overrides the keys in the JSON object of the body, keys set to null
+// are deleted. Overridden keys are no longer changed by webhooks.
+func patchProps(ctx *fasthttp.RequestCtx) {
+	p := loadProps(ctx)
+	var patch map[string]*string
+	crud.HandleError(ctx, http.StatusBadRequest, json.Unmarshal(ctx.PostBody(), &patch))
+
+	log := zlog.With().Str("client", p.key).IPAddr("for", p.ip).Logger()
+	for key, value := range patch {
+		if value == nil {
+			p.Forget(key)
+		} else {
+			p.Override(key, *value)
+		}
+
+		log.Info().Str("key", key).Interface("value", value).Msg("changed banner-data")
+	}
+
+	persistProps(log, p)
+	crud.Respond(ctx, p.view(true))
+}
+
+// deletePropsKey deletes a single key, including its override.
+func deletePropsKey(ctx *fasthttp.RequestCtx) {
+	p := loadProps(ctx)
+	key := fmt.Sprint(ctx.UserValue("key"))
+	p.Forget(key)
+
+	log := zlog.With().Str("client", p.key).IPAddr("for", p.ip).Logger()
+	log.Info().Str("key", key).Msg("deleted banner-data")
+	persistProps(log, p)
+	crud.Respond(ctx, p.view(true))
+}
+
+// refreshProps calls all webhooks for the client, and waits for them to finish.
+func refreshProps(ctx *fasthttp.RequestCtx) {
+	p := loadProps(ctx)
+	log := zlog.With().Str("client", p.key).IPAddr("for", p.ip).Logger()
+	log.Info().Msg("refreshing banner-data")
+	<-p.refresh(log, toCall)
+	crud.Respond(ctx, p.view(true))
+}
+
+// renderProps renders the banner of the client again.
+func renderProps(ctx *fasthttp.RequestCtx) {
+	p := loadProps(ctx)
+	log := zlog.With().Str("client", p.key).IPAddr("for", p.ip).Logger()
+	f, err := p.banner(log, true)
+	if f != nil {
+		_ = f.Close()
+	}
+
+	crud.HandleError(ctx, http.StatusInternalServerError, err)
+	crud.Respond(ctx, p.view(true))
+}
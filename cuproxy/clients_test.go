@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+// propsRequest executes the admin request, and decodes the Props in the
+// response.
+func propsRequest(t *testing.T, method, uri, body string) (*fasthttp.RequestCtx, propsView) {
+	t.Helper()
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	adminRouter().Handler(ctx)
+
+	var v propsView
+	if ctx.Response.StatusCode() == http.StatusOK && strings.HasPrefix(string(ctx.Response.Header.ContentType()), "application/json") {
+		require.NoError(t, json.Unmarshal(ctx.Response.Body(), &v))
+	}
+
+	return ctx, v
+}
+
+func TestPropsAdmin(t *testing.T) {
+	pdfLocation = t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"team_name": "Wrong team", "room": "A"}`))
+	}))
+	defer srv.Close()
+
+	old := toCall
+	toCall = endpointsSet{{{name: "team", method: http.MethodGet, url: srv.URL}}}
+	t.Cleanup(func() { toCall = old })
+
+	ip := net.ParseIP("10.13.0.1")
+	data := Load(ip, map[string]string{"requesting_ip": ip.String()}, "admin-team")
+	Load(net.ParseIP("10.13.0.2"), nil, "admin-other")
+
+	ctx := adminRequest(http.MethodGet, "/props?ip=10.13.0.1")
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	var list []propsView
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, data.key, list[0].ID)
+	assert.Equal(t, "admin-team", list[0].Identity)
+	assert.Nil(t, list[0].Data, "the list does not contain the data")
+
+	ctx, _ = propsRequest(t, http.MethodGet, "/props/unknown", "")
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+
+	// Refreshing calls the webhooks
+	_, v := propsRequest(t, http.MethodPost, "/props/"+data.key+"/refresh", "")
+	assert.Equal(t, "Wrong team", v.Data["team_name"])
+	assert.NotNil(t, v.Validated)
+
+	// Overrides are not changed by webhooks
+	_, v = propsRequest(t, http.MethodPatch, "/props/"+data.key, `{"team_name": "Right team", "room": null}`)
+	assert.Equal(t, map[string]string{"requesting_ip": "10.13.0.1", "team_name": "Right team"}, v.Data)
+	assert.Equal(t, map[string]string{"team_name": "Right team"}, v.Overrides)
+
+	_, v = propsRequest(t, http.MethodPost, "/props/"+data.key+"/refresh", "")
+	assert.Equal(t, "Right team", v.Data["team_name"])
+	assert.Equal(t, "A", v.Data["room"], "deleted keys are set by webhooks again")
+
+	_, v = propsRequest(t, http.MethodDelete, "/props/"+data.key+"/keys/team_name", "")
+	assert.NotContains(t, v.Data, "team_name")
+	assert.Empty(t, v.Overrides)
+
+	ctx, _ = propsRequest(t, http.MethodPatch, "/props/"+data.key, `["team_name"]`)
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+
+	// Banners are rendered on demand
+	ctx, _ = propsRequest(t, http.MethodGet, "/props/"+data.key+"/banner", "")
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+
+	_, v = propsRequest(t, http.MethodPost, "/props/"+data.key+"/render", "")
+	assert.Equal(t, pdfLocation+"/10.13.0.1.pdf", v.Banner)
+
+	ctx, _ = propsRequest(t, http.MethodGet, "/props/"+data.key+"/banner", "")
+	assert.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, formatPDF, string(ctx.Response.Header.ContentType()))
+	assert.True(t, strings.HasPrefix(string(ctx.Response.Body()), "%PDF"))
+
+	// The admin API changes the data while the webhooks refresh it
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		adminRequest(http.MethodPost, "/props/"+data.key+"/refresh")
+	}()
+
+	_, v = propsRequest(t, http.MethodPatch, "/props/"+data.key, `{"room": "B"}`)
+	wg.Wait()
+	assert.Equal(t, "B", v.Data["room"])
+	assert.NotNil(t, v.LatestData)
+}
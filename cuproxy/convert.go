@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/rs/zerolog"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	formatPDF        = "application/pdf"
+	formatPostScript = "application/postscript"
+	formatText       = "text/plain"
+	formatPWG        = "image/pwg-raster"
+	formatURF        = "image/urf"
+	formatPNG        = "image/png"
+	formatUnknown    = "application/octet-stream"
+
+	// sniffSize is the number of bytes at the start of a document used to
+	// detect its format.
+	sniffSize = 1024
+)
+
+// converter converts a document of a single format into a PDF. The title is
+// the name of the printed file, if known.
+type converter func(log zerolog.Logger, in io.Reader, out io.Writer, title string) error
+
+var (
+	nativeConversionDisabled = env.Bool("NATIVE_CONVERSION_DISABLED")
+
+	textFontSize        = env.FloatFb("TEXT_FONT_SIZE", 9)
+	textLineHeight      = pointsToUnits(textFontSize) * env.FloatFb("PDF_LINE_HEIGHT", 1.2)
+	textTabWidth        = env.IntFb("TEXT_TAB_WIDTH", 4)
+	textHideLineNumbers = env.Bool("TEXT_HIDE_LINE_NUMBERS")
+
+	// converters contains all natively supported formats.
+	converters = map[string]converter{
+		formatText: textToPDF,
+		formatPWG:  pwgToPDF,
+		formatURF:  urfToPDF,
+	}
+
+	// errPassThrough is returned when a document cannot be converted, but can be
+	// passed to the printer as-is.
+	errPassThrough = errors.New("document is passed through unconverted")
+)
+
+// convertToPDF converts contents to a PDF. The native converters are tried
+// first, cupsfilter is used as the fallback. PostScript documents are passed
+// through when cupsfilter is not configured, as most printers accept these.
+func convertToPDF(log zerolog.Logger, contents *io.SectionReader, documentFormat, title string) (*os.File, error) {
+	format := detectFormat(contents, documentFormat)
+	log = log.With().Str("format", format).Str("document-format", documentFormat).Logger()
+
+	if conv, ok := converters[format]; ok && !nativeConversionDisabled {
+		out, err := os.CreateTemp(spoolLocation, "cuproxy-converted-*")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create converted-file; %w", err)
+		}
+
+		_, _ = contents.Seek(0, io.SeekStart)
+		start := time.Now()
+		err = conv(log, bufio.NewReader(contents), out, title)
+		conversionDuration.WithLabelValues(format).Observe(time.Since(start).Seconds())
+		log.Err(err).Msg("converted natively")
+		if err == nil {
+			_, err = out.Seek(0, io.SeekStart)
+			return out, err
+		}
+
+		removeTemp(log, out)
+		if cupsfilter == "" {
+			return nil, fmt.Errorf("cannot convert '%v' to PDF; %w", format, err)
+		}
+	}
+
+	if cupsfilter == "" && format == formatPostScript {
+		return nil, errPassThrough
+	}
+
+	_, _ = contents.Seek(0, io.SeekStart)
+	return cupsConvert(log, contents, formatPDF, ppdLocation)
+}
+
+// detectFormat determines the format of the document, using the magic bytes
+// at the start of the document. The document-format sent by the client is only
+// used when the contents are inconclusive, since most clients send
+// "application/octet-stream".
+func detectFormat(r io.ReaderAt, documentFormat string) string {
+	head := make([]byte, sniffSize)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	// The document-format might contain parameters, e.g. "text/plain;charset=utf-8"
+	documentFormat, _, _ = strings.Cut(strings.ToLower(documentFormat), ";")
+	documentFormat = strings.TrimSpace(documentFormat)
+
+	switch {
+	case bytes.Contains(head, []byte("%PDF")):
+		return formatPDF
+	case bytes.HasPrefix(bytes.TrimLeft(head, "\x04"), []byte("%!")),
+		bytes.HasPrefix(head, []byte{0xC5, 0xD0, 0xD3, 0xC6}): // DOS EPS binary header
+		return formatPostScript
+	case bytes.HasPrefix(head, []byte(pwgSync)):
+		return formatPWG
+	case bytes.HasPrefix(head, []byte(urfSync)):
+		return formatURF
+	case strings.HasPrefix(documentFormat, "text/"),
+		(documentFormat == "" || documentFormat == formatUnknown) && isText(head):
+		return formatText
+	case documentFormat == "":
+		return formatUnknown
+	}
+
+	return documentFormat
+}
+
+// isText returns whether head looks like plain text, i.e. it is non-empty and
+// contains no control characters besides whitespace.
+func isText(head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+
+	for _, b := range head {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// textToPDF renders plain text, e.g. source code, using a monospace font. The
+// title, and page number, are printed in the header of every page. Each line
+// is prefixed with its line number, long lines are wrapped and a form-feed
+// starts a new page.
+func textToPDF(log zerolog.Logger, in io.Reader, out io.Writer, title string) error {
+	pdf := gofpdf.New("P", pdfUnit, pdfSize, pdfFontDir)
+	pdf.SetMargins(pdfLeftMargin, pdfTopMargin, pdfLeftMargin)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AliasNbPages("")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pageWidth, pageHeight := pdf.GetPageSize()
+	width := pageWidth - 2*pdfLeftMargin
+	bottom := pageHeight - pdfTopMargin
+
+	pdf.SetHeaderFunc(func() {
+		pdf.SetFont("Courier", "B", textFontSize)
+		pdf.SetXY(pdfLeftMargin, pdfTopMargin)
+		pdf.CellFormat(width*3/4, textLineHeight, tr(title), "", 0, "L", false, 0, "")
+		pdf.CellFormat(width/4, textLineHeight, fmt.Sprintf("%d/{nb}", pdf.PageNo()), "", 1, "R", false, 0, "")
+
+		y := pdf.GetY() + textLineHeight/4
+		pdf.Line(pdfLeftMargin, y, pageWidth-pdfLeftMargin, y)
+		pdf.SetY(y + textLineHeight/2)
+		pdf.SetFont("Courier", "", textFontSize)
+	})
+
+	pdf.AddPage()
+	columns := int(width / pdf.GetStringWidth("0"))
+
+	// write writes a single (wrapped) line, the number is omitted for
+	// continuations.
+	write := func(number string, line string) {
+		if pdf.GetY()+textLineHeight > bottom {
+			pdf.AddPage()
+		}
+
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(pdf.GetStringWidth(number), textLineHeight, number, "", 0, "L", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+		pdf.CellFormat(0, textLineHeight, tr(line), "", 1, "L", false, 0, "")
+	}
+
+	r := bufio.NewReader(in)
+	var lines int
+	for {
+		raw, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("cannot read text; %w", err)
+		}
+
+		if raw == "" && err == io.EOF {
+			break
+		}
+
+		lines++
+		number := ""
+		if !textHideLineNumbers {
+			number = fmt.Sprintf("%4d ", lines)
+		}
+
+		available := max(1, columns-len(number))
+		for k, page := range strings.Split(textLine(raw), "\f") {
+			if k > 0 {
+				pdf.AddPage()
+			}
+
+			runes := []rune(page)
+			for len(runes) > available {
+				write(number, string(runes[:available]))
+				runes = runes[available:]
+				number = strings.Repeat(" ", len(number))
+			}
+
+			write(number, string(runes))
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	log.Debug().Int("lines", lines).Int("pages", pdf.PageCount()).Msg("rendered text")
+	return pdf.Output(out)
+}
+
+// textLine strips the line ending, and expands tabs. Lines that are not valid
+// UTF-8 are assumed to be Latin-1.
+func textLine(raw string) string {
+	raw = strings.TrimRight(raw, "\r\n")
+	if !utf8.ValidString(raw) {
+		runes := make([]rune, len(raw))
+		for k := 0; k < len(raw); k++ {
+			runes[k] = rune(raw[k])
+		}
+
+		raw = string(runes)
+	}
+
+	if !strings.Contains(raw, "\t") {
+		return raw
+	}
+
+	var b strings.Builder
+	var column int
+	for _, c := range raw {
+		switch c {
+		case '\t':
+			n := textTabWidth - column%max(1, textTabWidth)
+			b.WriteString(strings.Repeat(" ", n))
+			column += n
+		case '\f':
+			b.WriteRune(c)
+			column = 0
+		default:
+			b.WriteRune(c)
+			column++
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectFormat(t *testing.T) {
+	for name, tc := range map[string]struct {
+		contents, documentFormat, expected string
+	}{
+		"pdf":                  {"%PDF-1.7\n", "application/octet-stream", formatPDF},
+		"postscript":           {"%!PS-Adobe-3.0\n", "", formatPostScript},
+		"postscript with ^D":   {"\x04%!PS-Adobe-3.0\n", "", formatPostScript},
+		"dos eps":              {"\xC5\xD0\xD3\xC6\x00\x00", "", formatPostScript},
+		"pwg":                  {pwgSync + "\x00\x00", "application/octet-stream", formatPWG},
+		"urf":                  {urfSync + "\x00\x00\x00\x01", "", formatURF},
+		"source code":          {"#include <cstdio>\n\nint main() {\n\treturn 0;\n}\n", "application/octet-stream", formatText},
+		"text with charset":    {"\x00\x01", "text/plain; charset=utf-8", formatText},
+		"text/x-c":             {"int x;", "text/x-c", formatText},
+		"binary":               {"\x00\x01\x02", "", formatUnknown},
+		"unknown keeps format": {"\x00\x01\x02", "image/jpeg", "image/jpeg"},
+		"empty":                {"", "", formatUnknown},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, detectFormat(strings.NewReader(tc.contents), tc.documentFormat))
+		})
+	}
+}
+
+func TestTextLine(t *testing.T) {
+	textTabWidth = 4
+	assert.Equal(t, "int main() {", textLine("int main() {\r\n"))
+	assert.Equal(t, "    return;", textLine("\treturn;\n"))
+	assert.Equal(t, "ab  c", textLine("ab\tc"))
+	assert.Equal(t, "café", textLine("caf\xe9"))
+}
+
+func TestTextToPDF(t *testing.T) {
+	var text strings.Builder
+	for k := 0; k < 100; k++ {
+		text.WriteString("\tstd::cout << \"hello world\" << std::endl;\n")
+	}
+
+	text.WriteString(strings.Repeat("x", 500) + "\n\fafter a form-feed\n")
+
+	var out bytes.Buffer
+	require.NoError(t, textToPDF(zerolog.Nop(), strings.NewReader(text.String()), &out, "main.cpp"))
+
+	pages, err := pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pages)
+
+	// An empty document still results in a page
+	out.Reset()
+	require.NoError(t, textToPDF(zerolog.Nop(), strings.NewReader(""), &out, ""))
+	pages, err = pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pages)
+}
+
+// encodeRaster compresses pixel lines using only literal runs, except for
+// completely white lines which use the clear-line command.
+func encodeRaster(lines [][]byte, unit int) []byte {
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.WriteByte(0)
+		if bytes.Count(line, []byte{0xFF}) == len(line) {
+			b.WriteByte(0x80)
+			continue
+		}
+
+		for len(line) > 0 {
+			n := min(len(line)/unit, 128)
+			b.WriteByte(byte(257 - n))
+			b.Write(line[:n*unit])
+			line = line[n*unit:]
+		}
+	}
+
+	return b.Bytes()
+}
+
+func TestDecodeRaster(t *testing.T) {
+	p := &rasterPage{width: 3, height: 4, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 9, space: spaceRGB, dpiX: 72, dpiY: 72}
+
+	// Line 1 is repeated twice, using a run of 2 pixels and a run of 1 pixel.
+	// Line 3 is cleared.
+	data := []byte{
+		1, 0x01, 0x10, 0x20, 0x30, 0x00, 0x00, 0x00, 0x00,
+		0, 0x80,
+		0, 0x02, 0x00, 0x00, 0xFF,
+	}
+
+	img, err := p.decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xFF}, img.At(0, 0))
+	assert.Equal(t, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xFF}, img.At(1, 1))
+	assert.Equal(t, color.NRGBA{A: 0xFF}, img.At(2, 1))
+	assert.Equal(t, color.NRGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}, img.At(1, 2))
+	assert.Equal(t, color.NRGBA{B: 0xFF, A: 0xFF}, img.At(2, 3))
+
+	// 1 bit black, a set bit is black
+	p = &rasterPage{width: 10, height: 1, bitsPerColor: 1, bitsPerPixel: 1, bytesPerLine: 2, space: spaceBlack, dpiX: 72, dpiY: 72}
+	img, err = p.decode(bytes.NewReader([]byte{0, 0xFF, 0x80, 0x40}))
+	require.NoError(t, err)
+	assert.Equal(t, color.Gray{Y: 0x00}, img.At(0, 0))
+	assert.Equal(t, color.Gray{Y: 0xFF}, img.At(1, 0))
+	assert.Equal(t, color.Gray{Y: 0x00}, img.At(9, 0))
+
+	// Runs must not exceed the line
+	p = &rasterPage{width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 8, bytesPerLine: 2, space: spaceGray, dpiX: 72, dpiY: 72}
+	_, err = p.decode(bytes.NewReader([]byte{0, 0x05, 0x00}))
+	assert.ErrorIs(t, err, errRasterOverflow)
+
+	_, err = p.decode(bytes.NewReader([]byte{0, 0xFE}))
+	assert.Error(t, err)
+}
+
+func TestDecodeMalformedRaster(t *testing.T) {
+	// Every page is 2 pixels of RGB, the data would fit the line
+	data := []byte{0, 0x01, 0x10, 0x20, 0x30}
+	for name, p := range map[string]rasterPage{
+		"no pixels":                {width: 0, height: 1, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 0, space: spaceRGB},
+		"too large":                {width: 1 << 31, height: 1 << 31, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 6, space: spaceRGB},
+		"bits per color":           {width: 2, height: 1, bitsPerColor: 4, bitsPerPixel: 12, bytesPerLine: 3, space: spaceRGB},
+		"1 bit color":              {width: 2, height: 1, bitsPerColor: 1, bitsPerPixel: 3, bytesPerLine: 1, space: spaceRGB},
+		"bits per pixel too small": {width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 8, bytesPerLine: 6, space: spaceRGB},
+		"bits per pixel too large": {width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 32, bytesPerLine: 8, space: spaceRGB},
+		"16 bit channels":          {width: 2, height: 1, bitsPerColor: 16, bitsPerPixel: 24, bytesPerLine: 6, space: spaceRGB},
+		"short line":               {width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 5, space: spaceRGB},
+		"long line":                {width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 7, space: spaceRGB},
+		"gray line":                {width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 6, space: spaceGray},
+		"cmyk line":                {width: 2, height: 1, bitsPerColor: 8, bitsPerPixel: 24, bytesPerLine: 6, space: spaceCMYK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p.dpiX, p.dpiY = 72, 72
+			_, err := p.decode(bytes.NewReader(data))
+			assert.Error(t, err)
+		})
+	}
+
+	// The decoded page must fit the memory budget, whatever its pixel count
+	maxRequestSize = 1 << 10
+	t.Cleanup(func() { maxRequestSize = 128 << 20 })
+	p := &rasterPage{width: 32, height: 32, bitsPerColor: 16, bitsPerPixel: 64, bytesPerLine: 256, space: spaceCMYK, dpiX: 72, dpiY: 72}
+	_, err := p.decode(bytes.NewReader(data))
+	assert.ErrorContains(t, err, "needs 12288 bytes to decode")
+
+	p = &rasterPage{width: 32, height: 32, bitsPerColor: 8, bitsPerPixel: 8, bytesPerLine: 32, space: spaceGray, dpiX: 72, dpiY: 72}
+	_, err = p.decode(bytes.NewReader([]byte{31, 0x80}))
+	assert.NoError(t, err, "2048 bytes are within the budget")
+
+	// A 1 bit line is rounded up to whole bytes
+	p = &rasterPage{width: 9, height: 1, bitsPerColor: 1, bitsPerPixel: 1, bytesPerLine: 2, space: spaceGray, dpiX: 72, dpiY: 72}
+	_, err = p.decode(bytes.NewReader([]byte{0, 0x01, 0x00}))
+	assert.NoError(t, err)
+
+	// The PWG header is validated as well
+	header := make([]byte, pwgHeaderSize)
+	for offset, v := range map[int]uint32{276: 72, 280: 72, 372: 2, 376: 1, 384: 8, 388: 8, 392: 6, 400: 19} {
+		binary.BigEndian.PutUint32(header[offset:], v)
+	}
+
+	stream := append(append([]byte(pwgSync), header...), data...)
+	assert.ErrorContains(t, pwgToPDF(zerolog.Nop(), bytes.NewReader(stream), &bytes.Buffer{}, ""), "8 bits per pixel do not match 3 colors")
+}
+
+func TestRasterToPDF(t *testing.T) {
+	const width, height = 16, 8
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	lines := make([][]byte, height)
+	for y := range lines {
+		lines[y] = img.Pix[y*img.Stride : (y+1)*img.Stride]
+		for x := range lines[y] {
+			lines[y][x] = byte(x * 16)
+		}
+	}
+
+	lines[height-1] = bytes.Repeat([]byte{0xFF}, width)
+	page := encodeRaster(lines, 1)
+
+	t.Run("pwg", func(t *testing.T) {
+		header := make([]byte, pwgHeaderSize)
+		for offset, v := range map[int]uint32{276: 72, 280: 72, 372: width, 376: height, 384: 8, 388: 8, 392: width, 400: 18} {
+			binary.BigEndian.PutUint32(header[offset:], v)
+		}
+
+		stream := []byte(pwgSync)
+		for k := 0; k < 2; k++ {
+			stream = append(append(stream, header...), page...)
+		}
+
+		var out bytes.Buffer
+		require.NoError(t, pwgToPDF(zerolog.Nop(), bytes.NewReader(stream), &out, ""))
+		pages, err := pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2, pages)
+	})
+
+	t.Run("urf", func(t *testing.T) {
+		header := make([]byte, urfHeaderSize)
+		header[0], header[1] = 8, 0
+		binary.BigEndian.PutUint32(header[12:], width)
+		binary.BigEndian.PutUint32(header[16:], height)
+		binary.BigEndian.PutUint32(header[20:], 72)
+
+		stream := append([]byte(urfSync), 0, 0, 0, 1)
+		stream = append(append(stream, header...), page...)
+
+		var out bytes.Buffer
+		require.NoError(t, urfToPDF(zerolog.Nop(), bytes.NewReader(stream), &out, ""))
+		pages, err := pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, pages)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		header := make([]byte, urfHeaderSize)
+		header[0] = 8
+		binary.BigEndian.PutUint32(header[12:], width)
+		binary.BigEndian.PutUint32(header[16:], height)
+		binary.BigEndian.PutUint32(header[20:], 72)
+
+		stream := append(append([]byte(urfSync), 0, 0, 0, 1), header...)
+		stream = append(stream, page[:len(page)/2]...)
+		assert.Error(t, urfToPDF(zerolog.Nop(), bytes.NewReader(stream), &bytes.Buffer{}, ""))
+		assert.Error(t, urfToPDF(zerolog.Nop(), bytes.NewReader([]byte(urfSync)), &bytes.Buffer{}, ""))
+	})
+}
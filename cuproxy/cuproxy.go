@@ -1,18 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"runtime/debug"
-	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/fasthttp/router"
 	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
@@ -23,21 +27,21 @@ import (
 
 	"github.com/tuupke/pixie/env"
 	"github.com/tuupke/pixie/lifecycle"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
 )
 
 var (
 	cupsListen = env.StringFb("LISTEN", ":631")
 	printerTo  = env.String("PRINTER_TO")
 
-	to = btsReplace([]byte("ipp://" + printerTo))
-
 	dumpsPath        = env.StringFb("DUMP_IPP_CONTENTS", "")
 	dumpReplacements = env.Bool("DUMP_REPLACEMENTS")
 	dumpOriginal     = env.Bool("DUMP_ORIGINAL")
 	appendBanner     = env.Bool("BANNER_APPEND")
 	bannerOnBack     = env.Bool("BANNER_ON_BACK")
 	cupsfilter       = env.String("CUPSFILTER_LOCATION")
-	maxRequestSize   = 128 << 20 // env.IntFb("MAX_REQUEST_SIZE", 128<<20) // 128 MiB
+	maxRequestSize   = env.IntFb("MAX_REQUEST_SIZE", 128<<20) // 128 MiB
 	seqId            = new(uint64)
 	numPrints        = new(uint64)
 	ppdLocation      = env.StringFb("PPD_LOCATION", "/usr/share/ppd/cupsfilters/Generic-PDF_Printer-PDF.ppd")
@@ -67,6 +71,18 @@ func main() {
 		zlog.Fatal().Err(err).Str("pdf-folder", pdfLocation).Msg("cannot create pdf-folder")
 	}
 
+	if err := os.MkdirAll(spoolLocation, 0755); err != nil {
+		zlog.Fatal().Err(err).Str("spool-folder", spoolLocation).Msg("cannot create spool-folder")
+	}
+
+	if err := openLedger(zlog.Logger); err != nil {
+		zlog.Fatal().Err(err).Msg("ledger is required")
+	}
+
+	if err := openCache(zlog.Logger); err != nil {
+		zlog.Fatal().Err(err).Msg("cannot load cache")
+	}
+
 	routes := router.New()
 	routes.PanicHandler = func(ctx *fasthttp.RequestCtx, i interface{}) {
 		zlog.Error().Interface("error", i).Msg("received panic")
@@ -93,103 +109,165 @@ func main() {
 	// Create and start the webserver
 	server := fasthttp.Server{
 		Handler:            routes.Handler,
-		MaxRequestBodySize: maxRequestSize,
+		MaxRequestBodySize: bufferedRequestSize,
+		StreamRequestBody:  true,
 	}
 
-	ln, err := net.Listen("tcp4", cupsListen)
+	ln, err := net.Listen("tcp", cupsListen)
 	if err != nil {
 		zlog.Fatal().Err(err).Msg("cups proxy cannot be started")
 	}
 
+	tlsConfig, err := listenerConfig(zlog.Logger)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("cups proxy cannot use tls")
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
 	lifecycle.EFinally(ln.Close)
-	zlog.Info().Msg("started cups proxy")
+	zlog.Info().Str("scheme", listenScheme()).Msg("started cups proxy")
 	go server.Serve(ln)
 
+	serveAdmin()
+	serveMetrics()
+
+	go pollPrinters(lifecycle.ApplicationContext(), zlog.Logger)
+	go janitor(lifecycle.ApplicationContext(), zlog.Logger)
+
 	zlog.Info().Str("printer to", printerTo).Str("listen", cupsListen).Int("max_body_size", maxRequestSize).Msg("Booted")
 	lifecycle.Finally(func() { zlog.Warn().Msg("Stopping") })
 	lifecycle.StopListener()
 }
 
-// Byter is an interface around the `Bytes` method returning a byte slice. Used
-// for more consistent logging of request/response contents.
-type (
-	Byter interface {
-		Bytes() []byte
-	}
-	byteSlice []byte
-)
-
-func (b byteSlice) Bytes() []byte {
-	return b
-}
+func cupsHandler(ctx *fasthttp.RequestCtx) {
+	seqId := atomic.AddUint64(seqId, 1)
+	atomic.AddUint64(numPrints, 1)
 
-func writeToFile[T Byter](seqId uint64, request, replaced bool, contents T) error {
-	if dumpsPath == "" || (replaced && !dumpReplacements) || (!replaced && !dumpOriginal) {
-		return nil
-	}
+	// Construct a logger
+	path := bytes.Trim(ctx.Request.URI().Path(), "/")
+	requestedUrl := fmt.Sprintf("%s://%s/%s", listenScheme(), cupsListen, path)
+	log := zlog.With().IPAddr("ip", ctx.RemoteIP()).Str("url", requestedUrl).Uint64("seq-id", seqId).Logger()
 
-	var req, typ = "res", "orig"
-	if request {
-		req = "req"
+	stream, err := requestBody(ctx)
+	if err != nil {
+		log.Warn().Err(err).Int("content_length", ctx.Request.Header.ContentLength()).Msg("refusing request")
+		ctx.SetStatusCode(http.StatusRequestEntityTooLarge)
+		return
 	}
 
-	if replaced {
-		typ = "repl"
+	origDump, err := dumpFile(seqId, true, false)
+	log.Debug().Err(err).Msg("opened dump of original request")
+	defer origDump.Close()
+	body := bufio.NewReader(io.TeeReader(countingReader{stream, receivedBytes}, origDump))
+
+	// Decode the IPP request, anything that is not IPP (e.g. the CUPS web
+	// interface) is proxied as-is. The preamble is kept to be able to replay it.
+	var preamble bytes.Buffer
+	msg, err := ipp.Decode(io.TeeReader(body, &preamble))
+	isIPP := err == nil
+	log.Debug().Err(err).Int("data_start", preamble.Len()).Msg("decoded request")
+
+	var operationId ipp.Operation
+	if isIPP {
+		operationId = msg.Operation()
+		log = log.With().Stringer("operation-id", operationId).Logger()
+		operationsTotal.WithLabelValues(operationId.String()).Inc()
 	}
 
-	name := fmt.Sprintf("%v/%v-%v-%v.bin", dumpsPath, seqId, req, typ)
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		return fmt.Errorf("could not open dump-file '%v'; %w", name, err)
-	}
+	var jobId int32
+	var job *Job
+	isCreate := operationId == ipp.OperationCreateJob
+	isPrint := operationId == ipp.OperationPrintJob || operationId == ipp.OperationSendDocument
+
+	// Requests referencing a job are sent to the printer of the job, new jobs
+	// are distributed over the printers. Anything else is sent to the first
+	// available printer.
+	target := defaultPrinter()
+	var hasJobId, migrated bool
+
+	// Rewrite the printer-uri to point to the actual printer, the uri the client
+	// used is needed to rewrite the response.
+	if isIPP {
+		if uri := msg.Attribute(ipp.TagOperation, "printer-uri").String(); uri != "" {
+			requestedUrl = uri
+		}
 
-	defer f.Close()
-	if _, err := f.Write(contents.Bytes()); err != nil {
-		return fmt.Errorf("could not write to dump-file '%v'; %w", name, err)
-	}
+		var p *printer
+		if p, jobId, hasJobId = routeJob(msg); p != nil {
+			target = p
+		} else if isCreate || operationId == ipp.OperationPrintJob {
+			target = selectPrinter(LoadFromRequest(ctx))
+		}
 
-	return nil
-}
+		log = log.With().Str("printer", target.name).Logger()
+		rewriteURIs(msg, requestedUrl, target.uri)
 
-func cupsHandler(ctx *fasthttp.RequestCtx) {
-	seqId := atomic.AddUint64(seqId, 1)
-	atomic.AddUint64(numPrints, 1)
-	body := slices.Clone(ctx.Request.Body())
+		if operationId == ipp.OperationCancelJob && hasJobId {
+			forgetPromise(log, jobId)
+		}
 
-	// Extract the type of operation. Consider extracting operation into a custom type for improved readability.
-	var operationId byte
-	if len(body) > 3 {
-		operationId = body[3]
+		// Jobs that did not reach the printer are answered by cuproxy, jobs that
+		// moved to another printer are asked to that printer.
+		if operationId == ipp.OperationGetJobAttributes && hasJobId {
+			if known, found := knownJob(jobId, ctx.RemoteIP().String()); found {
+				if _, _, _, own := jobState(known); own {
+					log.Debug().Int32("job-id", jobId).Str("status", known.Status).Msg("answering job attributes")
+					respondIPP(ctx, jobAttributesResponse(msg, known, requestedUrl))
+					return
+				}
+
+				if p := printerNamed(known.Printer); p != nil && known.UpstreamJobID != 0 {
+					rewriteURIs(msg, target.uri, p.uri)
+					setRequestJobId(msg, known.UpstreamJobID)
+					target = p
+					log = log.With().Str("printer", target.name).Logger()
+				}
+			}
+		}
 	}
-	var jobId int32
-	isCreate := operationId == 0x05
-	isPrint := operationId == 0x02 || operationId == 0x06
-
-	// Construct a logger
-	path := bytes.Trim(ctx.Request.URI().Path(), "/")
-	requestedUrl := fmt.Sprintf("ipp://%s/%s", cupsListen, path)
-	log := zlog.With().IPAddr("ip", ctx.RemoteIP()).Str("url", requestedUrl).Uint64("seq-id", seqId).Logger()
 
-	// Replace the url in the body, the actual printer's url is constant so does not
-	// need to be rebuilt every request.
-	from := btsReplace([]byte(requestedUrl))
-	log.Debug().Err(writeToFile[byteSlice](seqId, true, false, body)).Msg("written original request")
-	body = bytes.Replace(body, from, to, -1)
+	// The proxied body, and its length. A negative length depicts an unknown
+	// length.
+	var proxiedBody io.Reader
+	proxiedLength := int64(-1)
+	if cl := ctx.Request.Header.ContentLength(); cl >= 0 {
+		proxiedLength = int64(cl)
+	}
 
-	var b *bytes.Buffer
-	if !isPrint {
+	if !isIPP {
+		// Not IPP, replay what has been read and proxy the rest.
+		proxiedBody = io.MultiReader(&preamble, body)
+	} else if !isPrint {
 		// Base case, simply proxy the entire request.
-		b = bytes.NewBuffer(body)
+		proxiedBody = io.MultiReader(bytes.NewReader(msg.Bytes()), body)
+		if proxiedLength >= 0 {
+			proxiedLength += int64(msg.Size() - preamble.Len())
+		}
 	} else {
 		// An actual print job.
 
 		// Retrieve the data
 		var v promiseInteraction
-		var found bool
-		jobId, found = extractInt("job-id", body)
+		found := hasJobId
 		log := log.With().Int32("job-id", jobId).Bool("job-id-found", found).Logger()
 		log.Info().Msg("print triggered")
 
+		job = &Job{
+			SeqID:        seqId,
+			JobID:        jobId,
+			Operation:    operationId.String(),
+			RequestingIP: ctx.RemoteIP().String(),
+			User:         msg.Attribute(ipp.TagOperation, "requesting-user-name").String(),
+			JobName:      msg.Attribute(ipp.TagOperation, "job-name").String(),
+		}
+
+		if job.JobName == "" {
+			job.JobName = msg.Attribute(ipp.TagOperation, "document-name").String()
+		}
+
 		if !found {
 			log.Error().Msg("got print and cannot extract job-id, unusual")
 			v = loadValues(log, ctx, jobId)
@@ -201,6 +279,24 @@ func cupsHandler(ctx *fasthttp.RequestCtx) {
 			}
 		}
 
+		// The job is complete once its last document is received, the promise
+		// is no longer needed.
+		if last, _ := msg.Attribute(ipp.TagOperation, "last-document").Bool(); last && found {
+			requestPromises.Delete(jobId)
+		}
+
+		if job.JobName == "" && v.create != nil {
+			job.JobName = v.create.Attribute(ipp.TagOperation, "job-name").String()
+		}
+
+		// Documents of jobs created using Create-Job must be cancelled on the
+		// printer when they are not forwarded.
+		createdUpstream := operationId == ipp.OperationSendDocument && jobId != 0
+		cancelCreated := func() {
+			_, upstreamId := upstreamJob(jobId)
+			_ = cancelUpstream(log, target, upstreamId, job.User)
+		}
+
 		// Handling a print job is not trivial. There are two 'problematic' issues to account for:
 		//  1. The client might (and is allowed to) ignore that 'application/pdf' is the
 		//     only supported mime-type. i.e. conversion from some mime-type to 'application/pdf'
@@ -208,147 +304,455 @@ func cupsHandler(ctx *fasthttp.RequestCtx) {
 		//  2. PJL can 'wrap' print-jobs. i.e. PJL must be detected and unwrapped when
 		//    used. It is possible that after conversion, the job is in PJL again.
 		//
-		// Conversion to application/pdf is a whole can of worms. `cupsfilters` and an
-		// appropriate ppd are used to do this step.
+		// Conversion to application/pdf is a whole can of worms. Plain text and
+		// raster documents are converted natively, `cupsfilters` and an appropriate
+		// ppd are used for everything else.
 		//
 		// The rendered banner-page is then stitched to the to-be-printed PDF using
-		// PDFCPU, then passed to the actual printer.
+		// PDFCPU, then passed to the actual printer. To keep memory usage low, all
+		// intermediate documents are spooled to disk.
 
-		// Extract the to-be-printed file. This file is at the end of the IPP request,
+		// Spool the to-be-printed file. This file is at the end of the IPP request,
 		// but might be a PJL job.
-		startOfData, err := dataOffset(body)
-		log.Debug().Err(err).Int("data_start", startOfData).Msg("found offset")
+		doc, size, err := spool(body, "cuproxy-doc-*")
+		defer removeTemp(log, doc)
+		log.Debug().Err(err).Int64("size", size).Msg("spooled document")
 		if err != nil {
-			log.Panic().Err(err).Int("data_start", startOfData).Msg("could not extract start of data")
-			panic(err)
-		}
+			status := http.StatusInternalServerError
+			if errors.Is(err, errRequestTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
 
-		// Create a new body buffer and keep the IPP preamble.
-		// Do not handle the thrown error even though the job can now fail.
-		newB := bytes.NewBuffer(make([]byte, 0, len(body)+startOfData+2048))
-		num, err := newB.Write(body[:startOfData])
-		log.Trace().Err(err).Int("num", num).Msg("written preamble of request to new body")
-		if err != nil {
-			log.Err(err).Int("num", num).Msg("written preamble of request to new body")
+			ctx.SetStatusCode(status)
+			return
 		}
 
-		// Extract the
-		var contents = make([]byte, len(body)-startOfData)
-		copy(contents, body[startOfData:])
-
-		var prefix, suffix []byte
+		job.OriginalSize = size
 
-		oLen := len(contents)
 		// Body might contain PJL, needs to be kept but stripped
-		prefix, suffix, contents, err = extractPJL(contents)
+		prefix, contents, suffix, err := extractPJL(doc, size)
 		log.Err(err).
-			Int("prefix_len", len(prefix)).
-			Int("suffix_len", len(suffix)).
-			Int("contents_len", len(contents)).
-			Int("original_len", oLen).
+			Int64("prefix_len", prefix.Size()).
+			Int64("suffix_len", suffix.Size()).
+			Int64("contents_len", contents.Size()).
+			Int64("original_len", size).
 			Msg("extracted PJL body from print-job")
 
-		num, err = newB.Write(prefix)
-		log.Trace().Err(err).Int("num", num).Msg("written prefix of request to new body")
-		if err != nil {
-			log.Err(err).Int("num", num).Msg("could not write prefix of request to new body")
-		}
-
 		// PDF start with "%PDF" and end with "%%EOF"
-		if pdfStart := bytes.Index(contents, []byte("%PDF")); pdfStart < 0 {
-			contents, err = cupsConvert(log, contents, "application/pdf", ppdLocation)
+		passThrough := false
+		if !isPDF(contents) {
+			format := msg.Attribute(ipp.TagOperation, "document-format").String()
+			converted, err := convertToPDF(log, contents, format, job.JobName)
+			defer removeTemp(log, converted)
 			log.Err(err).Msg("converted contents to PDF")
-			if err != nil {
+			passThrough = errors.Is(err, errPassThrough)
+			if err != nil && !passThrough {
 				log.Panic().Msg("conversion to pdf is required")
 			}
 
-			// Might contain pjl. If so, strip away the PJL.
-			_, _, contents, err = extractPJL(contents)
-			if err != nil {
-				log.Err(err).Msg("could not unwrap converted pdf from PJL")
+			if !passThrough {
+				// Might contain pjl. If so, strip away the PJL.
+				fi, err := converted.Stat()
+				if err != nil {
+					log.Panic().Err(err).Msg("cannot stat converted pdf")
+				}
+
+				_, contents, _, err = extractPJL(converted, fi.Size())
+				if err != nil {
+					log.Err(err).Msg("could not unwrap converted pdf from PJL")
+				}
+
+				// The printer must not convert the document again
+				if op := msg.Group(ipp.TagOperation); op.Attribute("document-format") != nil {
+					op.Set("document-format", ipp.String(ipp.TagMimeMediaType, formatPDF))
+				}
 			}
 		}
 
-		// It must now hold that `contents` contains a PDF.
-		pdfReader := bytes.NewReader(contents)
+		// It must now hold that `contents` contains a PDF, unless it is passed through.
+		pagesCounted := false
+		if !passThrough {
+			job.Pages, err = pdfcpu.PageCount(contents, nil)
+			pagesCounted = err == nil
+			log.Err(err).Int("pages", job.Pages).Msg("counted pages")
+			job.Impressions = job.Pages
+			_, _ = contents.Seek(0, io.SeekStart)
+		}
 
 		// The to-be-printed document is ready, retrieve, or wait for the rendering of,
 		// the banner-pdf.
 		v.callItIn()
 		filePointer, err := v.pdfPromise.Await(lifecycle.ApplicationContext())
 		log.Err(err).Msg("retrieved PDF to stitch")
+		if v.data != nil {
+			job.Props = v.data.Snapshot()
+			job.Identity = v.data.Identity()
+		}
+
+		// A banner cannot be stitched to a document that is passed through.
+		if passThrough && filePointer != nil {
+			log.Warn().Msg("document is passed through, banner is not printed")
+			_ = (*filePointer).Close()
+			filePointer = nil
+		}
+
+		// Job specific data printed on the banner.
+		extra := make(map[string]string)
+
+		// Fail over when the printer became unavailable, jobs created using
+		// Create-Job are cancelled and moved to the other printer as a Print-Job.
+		// With the sticky strategy, the data is needed to select the printer.
+		if len(printers) > 1 {
+			var data bannerData
+			if v.data != nil {
+				data = v.data
+			}
+
+			if p := target; !p.available() || (operationId == ipp.OperationPrintJob && printerStrategy == strategySticky) {
+				target = selectPrinter(data)
+				migrated = createdUpstream && target != p
+				log.Info().Str("from", p.name).Str("to", target.name).Bool("migrated", migrated).Msg("selected printer")
+
+				if migrated {
+					_, upstreamId := upstreamJob(jobId)
+					_ = cancelUpstream(log, p, upstreamId, job.User)
+					msg, createdUpstream = printRequest(msg, v.create), false
+				}
 
-		// If no banner page exists, skip stitching, and (by default) pass the original print to the printer.
+				rewriteURIs(msg, p.uri, target.uri)
+			}
+
+			extra["printer"] = target.name
+		}
+
+		job.Printer = target.name
+
+		// Identify the job on the banner, allowing its delivery to be scanned.
+		if deliveryCodes {
+			var data bannerData
+			if v.data != nil {
+				data = v.data
+			}
+
+			maps.Copy(extra, deliveryData(job, data))
+		}
+
+		// reject records the job as rejected for the job.Reason, and tells the
+		// client.
+		reject := func(status ipp.Status) {
+			if filePointer != nil {
+				_ = (*filePointer).Close()
+			}
+
+			if createdUpstream {
+				cancelCreated()
+			}
+
+			job.Status = JobRejected
+			recordJob(log, job)
+			rejectJob(ctx, msg, status, job.Reason)
+		}
+
+		// All jobs are held when the operator must approve them.
+		hold := holdJobs
+
+		// Apply the content policy to the document. Violating jobs are either
+		// rejected, held, or flagged and printed with the violation on the banner.
+		// Documents that are passed through, or cannot be inspected otherwise,
+		// violate the policy.
+		if policyEnabled() {
+			reason := "document cannot be converted to PDF to be inspected"
+			if !passThrough {
+				doc, err := inspectDocument(log, contents, job.Pages)
+				log.Err(err).Bool("encrypted", doc.encrypted).Int("images", doc.images).Int("text", len(doc.text)).Msg("inspected document")
+				reason = "document cannot be inspected"
+				if err == nil {
+					reason = doc.violation(log, contents)
+				}
+			}
+
+			if reason != "" {
+				job.Reason = reason
+				log.Warn().Str("reason", reason).Str("action", policyAction).Msg("document violates content policy")
+				switch policyAction {
+				case policyReject:
+					reject(ipp.StatusClientErrorForbidden)
+					return
+				case policyHold:
+					hold = true
+				case policyFlag:
+					job.Flagged = true
+					extra["policy_violation"] = reason
+				}
+			}
+		}
+
+		// The banner, and every copy, start on a fresh sheet.
+		attrs := msg
+		if v.create != nil {
+			attrs = v.create
+		}
+
+		layout := jobLayout(attrs)
+		job.Copies = layout.copies
+
+		// Enforce the quota of the identity. Jobs exceeding the quota are either
+		// rejected or held, the remaining quota is printed on the banner. Every
+		// copy counts, jobs of which the pages cannot be counted exceed the page
+		// limits. Jobs of the identity wait for the job to be recorded, such that
+		// concurrent jobs cannot exceed the quota together.
+		if quotaEnabled() {
+			unlock := lockQuota(job.Identity)
+			defer unlock()
+
+			q, err := loadQuota(job.Identity)
+			log.Err(err).Str("identity", job.Identity).Int("jobs", q.jobs).Int("pages", q.pages).Msg("loaded quota")
+
+			pages := -1
+			if pagesCounted {
+				pages = job.Pages * layout.copies
+			}
+
+			if reason := q.exceeded(pages); reason != "" {
+				job.Reason = reason
+				if quotaExceeded == quotaReject {
+					log.Warn().Str("reason", job.Reason).Msg("rejecting job, quota exceeded")
+					reject(ipp.StatusClientErrorNotPossible)
+					return
+				}
+
+				hold = true
+			}
+
+			maps.Copy(extra, q.remaining(max(pages, 0)))
+		}
+
+		for k, val := range extra {
+			if job.Props != nil {
+				job.Props[k] = val
+			}
+		}
+
+		if len(extra) > 0 && filePointer != nil && v.data != nil {
+			_ = (*filePointer).Close()
+			banner, err := jobBanner(log, v.data, extra)
+			defer removeTemp(log, banner)
+			log.Err(err).Msg("rendered banner containing job specific data")
+
+			filePointer = nil
+			if err == nil {
+				filePointer = &banner
+			}
+		}
+
+		// The copies of a Print-Job are separated by cuproxy itself, the printer
+		// prints one.
+		copies := 1
+		if filePointer != nil && separateCopies && layout.copies > 1 && msg.Operation() == ipp.OperationPrintJob {
+			copies = layout.copies
+			msg.AddGroup(ipp.TagJob).Set("copies", ipp.Integer(ipp.TagInteger, 1))
+		}
+
+		log.Debug().Bool("duplex", layout.duplex).Int("number-up", layout.numberUp).Int("copies", layout.copies).Int("separated", copies).Msg("determined sheet layout")
+
+		// Stamp every page of the document, allowing loose pages to be sorted.
+		// Documents that are passed through are not a PDF, they cannot be stamped.
+		document := contents
+		if stampEnabled() && !passThrough {
+			stamped, err := stampDocument(contents, overlay{job.Props, stampData(job, time.Now())})
+			defer removeTemp(log, stamped)
+			log.Err(err).Msg("stamped document")
+			if fi, statErr := stamped.Stat(); err == nil && statErr == nil {
+				document = io.NewSectionReader(stamped, 0, fi.Size())
+			}
+		}
+
+		// Keep the IPP preamble, and the PJL prefix.
+		parts := []sizedReader{bytes.NewReader(msg.Bytes()), prefix}
+
+		// If no banner page exists, skip stitching, and (by default) pass the document to the printer.
 		if filePointer != nil {
 			file := *filePointer
 			defer file.Close()
 
-			tempReader := bytes.NewBuffer(make([]byte, 0, len(body)))
-			pdf := []io.ReadSeeker{file, pdfReader}
-			if appendBanner {
-				// Flip the pdfs to stitch
-				pdf[0], pdf[1] = pdf[1], pdf[0]
+			_, _ = file.Seek(0, io.SeekStart)
+			job.BannerHash, err = hashReader(file)
+			log.Err(err).Str("hash", job.BannerHash).Msg("hashed banner")
+			_, _ = file.Seek(0, io.SeekStart)
+
+			merged, err := os.CreateTemp(spoolLocation, "cuproxy-merged-*")
+			defer removeTemp(log, merged)
+			if err != nil {
+				log.Panic().Err(err).Msg("cannot create file to merge into")
+			}
+
+			start := time.Now()
+			if fi, statErr := file.Stat(); statErr != nil {
+				err = statErr
+			} else {
+				var pages int
+				if pages, err = stitch(merged, io.NewSectionReader(file, 0, fi.Size()), document, layout, copies, job.Identity); err == nil {
+					job.Impressions = pages
+				}
 			}
 
-			err := pdfcpu.MergeRaw([]io.ReadSeeker{file, pdfReader}, tempReader, false, nil)
+			mergeDuration.Observe(time.Since(start).Seconds())
 			log.Err(err).Msg("merged banner with main print")
-			if err == nil {
-				num, err := io.Copy(newB, tempReader)
-				log.Debug().Err(err).Int64("num", num).Msg("copied buffer")
+			fi, statErr := merged.Stat()
+			if err == nil && statErr == nil {
+				parts = append(parts, io.NewSectionReader(merged, 0, fi.Size()))
 			} else {
-				io.Copy(newB, pdfReader)
+				_, _ = document.Seek(0, io.SeekStart)
+				parts = append(parts, document)
 			}
 
 			// Write the rest of the original PJL description (if it exists), and replace
 			// what will be sent to the actual printer.
-			num, err = newB.Write(suffix)
-			log.Trace().Err(err).Int("num", num).Msg("written rest of request to new body")
-			// Replace the body
-			b = newB
+			parts = append(parts, suffix)
 		} else if panicWithoutBanner {
 			log.Panic().Msg("no banner, aborting")
+		} else {
+			// The converted document is forwarded, it is what the document-format
+			// depicts.
+			_, _ = document.Seek(0, io.SeekStart)
+			parts = append(parts, document, suffix)
+		}
+
+		proxiedBody, proxiedLength = concat(parts...)
+		job.ConvertedSize = proxiedLength - int64(msg.Size())
+
+		// Park the job instead of forwarding it, the client is told the job is
+		// held.
+		if hold {
+			if job.Reason == "" {
+				job.Reason = "awaiting approval"
+			}
+
+			document, _ := concat(parts[1:]...)
+			if err := holdJob(log, job, printRequest(msg, v.create), document); err != nil {
+				log.Panic().Err(err).Msg("cannot hold job")
+			}
+
+			if createdUpstream {
+				cancelCreated()
+			}
+
+			respondIPP(ctx, heldResponse(msg, job, requestedUrl))
+			return
 		}
 	}
 
-	log.Trace().Err(writeToFile(seqId, true, true, b)).Msg("written replaced request")
+	replDump, err := dumpFile(seqId, true, true)
+	log.Trace().Err(err).Msg("opened dump of replaced request")
+	defer replDump.Close()
 
-	// Construct the proxy request, since `b` is always a *bytes.Buffer and these get closed automatically
-	proxiedRequest, err := http.NewRequest(string(ctx.Method()), "http://"+printerTo, b)
-	log.Debug().Err(err).Msg("created request to proxy")
+	// Construct the proxy request, the body is streamed to the printer.
+	proxiedRequest, err := http.NewRequest(string(ctx.Method()), target.url(), io.TeeReader(countingReader{proxiedBody, forwardedBytes}, replDump))
+	log.Debug().Err(err).Int64("length", proxiedLength).Msg("created request to proxy")
+	proxiedRequest.ContentLength = proxiedLength
+	_, requestedAddress := splitScheme(requestedUrl)
 	ctx.Request.Header.VisitAll(func(key, value []byte) {
-		proxiedRequest.Header.Add(string(key), strings.Replace(string(value), requestedUrl[5:], printerTo, -1))
+		if hopHeader(key) {
+			return
+		}
+
+		proxiedRequest.Header.Add(string(key), strings.Replace(string(value), requestedAddress, target.address, -1))
 	})
 
-	resp, err := http.DefaultClient.Do(proxiedRequest)
+	resp, err := upstreamClient.Do(proxiedRequest)
 	log.Debug().Err(err).Msg("proxied request")
-	err = proxiedRequest.Body.Close()
-	log.Debug().Err(err).Msg("closed request body")
 	if err != nil {
-		panic(err)
-	}
+		upstreamResponses.WithLabelValues(target.name, "error").Inc()
+		if job != nil {
+			job.Status = JobFailed
+			recordJob(log, job)
+		}
 
-	body, err = io.ReadAll(resp.Body)
-	log.Debug().Err(err).Msg("read entire response body")
-	err = resp.Body.Close()
-	log.Debug().Err(err).Msg("closed response body")
-	body = setReplace(body)
+		target.failed(log, err.Error())
+		ctx.SetStatusCode(http.StatusBadGateway)
+		return
+	}
 
+	upstreamResponses.WithLabelValues(target.name, strconv.Itoa(resp.StatusCode)).Inc()
 	ctx.SetStatusCode(resp.StatusCode)
 	for k, values := range resp.Header {
+		if hopHeader([]byte(k)) {
+			continue
+		}
+
 		for _, value := range values {
-			repl := strings.Replace(value, printerTo, requestedUrl[5:], -1)
+			repl := strings.Replace(value, target.address, requestedAddress, -1)
 			ctx.Response.Header.Add(k, repl)
 		}
 	}
 
-	log.Trace().Err(writeToFile[byteSlice](seqId, false, false, body)).Msg("written original response")
-	body = bytes.Replace(body, to, from, -1)
-	log.Debug().Msg("replaced response body")
-	log.Trace().Err(writeToFile[byteSlice](seqId, false, true, body)).Msg("written replaced response")
+	respOrigDump, err := dumpFile(seqId, false, false)
+	log.Trace().Err(err).Msg("opened dump of original response")
+	respBody := bufio.NewReader(io.TeeReader(resp.Body, respOrigDump))
+
+	// Point all uris back to the proxy, and convince the client that only PDF
+	// is supported.
+	var respPreamble bytes.Buffer
+	var respStream io.Reader
+	respLength := resp.ContentLength
+	respMsg, err := ipp.Decode(io.TeeReader(respBody, &respPreamble))
+	log.Debug().Err(err).Int("data_start", respPreamble.Len()).Msg("decoded response")
+	if err == nil {
+		rewriteURIs(respMsg, target.uri, requestedUrl)
+		replaceDocumentFormats(respMsg)
+		localizeJobs(log, respMsg, target)
+
+		// The client keeps using the job-id of the job it created.
+		if migrated {
+			job.UpstreamJobID, _ = respMsg.Attribute(ipp.TagJob, "job-id").Int()
+			_, job.UpstreamJobID = upstreamJob(job.UpstreamJobID)
+			if a := respMsg.Attribute(ipp.TagJob, "job-id"); a != nil {
+				a.Values = []ipp.Value{ipp.Integer(ipp.TagInteger, jobId)}
+			}
+
+			if a := respMsg.Attribute(ipp.TagJob, "job-uri"); a != nil {
+				a.Values = []ipp.Value{ipp.String(ipp.TagURI, setJobUriId(a.String(), jobId))}
+			}
+		}
+
+		// Overlay the state of the jobs known to cuproxy, such that the client
+		// sees held and rejected jobs, and the pages including the banner.
+		if operationId == ipp.OperationGetJobs || operationId == ipp.OperationGetJobAttributes {
+			overlayJobs(log, respMsg, msg, requestedUrl, ctx.RemoteIP().String())
+		}
 
-	if isCreate {
+		respStream = io.MultiReader(bytes.NewReader(respMsg.Bytes()), respBody)
+		if respLength >= 0 {
+			respLength += int64(respMsg.Size() - respPreamble.Len())
+		}
+
+		log.Debug().Msg("replaced response body")
+	} else {
+		respMsg = nil
+		respStream = io.MultiReader(&respPreamble, respBody)
+	}
+
+	if job != nil {
+		now := time.Now()
+		job.UpstreamStatus, job.ForwardedAt, job.Status = resp.StatusCode, &now, JobFailed
+		if respMsg != nil {
+			job.IppStatus = respMsg.Status().String()
+			if id, ok := respMsg.Attribute(ipp.TagJob, "job-id").Int(); ok {
+				job.JobID = id
+			}
+
+			if resp.StatusCode/100 == 2 && respMsg.Status().IsSuccessful() {
+				job.Status = JobForwarded
+				target.dispatched()
+			}
+		}
+
+		recordJob(log, job)
+	}
+
+	if isCreate && respMsg != nil {
 		var found bool
-		jobId, found = extractInt("job-id", body)
+		jobId, found = respMsg.Attribute(ipp.TagJob, "job-id").Int()
 		if !found {
 			// Weirdness happens here
 			log.Warn().Msg("cannot deduce job-id though it should be present!")
@@ -356,6 +760,7 @@ func cupsHandler(ctx *fasthttp.RequestCtx) {
 			var pp promiseInteraction
 			if isCreate {
 				pp = loadValues(log, ctx, jobId)
+				pp.create = msg
 			}
 
 			// Store as job
@@ -363,199 +768,107 @@ func cupsHandler(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
-	// Write the body
-	if _, err := ctx.Write(body); err != nil {
-		panic(err)
-	}
+	// Stream the body, the response and dumps are closed once fully written.
+	respReplDump, err := dumpFile(seqId, false, true)
+	log.Trace().Err(err).Msg("opened dump of replaced response")
+	ctx.SetBodyStream(&readCloser{
+		Reader:  io.TeeReader(respStream, respReplDump),
+		closers: []io.Closer{resp.Body, respOrigDump, respReplDump},
+	}, int(respLength))
 
-	log.Debug().Msg("written proxied-body")
+	log.Debug().Msg("streaming proxied-body")
 }
 
-// btsReplace takes a byte string and converts it to the representation used in CUPS
-func btsReplace(check []byte) []byte {
-	checkLen := len(check)
-	b := make([]byte, 2+checkLen)
-	copy(b[2:], check)
+// rewriteURIs replaces the `from` prefix of all uri values with `to`. Only
+// complete uris, or uris continuing with a path segment, are replaced. The ipp
+// and ipps schemes are considered equal, as printers advertise both; the
+// scheme of `to` is used.
+func rewriteURIs(msg *ipp.Message, from, to string) {
+	_, from = splitScheme(strings.TrimRight(from, "/"))
+	from = canonicalHost(from)
+	to = strings.TrimRight(to, "/")
+	msg.Range(func(_ *ipp.Group, a *ipp.Attribute) bool {
+		for k, v := range a.Values {
+			if v.Tag != ipp.TagURI {
+				continue
+			}
 
-	// Prepend big-endian length, it's encoded in two bytes
-	binary.BigEndian.PutUint16(b, uint16(checkLen))
-	return b
-}
+			scheme, uri := splitScheme(v.String())
+			if scheme != schemeIPP && scheme != schemeIPPS {
+				continue
+			}
 
-// setReplace replaces all relevant sets/collections in the response that are
-// needed to convince cups that only PDF is supported. All properties starting
-// with "document-format-" need to be replaced. To simplify even further, all
-// properties that depict mime-types are replaced.
-func setReplace(body []byte) []byte {
-	// The format used by CUPS is a bit annoying to efficiently replace. For a single value:
-	//   <type, 1B><length, 2B, big-endian><key-name, `length`B><value length, 2B,
-	//   big-endian><value, `value length`B>
-	// subsequent values are than 'appended' as follows:
-	//   <type, 1B>\u0000\u0000<value length, 2B, big-endian><value, `value length`B>
-	// The two nulls represent the 'empty key' and thus the value should be interpreted as being part of last key.
-
-	// All keys storing mime-types should be set to 'application/pdf'. The type depicting a mime-type is "I"
-	var result = make([]byte, len(body))
-	// We know all our properties start with 0x49 0x00
-	prefix := []byte("I\u0000")
-
-	var matchedUntil, appendedUntil int
-	pdfMime := "\u0000\u000Fapplication/pdf"
-
-	for len(body) > matchedUntil {
-		next := bytes.Index(body[matchedUntil:], prefix)
-		if next < 0 {
-			break
-		}
-
-		// Copy everything up to the match and move to the match
-		copy(result[appendedUntil:], body[matchedUntil:matchedUntil+next])
-		appendedUntil += next
-		matchedUntil += next
-
-		// A property is found, the next four bytes must be the prefix and big-endian length. Then
-		keyLength := binary.BigEndian.Uint16(body[matchedUntil+1 : matchedUntil+3])
-
-		// copy the type (1 byte), the length (2 bytes), and the key (length bytes) to the result, and advance
-		toCopy := 3 + int(keyLength)
-		copy(result[appendedUntil:], body[matchedUntil:matchedUntil+toCopy])
-		appendedUntil += toCopy
-		matchedUntil += toCopy
-
-		// A key is copied, for which the value always must be application/pdf.
-		copy(result[appendedUntil:], pdfMime)
-		appendedUntil += len(pdfMime)
-
-		// The first value always exists, read the length and skip
-		matchedUntil += 2 + int(binary.BigEndian.Uint16(body[matchedUntil:matchedUntil+2]))
-
-		// Another value starts with the type ("I") and a continuation character ("\u0000\u0000"). Keep reading until the next few characters are not continuation.
-		for len(body) >= matchedUntil+5 && bytes.Equal(body[matchedUntil:matchedUntil+3], []byte("I\u0000\u0000")) {
-			matchedUntil += 5 + int(binary.BigEndian.Uint16(body[matchedUntil+3:matchedUntil+5]))
+			if uri = canonicalHost(uri); uri == from || strings.HasPrefix(uri, from+"/") {
+				a.Values[k] = ipp.String(ipp.TagURI, to+uri[len(from):])
+			}
 		}
-	}
-
-	// Copy the remaining bytes
-	copy(result[appendedUntil:], body[matchedUntil:])
 
-	// Re-slice the byte slice to the correct length.
-	return result[:appendedUntil+len(body)-matchedUntil]
+		return true
+	})
 }
 
-func extractInt(name string, body []byte) (value int32, found bool) {
-	bts := make([]byte, 3, len(name)+3)
-	bts[0] = '!'
-	binary.BigEndian.PutUint16(bts[1:], uint16(len(name)))
-	bts = append(bts, []byte(name)...)
+// canonicalHost lowercases the host of the uri, given without scheme, and
+// writes IPv6 literals in their canonical form. Clients may spell the address
+// of the proxy differently, e.g. "[2001:DB8:0::1]:631" for "[2001:db8::1]:631".
+func canonicalHost(uri string) string {
+	host, path, found := strings.Cut(uri, "/")
+	host = strings.ToLower(host)
+	if end := strings.IndexByte(host, ']'); strings.HasPrefix(host, "[") && end > 0 {
+		addr, zone, zoned := strings.Cut(host[1:end], "%")
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			if zoned {
+				addr = ip.String() + "%" + zone
+			} else {
+				addr = ip.String()
+			}
 
-	index := bytes.Index(body, bts)
-	if index < 0 {
-		return
+			host = "[" + addr + "]" + host[end+1:]
+		}
 	}
 
-	found = true
-
-	// Read the next byte, this is the length
-	start := index + len(bts)
-	length := int(binary.BigEndian.Uint16(body[start:]))
-	// Length should be smaller than 4 bytes
-	if length > 4 || length <= 0 {
-		// Give warning
-		panic("oops")
+	if !found {
+		return host
 	}
 
-	value = int32(binary.BigEndian.Uint32(body[start+2:]))
-
-	return
+	return host + "/" + path
 }
 
-func dataOffset(body []byte) (offset int, err error) {
-	defer func() {
-		ei := recover()
-		if ei == nil {
-			return
-		}
-
-		switch e := ei.(type) {
-		case error:
-			err = e
-			return
-		default:
-			err = fmt.Errorf("error encountered; %v", e)
-		}
-	}()
-
-	/*
-	  -----------------------------------------------
-	  |                  version-number             |   2 bytes  - required
-	  -----------------------------------------------
-	  |               operation-id (request)        |
-	  |                      or                     |   2 bytes  - required
-	  |               status-code (response)        |
-	  -----------------------------------------------
-	  |                   request-id                |   4 bytes  - required
-	  -----------------------------------------------------------
-	  |               xxx-attributes-tag            |   1 byte  |
-	  -----------------------------------------------           |-0 or more
-	  |             xxx-attribute-sequence          |   n bytes |
-	  -----------------------------------------------------------
-	  |              end-of-attributes-tag          |   1 byte   - required
-	  -----------------------------------------------
-	  |                     data                    |   q bytes  - optional
-	  -----------------------------------------------
-	*/
-
-	// headerSize := 8
-	// body = body[headerSize:]
-
-	offset = 8
-
-	// var its, length int
-	// var key, value string
-	// 0x03 (ETX) marks the end of data
-	var length int
-	for len(body) > offset && body[offset] != 0x03 {
-		offset++
-		for len(body) > offset && body[offset] != 0x02 && body[offset] != 0x03 {
-			offset++
-
-			// Read the key
-			length = int(binary.BigEndian.Uint16(body[offset:]))
-			offset += 2 + length
-
-			// Read the value
-			length = int(binary.BigEndian.Uint16(body[offset:]))
-			offset += 2 + length
+// replaceDocumentFormats replaces all attributes that are needed to convince
+// cups that only PDF is supported. All properties starting with
+// "document-format-" need to be replaced. To simplify even further, all
+// attributes that only contain mime-types are replaced.
+func replaceDocumentFormats(msg *ipp.Message) {
+	msg.Range(func(_ *ipp.Group, a *ipp.Attribute) bool {
+		for _, v := range a.Values {
+			if v.Tag != ipp.TagMimeMediaType {
+				return true
+			}
 		}
-	}
 
-	if len(body) > 0 {
-		offset++
-	}
-
-	return
+		a.Values = []ipp.Value{ipp.String(ipp.TagMimeMediaType, "application/pdf")}
+		return true
+	})
 }
 
-func cupsConvert(log zerolog.Logger, data []byte, mime, ppd string) (converted []byte, err error) {
+func cupsConvert(log zerolog.Logger, data io.Reader, mime, ppd string) (converted *os.File, err error) {
 	if cupsfilter == "" {
-		return data, fmt.Errorf("cupsfilter must be set to convert to pdf")
+		return nil, fmt.Errorf("cupsfilter must be set to convert to pdf")
 	}
 
 	// Convert to `mime`
-	td := os.TempDir()
 	var temp *os.File
-	temp, err = os.CreateTemp(td, "cuproxy-preconvert-*")
-	log.Trace().Err(err).Msg("created temp-file")
+	var n int64
+	temp, n, err = spool(data, "cuproxy-preconvert-*")
+	log.Trace().Err(err).Int64("num_bytes", n).Msg("written to temp-file")
+
+	// Close and remove temp when done
+	defer removeTemp(log, temp)
 	if err != nil {
 		return
 	}
 
-	// Close and remove temp when done
-	defer os.Remove(temp.Name())
-	defer temp.Close()
-
-	n, err := temp.Write(data)
-	log.Trace().Err(err).Int("num_bytes", n).Msg("written to temp-file")
+	converted, err = os.CreateTemp(spoolLocation, "cuproxy-converted-*")
+	log.Trace().Err(err).Msg("created converted-file")
 	if err != nil {
 		return
 	}
@@ -563,11 +876,11 @@ func cupsConvert(log zerolog.Logger, data []byte, mime, ppd string) (converted [
 	cmdRaw := []string{cupsfilter, temp.Name(), "-m", mime, "-P", ppd}
 
 	cmd := exec.Command(cmdRaw[0], cmdRaw[1:]...)
-	var b bytes.Buffer
-	cmd.Stdout = &b
+	cmd.Stdout = converted
 	cmd.Stderr = nil
+	start := time.Now()
 	err = cmd.Run()
-	converted = b.Bytes()
+	conversionDuration.WithLabelValues("cupsfilter").Observe(time.Since(start).Seconds())
 
 	log.Trace().Err(err).Strs("command", cmdRaw).Str("file", temp.Name()).Msg("converting")
 	if err != nil {
@@ -578,34 +891,53 @@ func cupsConvert(log zerolog.Logger, data []byte, mime, ppd string) (converted [
 }
 
 // extractPJL extracts, and returns, the PJL prefix and suffix, and actual
-// 'to-be-printed' body of a PJL print job.
-func extractPJL(contents []byte) (prefix []byte, suffix []byte, body []byte, err error) {
-	body = contents
+// 'to-be-printed' body of a PJL print job. Only the start and end of the
+// document are searched for PJL commands.
+func extractPJL(contents io.ReaderAt, size int64) (prefix, body, suffix *io.SectionReader, err error) {
+	prefix = io.NewSectionReader(contents, 0, 0)
+	body = io.NewSectionReader(contents, 0, size)
+	suffix = io.NewSectionReader(contents, size, 0)
+
+	head := make([]byte, min(size, pjlSearchSize))
+	if _, err = contents.ReadAt(head, 0); err != nil && err != io.EOF {
+		return
+	}
 
 	// PJL body starts after "@PJL ENTER LANGUAGE = .*?\r\n" and ends with "@PJL EOJ"
-	start := bytes.Index(body, []byte("@PJL ENTER LANGUAGE = "))
+	start := bytes.Index(head, []byte("@PJL ENTER LANGUAGE = "))
 	if start < 0 {
 		// `contents` does not contain a PJL job.
+		err = nil
+		return
+	}
+
+	tailStart := max(0, size-pjlSearchSize)
+	tail := make([]byte, size-tailStart)
+	if _, err = contents.ReadAt(tail, tailStart); err != nil && err != io.EOF {
 		return
 	}
 
-	end := bytes.LastIndex(body, []byte("@PJL EOJ"))
-	if end < 0 {
+	end := bytes.LastIndex(tail, []byte("@PJL EOJ"))
+	newline := bytes.Index(head[start:], []byte("\n"))
+	if end < 0 || newline < 0 {
 		// Should not be possible! End of PJL must be found.
 		err = fmt.Errorf("PJL job, but no end can be found")
 		return
 	}
 
-	start += bytes.Index(body[start:], []byte("\n"))
-
-	prefix = make([]byte, start)
-	copy(prefix, body[:start])
-
-	suffix = make([]byte, len(body)-end)
-	copy(suffix, body[end:])
-
-	// Re-slice, to get the in-fixed body
-	body = body[start:end]
+	err = nil
+	bodyStart, bodyEnd := int64(start+newline), tailStart+int64(end)
+	prefix = io.NewSectionReader(contents, 0, bodyStart)
+	body = io.NewSectionReader(contents, bodyStart, bodyEnd-bodyStart)
+	suffix = io.NewSectionReader(contents, bodyEnd, size-bodyEnd)
 
 	return
 }
+
+// isPDF returns whether the document starts with the PDF header. The header
+// must be located within the first 1024 bytes.
+func isPDF(r io.ReaderAt) bool {
+	head := make([]byte, 1024)
+	n, _ := r.ReadAt(head, 0)
+	return bytes.Contains(head[:n], []byte("%PDF"))
+}
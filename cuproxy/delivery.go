@@ -0,0 +1,192 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	"github.com/tuupke/pixie/crud"
+	"github.com/tuupke/pixie/env"
+)
+
+var (
+	deliveryCodes   = env.Bool("DELIVERY_CODES")
+	deliveryCode128 = env.Bool("DELIVERY_CODE128")
+	deliveryUrl     = strings.TrimRight(env.String("DELIVERY_URL"), "/")
+	deliveryTeamKey = env.StringFb("DELIVERY_TEAM_KEY", "team_id")
+
+	//go:embed deliver.html
+	deliverPage     string
+	deliverTemplate = template.Must(template.New("deliver").Parse(deliverPage))
+
+	errUnknownCode  = errors.New("unknown delivery code")
+	errCodeMismatch = errors.New("delivery code does not match the job")
+)
+
+// deliveryResult is rendered on the delivery page.
+type deliveryResult struct {
+	Message   string
+	Delivered *Job
+	Pending   []Job
+}
+
+// deliveryTeam returns the team of the job, the value of DELIVERY_TEAM_KEY or
+// the identity when the key is not set.
+func deliveryTeam(job *Job, data bannerData) string {
+	if data != nil {
+		if team, ok := data.Load(deliveryTeamKey); ok {
+			return team
+		}
+	}
+
+	return job.Identity
+}
+
+// deliveryCode encodes the sequence-id, job-id and team of the job as
+// "<seq-id>/<job-id>/<team>". When DELIVERY_URL is set, the code is the url at
+// which the job is marked as delivered, allowing it to be scanned by a phone.
+func deliveryCode(job *Job, team string) string {
+	code := fmt.Sprintf("%v/%v/%v", job.SeqID, job.JobID, url.PathEscape(team))
+	if deliveryUrl != "" {
+		return deliveryUrl + "/deliver/" + code
+	}
+
+	return code
+}
+
+// deliveryData returns the banner-data identifying the job.
+func deliveryData(job *Job, data bannerData) map[string]string {
+	return map[string]string{
+		"seq_id":        strconv.FormatUint(job.SeqID, 10),
+		"job_id":        strconv.Itoa(int(job.JobID)),
+		"delivery_code": deliveryCode(job, deliveryTeam(job, data)),
+	}
+}
+
+// parseDeliveryCode decodes a scanned delivery code, with or without the url.
+func parseDeliveryCode(code string) (seq uint64, jobId int32, team string, err error) {
+	if i := strings.LastIndex(code, "/deliver/"); i >= 0 {
+		code = code[i+len("/deliver/"):]
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(code), "/", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid delivery code '%v'", code)
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 32)
+	if err == nil {
+		seq, err = strconv.ParseUint(parts[0], 10, 64)
+	}
+
+	if err == nil {
+		team, err = url.PathUnescape(parts[2])
+	}
+
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid delivery code '%v'; %w", code, err)
+	}
+
+	return seq, int32(id), team, nil
+}
+
+// markDelivered records the job of the delivery code as delivered. Scanning a
+// delivered job again keeps the time of the first scan.
+func markDelivered(log zerolog.Logger, code string) (*Job, error) {
+	seq, jobId, team, err := parseDeliveryCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	job := new(Job)
+	if err = ledger.First(job, "seq_id = ?", seq).Error; err == gorm.ErrRecordNotFound {
+		return nil, fmt.Errorf("%w '%v'", errUnknownCode, code)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot load job %v; %w", seq, err)
+	}
+
+	// The job-id of a Print-Job is unknown when its banner is rendered.
+	if (jobId != 0 && job.JobID != jobId) || deliveryTeam(job, job.Props) != team {
+		return job, fmt.Errorf("%w, job %v of '%v' was printed as job %v of '%v'", errCodeMismatch, jobId, team, job.JobID, deliveryTeam(job, job.Props))
+	}
+
+	if job.DeliveredAt == nil {
+		now := time.Now()
+		job.DeliveredAt = &now
+		recordJob(log, job)
+	}
+
+	log.Info().Uint64("seq-id", seq).Int32("job-id", jobId).Str("team", team).Msg("delivered job")
+	return job, nil
+}
+
+// deliver handles the delivery page. Codes are either submitted using the form,
+// e.g. by a barcode scanner, or by opening the url of the code.
+func deliver(ctx *fasthttp.RequestCtx) {
+	var result deliveryResult
+	code := string(ctx.FormValue("code"))
+	if seq := ctx.UserValue("seq"); seq != nil {
+		code = fmt.Sprintf("%v/%v/%v", seq, ctx.UserValue("job"), url.PathEscape(fmt.Sprint(ctx.UserValue("team"))))
+	}
+
+	if code != "" {
+		job, err := markDelivered(zlog.Logger, code)
+		switch {
+		case err == nil:
+			result.Delivered = job
+			result.Message = fmt.Sprintf("Delivered job %v of %v", job.JobID, deliveryTeam(job, job.Props))
+		case errors.Is(err, errUnknownCode):
+			ctx.SetStatusCode(http.StatusNotFound)
+		case errors.Is(err, errCodeMismatch):
+			ctx.SetStatusCode(http.StatusConflict)
+		default:
+			ctx.SetStatusCode(http.StatusBadRequest)
+		}
+
+		if err != nil {
+			result.Message = err.Error()
+		}
+	}
+
+	err := ledger.Model(&Job{}).
+		Where("status = ? AND delivered_at IS NULL", JobForwarded).
+		Order("id ASC").Limit(100).
+		Find(&result.Pending).Error
+	crud.HandleError(ctx, http.StatusInternalServerError, err)
+
+	ctx.SetContentType("text/html; charset=utf-8")
+	crud.HandleError(ctx, http.StatusInternalServerError, deliverTemplate.Execute(ctx, result))
+}
+
+// drawDeliveryCodes draws the delivery code in the top-right corner of the
+// default banner, as a QR-code and optionally as a Code 128 barcode.
+func drawDeliveryCodes(log zerolog.Logger, pdf *gofpdf.Fpdf, data bannerData) {
+	code, ok := data.Load("delivery_code")
+	if !deliveryCodes || !ok {
+		return
+	}
+
+	width, _ := pdf.GetPageSize()
+	size := pointsToUnits(100)
+	pdf.SetFillColor(0, 0, 0)
+
+	qr := layoutElement{Type: elementQR, X: width - pdfLeftMargin - size, Y: pdfTopMargin, W: size}
+	qr.drawBarcode(log, pdf, code)
+
+	if deliveryCode128 {
+		bar := layoutElement{Type: elementCode128, X: width - pdfLeftMargin - 2*size, Y: pdfTopMargin + size*1.1, W: 2 * size, H: size / 3}
+		bar.drawBarcode(log, pdf, code)
+	}
+}
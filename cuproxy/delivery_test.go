@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDeliveryCode(t *testing.T) {
+	job := &Job{SeqID: 17, JobID: 795, Identity: "10.0.0.4"}
+	assert.Equal(t, "17/795/42", deliveryCode(job, deliveryTeam(job, kvs{"team_id": "42"})))
+	assert.Equal(t, "17/795/10.0.0.4", deliveryCode(job, deliveryTeam(job, nil)), "the identity is used without a team")
+
+	deliveryUrl = "https://jury.example/admin"
+	t.Cleanup(func() { deliveryUrl = "" })
+	code := deliveryCode(job, "Team /dev/null")
+	assert.Equal(t, "https://jury.example/admin/deliver/17/795/Team%20%2Fdev%2Fnull", code)
+
+	seq, id, team, err := parseDeliveryCode(code)
+	require.NoError(t, err)
+	assert.EqualValues(t, 17, seq)
+	assert.EqualValues(t, 795, id)
+	assert.Equal(t, "Team /dev/null", team)
+
+	for _, code := range []string{"", "17/795", "x/795/42", "17/x/42", "17/795/%zz"} {
+		_, _, _, err = parseDeliveryCode(code)
+		assert.Error(t, err, code)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	testLedger(t)
+	recordJob(zlog.Logger, &Job{SeqID: 1, JobID: 795, Identity: "10.0.0.4", Props: kvs{"team_id": "42"}, Status: JobForwarded})
+	recordJob(zlog.Logger, &Job{SeqID: 2, Identity: "10.0.0.5", Props: kvs{"team_id": "43"}, Status: JobForwarded})
+
+	ctx := adminRequest(http.MethodGet, "/deliver")
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "795")
+
+	ctx = adminRequest(http.MethodGet, "/deliver/1/795/42")
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "Delivered job 795 of 42")
+
+	var job Job
+	require.NoError(t, ledger.First(&job, "seq_id = 1").Error)
+	require.NotNil(t, job.DeliveredAt)
+	assert.Len(t, queryJobs(t, "delivered=true"), 1)
+	assert.Len(t, queryJobs(t, "delivered=false"), 1)
+
+	// Codes are submitted by a scanner using the form
+	for code, status := range map[string]int{
+		"2/0/43":   http.StatusOK, // The job-id of a Print-Job is unknown
+		"2/0/42":   http.StatusConflict,
+		"1/796/42": http.StatusConflict,
+		"9/795/42": http.StatusNotFound,
+		"garbage":  http.StatusBadRequest,
+	} {
+		ctx = new(fasthttp.RequestCtx)
+		ctx.Request.Header.SetMethod(http.MethodPost)
+		ctx.Request.SetRequestURI("/deliver")
+		ctx.Request.Header.SetContentType("application/x-www-form-urlencoded")
+		ctx.Request.SetBodyString("code=" + code)
+		adminRouter().Handler(ctx)
+		assert.Equal(t, status, ctx.Response.StatusCode(), code)
+	}
+
+	assert.Empty(t, queryJobs(t, "delivered=false"))
+}
+
+func TestBannerDeliveryCodes(t *testing.T) {
+	deliveryCodes, deliveryCode128 = true, true
+	t.Cleanup(func() { deliveryCodes, deliveryCode128 = false, false })
+
+	var with, without bytes.Buffer
+	data := kvs{"team_id": "42"}
+	require.NoError(t, BannerPage(zlog.Logger, &without, data, printKeys...))
+	require.NoError(t, BannerPage(zlog.Logger, &with, overlay{data, map[string]string{"delivery_code": "1/795/42"}}, printKeys...))
+	assert.Greater(t, with.Len(), without.Len(), "the codes must be drawn")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+// fakeJob is a job accepted by the fake printer.
+type fakeJob struct {
+	id        int32
+	state     int32
+	documents [][]byte
+}
+
+// fakePrinter is an in-process IPP printer. It accepts Print-Job, Create-Job and
+// Send-Document, and records the requests and documents it receives. Requests
+// that are not IPP are answered with the fake web interface.
+type fakePrinter struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*ipp.Message
+	jobs     []*fakeJob
+	lastId   int32
+}
+
+// newFakePrinter starts the fake printer, and points the proxy to it for the
+// duration of the test.
+func newFakePrinter(t *testing.T) *fakePrinter {
+	t.Helper()
+	f := &fakePrinter{lastId: 100}
+	f.Server = httptest.NewServer(f)
+
+	old := printers
+	printers = mustParsePrinters(strings.TrimPrefix(f.URL, "http://") + "/printers/fake")
+	t.Cleanup(func() {
+		f.Close()
+		printers = old
+	})
+
+	return f
+}
+
+func (f *fakePrinter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	req, n, err := ipp.DecodeBytes(b)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("fake printer web interface"))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+
+	uri := req.Attribute(ipp.TagOperation, "printer-uri").String()
+	resp := ipp.NewResponse(req, ipp.StatusOK)
+	jobId, _ := req.Attribute(ipp.TagOperation, "job-id").Int()
+	switch req.Operation() {
+	case ipp.OperationPrintJob, ipp.OperationCreateJob:
+		f.lastId++
+		job := &fakeJob{id: f.lastId, state: ipp.JobStatePending}
+		if req.Operation() == ipp.OperationPrintJob {
+			job.state, job.documents = ipp.JobStateProcessing, [][]byte{b[n:]}
+		}
+
+		f.jobs = append(f.jobs, job)
+		f.jobAttributes(resp, job, uri)
+	case ipp.OperationSendDocument:
+		job := f.job(jobId)
+		if job == nil {
+			resp = ipp.NewResponse(req, ipp.StatusClientErrorNotFound)
+			break
+		}
+
+		job.state, job.documents = ipp.JobStateProcessing, append(job.documents, b[n:])
+		f.jobAttributes(resp, job, uri)
+	case ipp.OperationGetJobAttributes, ipp.OperationCancelJob:
+		job := f.job(jobId)
+		if job == nil {
+			resp = ipp.NewResponse(req, ipp.StatusClientErrorNotFound)
+			break
+		}
+
+		if req.Operation() == ipp.OperationCancelJob {
+			job.state = ipp.JobStateCanceled
+			break
+		}
+
+		f.jobAttributes(resp, job, uri)
+	case ipp.OperationGetJobs:
+		for _, job := range f.jobs {
+			f.jobAttributes(resp, job, uri)
+		}
+	case ipp.OperationGetPrinterAttributes:
+		attrs := resp.AddGroup(ipp.TagPrinter)
+		attrs.Set("printer-uri-supported", ipp.String(ipp.TagURI, uri))
+		attrs.Set("printer-state", ipp.Integer(ipp.TagEnum, 3))
+		attrs.Set("printer-state-reasons", ipp.String(ipp.TagKeyword, "none"))
+		attrs.Set("queued-job-count", ipp.Integer(ipp.TagInteger, int32(len(f.jobs))))
+		attrs.Set("document-format-supported", ipp.String(ipp.TagMimeMediaType, formatPDF))
+	default:
+		resp = ipp.NewResponse(req, ipp.StatusServerErrorOperationUnsupported)
+	}
+
+	w.Header().Set("Content-Type", "application/ipp")
+	_, _ = w.Write(resp.Bytes())
+}
+
+// jobAttributes adds the attributes of the job to the response.
+func (f *fakePrinter) jobAttributes(resp *ipp.Message, job *fakeJob, uri string) {
+	attrs := &ipp.Group{Tag: ipp.TagJob}
+	attrs.Set("job-id", ipp.Integer(ipp.TagInteger, job.id))
+	attrs.Set("job-uri", ipp.String(ipp.TagURI, jobUri(uri, job.id)))
+	attrs.Set("job-state", ipp.Integer(ipp.TagEnum, job.state))
+	attrs.Set("job-state-reasons", ipp.String(ipp.TagKeyword, "none"))
+	resp.Groups = append(resp.Groups, attrs)
+}
+
+func (f *fakePrinter) job(id int32) *fakeJob {
+	for _, job := range f.jobs {
+		if job.id == id {
+			return job
+		}
+	}
+
+	return nil
+}
+
+// operations returns the operations of the received requests, in order.
+func (f *fakePrinter) operations() []ipp.Operation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ops []ipp.Operation
+	for _, req := range f.requests {
+		ops = append(ops, req.Operation())
+	}
+
+	return ops
+}
+
+// lastRequest returns the request received last.
+func (f *fakePrinter) lastRequest() *ipp.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+// lastDocument returns the document received last, or nil when no document
+// has been received.
+func (f *fakePrinter) lastDocument() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var last []byte
+	for _, job := range f.jobs {
+		if len(job.documents) > 0 {
+			last = job.documents[len(job.documents)-1]
+		}
+	}
+
+	return last
+}
+
+// fakeWebhooks is an in-process webhook server, responding to every path with
+// the configured body. The calls are counted per path.
+type fakeWebhooks struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string][]byte
+	calls     map[string]int
+}
+
+// newFakeWebhooks starts the webhook server, responding with the bodies by
+// path. The content type is detected from the body, unknown paths are not
+// found.
+func newFakeWebhooks(t *testing.T, responses map[string][]byte) *fakeWebhooks {
+	t.Helper()
+	f := &fakeWebhooks{responses: responses, calls: make(map[string]int)}
+	f.Server = httptest.NewServer(f)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeWebhooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls[r.URL.Path]++
+	body, ok := f.responses[r.URL.Path]
+	f.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := http.DetectContentType(body)
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		contentType = "application/json"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(body)
+}
+
+// called returns the number of calls to the path.
+func (f *fakeWebhooks) called(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[path]
+}
+
+// endpoint returns the GET endpoint called name, calling the path.
+func (f *fakeWebhooks) endpoint(name, path string) endpoint {
+	return endpoint{method: http.MethodGet, name: name, url: f.URL + path}
+}
+
+// pageTexts returns the text shown on every page of the pdf.
+func pageTexts(t *testing.T, document []byte) []string {
+	t.Helper()
+	ctx, err := pdfcpuapi.ReadContext(bytes.NewReader(document), nil)
+	require.NoError(t, err)
+	require.NoError(t, ctx.EnsurePageCount())
+
+	texts := make([]string, ctx.PageCount)
+	for p := range texts {
+		r, err := pdfcpu.ExtractPageContent(ctx, p+1)
+		require.NoError(t, err)
+		if r == nil {
+			continue
+		}
+
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		texts[p] = strings.TrimSpace(contentText(content))
+	}
+
+	return texts
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+
+	"github.com/tuupke/pixie/crud"
+	"github.com/tuupke/pixie/env"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+// heldJobOffset is added to the ledger-id of held Print-Job jobs to construct
+// a job-id. These jobs are unknown to the printer, the offset prevents
+// collisions with the job-ids of the printer.
+const heldJobOffset = 1 << 30
+
+var (
+	holdJobs     = env.Bool("HOLD_JOBS")
+	heldLocation = strings.TrimRight(env.StringFb("HELD_LOCATION", pdfLocation+"/held"), "/")
+
+	//go:embed held.html
+	heldPage     string
+	heldTemplate = template.Must(template.New("held").Parse(heldPage))
+)
+
+// heldFile returns the location of the held job with the ledger-id.
+func heldFile(id uint) string {
+	return fmt.Sprintf("%v/%v.ipp", heldLocation, id)
+}
+
+// printRequest converts the request into a Print-Job request, which can be sent
+// to the printer when the held job is released. The job attributes of a
+// Send-Document request are taken from its Create-Job request.
+func printRequest(msg, create *ipp.Message) *ipp.Message {
+	base := msg
+	if msg.Operation() == ipp.OperationSendDocument && create != nil {
+		base = create
+	}
+
+	// Decoding the encoded message results in a deep copy
+	req, _, _ := ipp.DecodeBytes(base.Bytes())
+	req.Code = uint16(ipp.OperationPrintJob)
+
+	op := req.AddGroup(ipp.TagOperation)
+	for _, name := range []string{"document-format", "document-name", "compression"} {
+		if a := msg.Attribute(ipp.TagOperation, name); a != nil {
+			op.Set(name, a.Values...)
+		}
+	}
+
+	op.Delete("job-id")
+	op.Delete("last-document")
+	return req
+}
+
+// holdJob parks the job, consisting of the Print-Job request and the document,
+// instead of sending it to the printer. Jobs are stored using their ledger-id.
+func holdJob(log zerolog.Logger, job *Job, req *ipp.Message, document io.Reader) error {
+	job.Status = JobHeld
+	recordJob(log, job)
+	if job.ID == 0 {
+		return fmt.Errorf("cannot hold job, it is not recorded in the ledger")
+	}
+
+	if job.JobID == 0 {
+		job.JobID = heldJobOffset + int32(job.ID)
+		recordJob(log, job)
+	}
+
+	if err := os.MkdirAll(heldLocation, 0755); err != nil {
+		return fmt.Errorf("cannot create held-folder '%v'; %w", heldLocation, err)
+	}
+
+	f, err := os.Create(heldFile(job.ID))
+	if err != nil {
+		return fmt.Errorf("cannot create held job; %w", err)
+	}
+
+	defer f.Close()
+	if _, err = io.Copy(f, io.MultiReader(bytes.NewReader(req.Bytes()), document)); err != nil {
+		return fmt.Errorf("cannot write held job '%v'; %w", f.Name(), err)
+	}
+
+	log.Info().Uint("ledger-id", job.ID).Int32("job-id", job.JobID).Str("reason", job.Reason).Msg("held job")
+	return nil
+}
+
+// heldResponse constructs the successful response to a request of which the job
+// is held.
+func heldResponse(req *ipp.Message, job *Job, printerUrl string) *ipp.Message {
+	resp := ipp.NewResponse(req, ipp.StatusOK)
+	attrs := resp.AddGroup(ipp.TagJob)
+	attrs.Set("job-id", ipp.Integer(ipp.TagInteger, job.JobID))
+	attrs.Set("job-uri", ipp.String(ipp.TagURI, jobUri(printerUrl, job.JobID)))
+	attrs.Set("job-state", ipp.Integer(ipp.TagEnum, ipp.JobStatePendingHeld))
+	attrs.Set("job-state-reasons", ipp.String(ipp.TagKeyword, "job-hold-until-specified"))
+	if job.Reason != "" {
+		attrs.Set("job-state-message", ipp.String(ipp.TagTextWithoutLanguage, job.Reason))
+	}
+
+	return resp
+}
+
+// jobUri returns the uri of the job on the printer.
+func jobUri(printerUrl string, id int32) string {
+	if u, err := url.Parse(printerUrl); err == nil && u.Host != "" {
+		return fmt.Sprintf("%v://%v/jobs/%v", u.Scheme, u.Host, id)
+	}
+
+	return fmt.Sprintf("%v/jobs/%v", strings.TrimRight(printerUrl, "/"), id)
+}
+
+// openHeld opens the held job, and returns the Print-Job request and the
+// document following it. The returned file must be closed.
+func openHeld(job *Job) (f *os.File, req *ipp.Message, document *io.SectionReader, err error) {
+	if f, err = os.Open(heldFile(job.ID)); err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot open held job %v; %w", job.ID, err)
+	}
+
+	fi, err := f.Stat()
+	if err == nil {
+		req, err = ipp.Decode(bufio.NewReader(f))
+	}
+
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, nil, fmt.Errorf("cannot read held job %v; %w", job.ID, err)
+	}
+
+	// Encoding is byte-for-byte, the document starts right after the request.
+	offset := int64(req.Size())
+	return f, req, io.NewSectionReader(f, offset, fi.Size()-offset), nil
+}
+
+// releaseHeld sends the held job to the printer. The job is kept, allowing it
+// to be reprinted, until it is discarded.
+func releaseHeld(log zerolog.Logger, job *Job) error {
+	f, req, document, err := openHeld(job)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	p := selectPrinter(job.Props)
+	fresh := newUpstreamRequest(p, ipp.OperationPrintJob, "")
+	req.RequestID = fresh.RequestID
+	req.AddGroup(ipp.TagOperation).Set("printer-uri", ipp.String(ipp.TagURI, p.uri))
+
+	resp, err := sendUpstream(log, p, req, document)
+	if err != nil {
+		p.failed(log, err.Error())
+		return err
+	}
+
+	job.Printer = p.name
+
+	now := time.Now()
+	job.UpstreamStatus, job.IppStatus, job.ReleasedAt = http.StatusOK, resp.Status().String(), &now
+	if !resp.Status().IsSuccessful() {
+		recordJob(log, job)
+		return fmt.Errorf("printer refused job %v; status %v", job.ID, resp.Status())
+	}
+
+	job.Status, job.ForwardedAt = JobForwarded, &now
+	job.UpstreamJobID, _ = resp.Attribute(ipp.TagJob, "job-id").Int()
+	p.dispatched()
+	recordJob(log, job)
+	return nil
+}
+
+// discardHeld removes the held job, it can no longer be printed.
+func discardHeld(log zerolog.Logger, job *Job) error {
+	if err := os.Remove(heldFile(job.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove held job %v; %w", job.ID, err)
+	}
+
+	job.Status = JobDiscarded
+	recordJob(log, job)
+	return nil
+}
+
+// heldQuery selects all jobs that are held, or released but not yet discarded.
+func heldQuery() *gorm.DB {
+	return ledger.Model(&Job{}).Where("status = ? OR (status = ? AND released_at IS NOT NULL)", JobHeld, JobForwarded)
+}
+
+// loadHeld retrieves the held job referenced by the id in the url.
+func loadHeld(ctx *fasthttp.RequestCtx) (job Job) {
+	err := heldQuery().First(&job, "id = ?", ctx.UserValue("id")).Error
+	status := http.StatusInternalServerError
+	if err == gorm.ErrRecordNotFound {
+		status = http.StatusNotFound
+	}
+
+	crud.HandleError(ctx, status, err)
+	return
+}
+
+// listHeld renders the page listing all held jobs, oldest first.
+func listHeld(ctx *fasthttp.RequestCtx) {
+	var jobs []Job
+	crud.HandleError(ctx, http.StatusInternalServerError, heldQuery().Order("id ASC").Find(&jobs).Error)
+
+	ctx.SetContentType("text/html; charset=utf-8")
+	crud.HandleError(ctx, http.StatusInternalServerError, heldTemplate.Execute(ctx, jobs))
+}
+
+// heldDocument streams the document of a held job, including the banner. PJL
+// is stripped, allowing the document to be previewed.
+func heldDocument(ctx *fasthttp.RequestCtx) {
+	job := loadHeld(ctx)
+	f, _, document, err := openHeld(&job)
+	crud.HandleError(ctx, http.StatusInternalServerError, err)
+
+	_, contents, _, err := extractPJL(document, document.Size())
+	if err != nil {
+		_ = f.Close()
+		crud.HandleError(ctx, http.StatusInternalServerError, err)
+	}
+
+	ctx.SetContentType(formatPDF)
+	ctx.SetBodyStream(&readCloser{Reader: contents, closers: []io.Closer{f}}, int(contents.Size()))
+}
+
+// heldAction releases, reprints, or discards a held job and returns to the
+// list of held jobs.
+func heldAction(ctx *fasthttp.RequestCtx) {
+	job := loadHeld(ctx)
+	action := ctx.UserValue("action")
+	log := zlog.With().Uint("ledger-id", job.ID).Int32("job-id", job.JobID).Interface("action", action).Logger()
+
+	var err error
+	switch {
+	case action == "release" && job.Status == JobHeld, action == "reprint" && job.Status == JobForwarded:
+		err = releaseHeld(log, &job)
+	case action == "discard":
+		err = discardHeld(log, &job)
+	default:
+		crud.HandleError(ctx, http.StatusConflict, fmt.Errorf("cannot %v job with status '%v'", action, job.Status))
+	}
+
+	log.Err(err).Msg("handled held job")
+	crud.HandleError(ctx, http.StatusBadGateway, err)
+	ctx.Redirect("/held", http.StatusSeeOther)
+}
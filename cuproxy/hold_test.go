@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+func testMessage(t *testing.T, fixture string) *ipp.Message {
+	t.Helper()
+	b, err := os.ReadFile("ipp/testdata/" + fixture)
+	require.NoError(t, err)
+
+	msg, _, err := ipp.DecodeBytes(b)
+	require.NoError(t, err)
+	return msg
+}
+
+func TestPrintRequest(t *testing.T) {
+	create := testMessage(t, "create-job-request.bin")
+	send := testMessage(t, "send-document-request.bin")
+
+	req := printRequest(send, create)
+	assert.Equal(t, ipp.OperationPrintJob, req.Operation())
+	assert.Equal(t, "application/octet-stream", req.Attribute(ipp.TagOperation, "document-format").String())
+	assert.Nil(t, req.Attribute(ipp.TagOperation, "job-id"))
+	assert.Nil(t, req.Attribute(ipp.TagOperation, "last-document"))
+	assert.Equal(t, "two-sided-long-edge", req.Attribute(ipp.TagJob, "sides").String(), "job attributes of Create-Job must be kept")
+
+	// The original requests are left untouched
+	assert.Equal(t, ipp.OperationCreateJob, create.Operation())
+	assert.Nil(t, create.Attribute(ipp.TagOperation, "document-format"))
+
+	// Without Create-Job, the Send-Document request is used
+	req = printRequest(send, nil)
+	assert.Equal(t, ipp.OperationPrintJob, req.Operation())
+	assert.Nil(t, req.Attribute(ipp.TagOperation, "job-id"))
+	assert.NotNil(t, send.Attribute(ipp.TagOperation, "job-id"))
+}
+
+func TestHeldResponse(t *testing.T) {
+	send := testMessage(t, "send-document-request.bin")
+	resp := heldResponse(send, &Job{JobID: heldJobOffset + 3, Reason: "quota exceeded"}, "ipp://localhost:6631/team=42")
+
+	assert.Equal(t, ipp.StatusOK, resp.Status())
+	assert.Equal(t, send.RequestID, resp.RequestID)
+	id, _ := resp.Attribute(ipp.TagJob, "job-id").Int()
+	assert.EqualValues(t, heldJobOffset+3, id)
+	assert.Equal(t, "ipp://localhost:6631/jobs/1073741827", resp.Attribute(ipp.TagJob, "job-uri").String())
+	state, _ := resp.Attribute(ipp.TagJob, "job-state").Int()
+	assert.Equal(t, ipp.JobStatePendingHeld, state)
+	assert.Equal(t, "quota exceeded", resp.Attribute(ipp.TagJob, "job-state-message").String())
+}
+
+// testPrinter points the proxy to a printer that responds to every request
+// using the fixture, the received requests are returned.
+func testPrinter(t *testing.T, fixture string) *[]*ipp.Message {
+	t.Helper()
+	response, err := os.ReadFile("ipp/testdata/" + fixture)
+	require.NoError(t, err)
+
+	received := new([]*ipp.Message)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		msg, _, err := ipp.DecodeBytes(b)
+		require.NoError(t, err)
+		*received = append(*received, msg)
+		_, _ = w.Write(response)
+	}))
+
+	old := printers
+	printers = mustParsePrinters(strings.TrimPrefix(srv.URL, "http://") + "/printers/test")
+	t.Cleanup(func() {
+		srv.Close()
+		printers = old
+	})
+
+	return received
+}
+
+func adminRequest(method, uri string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	adminRouter().Handler(ctx)
+	return ctx
+}
+
+func TestHeldQueue(t *testing.T) {
+	testLedger(t)
+	heldLocation = t.TempDir()
+	received := testPrinter(t, "create-job-response.bin")
+
+	create := testMessage(t, "create-job-request.bin")
+	send := testMessage(t, "send-document-request.bin")
+	job := &Job{JobID: 795, JobName: "main.cpp", Pages: 1}
+	require.NoError(t, holdJob(zlog.Logger, job, printRequest(send, create), strings.NewReader("%PDF-1.4 held\n%%EOF\n")))
+	assert.Equal(t, JobHeld, job.Status)
+	assert.EqualValues(t, 795, job.JobID, "the job-id of the printer must be kept")
+
+	printJob := &Job{Pages: 1}
+	require.NoError(t, holdJob(zlog.Logger, printJob, testMessage(t, "create-job-request.bin"), strings.NewReader("%PDF-1.4\n")))
+	assert.EqualValues(t, heldJobOffset+printJob.ID, printJob.JobID)
+
+	ctx := adminRequest(http.MethodGet, "/held")
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "main.cpp")
+	assert.Contains(t, string(ctx.Response.Body()), "/held/1/release")
+
+	ctx = adminRequest(http.MethodGet, "/held/1/document")
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "%PDF-1.4 held\n%%EOF\n", string(ctx.Response.Body()))
+
+	// Reprinting requires the job to be released first
+	ctx = adminRequest(http.MethodPost, "/held/1/reprint")
+	assert.Equal(t, http.StatusConflict, ctx.Response.StatusCode())
+	assert.Empty(t, *received)
+
+	ctx = adminRequest(http.MethodPost, "/held/1/release")
+	assert.Equal(t, http.StatusSeeOther, ctx.Response.StatusCode())
+	require.Len(t, *received, 1)
+	assert.Equal(t, ipp.OperationPrintJob, (*received)[0].Operation())
+	assert.Equal(t, printers[0].uri, (*received)[0].Attribute(ipp.TagOperation, "printer-uri").String())
+	assert.Equal(t, "two-sided-long-edge", (*received)[0].Attribute(ipp.TagJob, "sides").String())
+
+	var released Job
+	require.NoError(t, ledger.First(&released, job.ID).Error)
+	assert.Equal(t, JobForwarded, released.Status)
+	assert.EqualValues(t, 795, released.UpstreamJobID)
+	assert.NotNil(t, released.ReleasedAt)
+
+	ctx = adminRequest(http.MethodPost, "/held/1/release")
+	assert.Equal(t, http.StatusConflict, ctx.Response.StatusCode())
+	ctx = adminRequest(http.MethodPost, "/held/1/reprint")
+	assert.Equal(t, http.StatusSeeOther, ctx.Response.StatusCode())
+	assert.Len(t, *received, 2)
+
+	ctx = adminRequest(http.MethodPost, "/held/1/discard")
+	assert.Equal(t, http.StatusSeeOther, ctx.Response.StatusCode())
+	assert.NoFileExists(t, heldFile(1))
+	assert.Equal(t, http.StatusNotFound, adminRequest(http.MethodGet, "/held/1/document").Response.StatusCode())
+	assert.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/held/2/document").Response.StatusCode())
+}
+
+func TestAdminAuth(t *testing.T) {
+	adminCredentials = "jury:secret"
+	t.Cleanup(func() { adminCredentials = "" })
+
+	handler := adminAuth(func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(http.StatusNoContent) })
+	for auth, status := range map[string]int{
+		"":                               http.StatusUnauthorized,
+		"Basic anVyeTp3cm9uZw==":         http.StatusUnauthorized, // jury:wrong
+		"Basic anVyeTpzZWNyZXQ=":         http.StatusNoContent,    // jury:secret
+		"Bearer anVyeTpzZWNyZXQ=":        http.StatusUnauthorized,
+		"Basic bm90LWp1cnk6c2VjcmV0":     http.StatusUnauthorized, // not-jury:secret
+		"Basic anVyeTpzZWNyZXQ6ZXh0cmE=": http.StatusUnauthorized, // jury:secret:extra
+	} {
+		ctx := new(fasthttp.RequestCtx)
+		if auth != "" {
+			ctx.Request.Header.Set("Authorization", auth)
+		}
+
+		handler(ctx)
+		assert.Equal(t, status, ctx.Response.StatusCode(), auth)
+	}
+}
@@ -0,0 +1,548 @@
+// Package ipp implements decoding and encoding of IPP messages as described in
+// RFC 8010. Messages are decoded into typed attribute groups while keeping the
+// raw value encoding, this allows a decoded message to be encoded again
+// byte-for-byte.
+package ipp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type (
+	// Tag is either a delimiter tag, depicting the start of an attribute group,
+	// or a value tag, depicting the syntax of an attribute value.
+	Tag byte
+
+	// Operation is the operation-id of an IPP request.
+	Operation uint16
+
+	// Status is the status-code of an IPP response.
+	Status uint16
+
+	// Message is a single IPP request or response. Code contains either the
+	// operation-id, for requests, or the status-code, for responses.
+	Message struct {
+		Major, Minor byte
+		Code         uint16
+		RequestID    uint32
+		Groups       []*Group
+	}
+
+	// Group is an attribute group, the attributes are kept in the order they
+	// were encountered.
+	Group struct {
+		Tag        Tag
+		Attributes []*Attribute
+	}
+
+	// Attribute is a named attribute with one or more values. Collections are
+	// stored as a flat sequence of values, including their begin, member and end
+	// values, exactly as they are encoded.
+	Attribute struct {
+		Name   string
+		Values []Value
+	}
+
+	// Value is a single attribute value. Data contains the raw encoding of the
+	// value.
+	Value struct {
+		Tag  Tag
+		Data []byte
+	}
+)
+
+// Delimiter tags
+const (
+	TagOperation         Tag = 0x01
+	TagJob               Tag = 0x02
+	TagEnd               Tag = 0x03
+	TagPrinter           Tag = 0x04
+	TagUnsupportedGroup  Tag = 0x05
+	TagSubscription      Tag = 0x06
+	TagEventNotification Tag = 0x07
+	TagResource          Tag = 0x08
+	TagDocument          Tag = 0x09
+	TagSystem            Tag = 0x0A
+)
+
+// Out-of-band value tags
+const (
+	TagUnsupportedValue Tag = 0x10
+	TagDefault          Tag = 0x11
+	TagUnknown          Tag = 0x12
+	TagNoValue          Tag = 0x13
+	TagNotSettable      Tag = 0x15
+	TagDeleteAttribute  Tag = 0x16
+	TagAdminDefine      Tag = 0x17
+)
+
+// Value tags
+const (
+	TagInteger             Tag = 0x21
+	TagBoolean             Tag = 0x22
+	TagEnum                Tag = 0x23
+	TagOctetString         Tag = 0x30
+	TagDateTime            Tag = 0x31
+	TagResolution          Tag = 0x32
+	TagRangeOfInteger      Tag = 0x33
+	TagBeginCollection     Tag = 0x34
+	TagTextWithLanguage    Tag = 0x35
+	TagNameWithLanguage    Tag = 0x36
+	TagEndCollection       Tag = 0x37
+	TagTextWithoutLanguage Tag = 0x41
+	TagNameWithoutLanguage Tag = 0x42
+	TagKeyword             Tag = 0x44
+	TagURI                 Tag = 0x45
+	TagURIScheme           Tag = 0x46
+	TagCharset             Tag = 0x47
+	TagNaturalLanguage     Tag = 0x48
+	TagMimeMediaType       Tag = 0x49
+	TagMemberAttrName      Tag = 0x4A
+	TagExtension           Tag = 0x7F
+)
+
+// Operations
+const (
+	OperationPrintJob             Operation = 0x0002
+	OperationPrintURI             Operation = 0x0003
+	OperationValidateJob          Operation = 0x0004
+	OperationCreateJob            Operation = 0x0005
+	OperationSendDocument         Operation = 0x0006
+	OperationSendURI              Operation = 0x0007
+	OperationCancelJob            Operation = 0x0008
+	OperationGetJobAttributes     Operation = 0x0009
+	OperationGetJobs              Operation = 0x000A
+	OperationGetPrinterAttributes Operation = 0x000B
+	OperationHoldJob              Operation = 0x000C
+	OperationReleaseJob           Operation = 0x000D
+	OperationRestartJob           Operation = 0x000E
+	OperationPausePrinter         Operation = 0x0010
+	OperationResumePrinter        Operation = 0x0011
+	OperationPurgeJobs            Operation = 0x0012
+)
+
+// Status codes
+const (
+	StatusOK                              Status = 0x0000
+	StatusOKIgnoredOrSubstituted          Status = 0x0001
+	StatusOKConflicting                   Status = 0x0002
+	StatusClientErrorBadRequest           Status = 0x0400
+	StatusClientErrorForbidden            Status = 0x0401
+	StatusClientErrorNotAuthenticated     Status = 0x0402
+	StatusClientErrorNotAuthorized        Status = 0x0403
+	StatusClientErrorNotPossible          Status = 0x0404
+	StatusClientErrorTimeout              Status = 0x0405
+	StatusClientErrorNotFound             Status = 0x0406
+	StatusClientErrorGone                 Status = 0x0407
+	StatusClientErrorRequestEntityTooBig  Status = 0x0408
+	StatusClientErrorDocumentFormat       Status = 0x040A
+	StatusServerErrorInternalError        Status = 0x0500
+	StatusServerErrorOperationUnsupported Status = 0x0501
+	StatusServerErrorServiceUnavailable   Status = 0x0502
+	StatusServerErrorBusy                 Status = 0x0507
+)
+
+// Job states
+const (
+	JobStatePending           int32 = 3
+	JobStatePendingHeld       int32 = 4
+	JobStateProcessing        int32 = 5
+	JobStateProcessingStopped int32 = 6
+	JobStateCanceled          int32 = 7
+	JobStateAborted           int32 = 8
+	JobStateCompleted         int32 = 9
+)
+
+// Printer states
+const (
+	PrinterStateIdle       int32 = 3
+	PrinterStateProcessing int32 = 4
+	PrinterStateStopped    int32 = 5
+)
+
+var (
+	// ErrNoGroup is returned when an attribute is found outside an attribute group.
+	ErrNoGroup = errors.New("attribute found outside of an attribute group")
+
+	// ErrNoAttribute is returned when an additional value is found without a
+	// preceding attribute.
+	ErrNoAttribute = errors.New("additional value found without an attribute")
+)
+
+// IsDelimiter returns whether the tag depicts the start of a group, or the end
+// of the attributes.
+func (t Tag) IsDelimiter() bool {
+	return t < 0x10
+}
+
+// IsSuccessful returns whether the status-code is in the successful range.
+func (s Status) IsSuccessful() bool {
+	return s < 0x0100
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("0x%04x", uint16(s))
+}
+
+var operationNames = map[Operation]string{
+	OperationPrintJob:             "Print-Job",
+	OperationPrintURI:             "Print-URI",
+	OperationValidateJob:          "Validate-Job",
+	OperationCreateJob:            "Create-Job",
+	OperationSendDocument:         "Send-Document",
+	OperationSendURI:              "Send-URI",
+	OperationCancelJob:            "Cancel-Job",
+	OperationGetJobAttributes:     "Get-Job-Attributes",
+	OperationGetJobs:              "Get-Jobs",
+	OperationGetPrinterAttributes: "Get-Printer-Attributes",
+	OperationHoldJob:              "Hold-Job",
+	OperationReleaseJob:           "Release-Job",
+	OperationRestartJob:           "Restart-Job",
+	OperationPausePrinter:         "Pause-Printer",
+	OperationResumePrinter:        "Resume-Printer",
+	OperationPurgeJobs:            "Purge-Jobs",
+}
+
+// String returns the name of the operation, or its hexadecimal representation
+// when the operation is unknown.
+func (o Operation) String() string {
+	if name, ok := operationNames[o]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04x", uint16(o))
+}
+
+// NewRequest constructs an IPP/2.0 request, containing the required
+// attributes-charset and attributes-natural-language operation attributes.
+func NewRequest(op Operation, requestID uint32) *Message {
+	return &Message{
+		Major:     2,
+		Code:      uint16(op),
+		RequestID: requestID,
+		Groups:    []*Group{operationGroup()},
+	}
+}
+
+// NewResponse constructs the response to req, using the same version and
+// request-id.
+func NewResponse(req *Message, status Status) *Message {
+	return &Message{
+		Major:     req.Major,
+		Minor:     req.Minor,
+		Code:      uint16(status),
+		RequestID: req.RequestID,
+		Groups:    []*Group{operationGroup()},
+	}
+}
+
+func operationGroup() *Group {
+	return &Group{Tag: TagOperation, Attributes: []*Attribute{
+		{Name: "attributes-charset", Values: []Value{String(TagCharset, "utf-8")}},
+		{Name: "attributes-natural-language", Values: []Value{String(TagNaturalLanguage, "en")}},
+	}}
+}
+
+// Decode reads a single message from r, up to and including the
+// end-of-attributes-tag. Document data following the attributes is not read.
+func Decode(r io.Reader) (m *Message, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("could not read header; %w", err)
+	}
+
+	m = &Message{
+		Major:     header[0],
+		Minor:     header[1],
+		Code:      binary.BigEndian.Uint16(header[2:]),
+		RequestID: binary.BigEndian.Uint32(header[4:]),
+	}
+
+	var (
+		group *Group
+		attr  *Attribute
+		tag   [1]byte
+		size  [2]byte
+	)
+
+	readSized := func() ([]byte, error) {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, binary.BigEndian.Uint16(size[:]))
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+
+	for {
+		if _, err = io.ReadFull(r, tag[:]); err != nil {
+			return nil, fmt.Errorf("could not read tag; %w", err)
+		}
+
+		t := Tag(tag[0])
+		if t == TagEnd {
+			return m, nil
+		}
+
+		if t.IsDelimiter() {
+			group = &Group{Tag: t}
+			attr = nil
+			m.Groups = append(m.Groups, group)
+			continue
+		}
+
+		if group == nil {
+			return nil, ErrNoGroup
+		}
+
+		name, err := readSized()
+		if err != nil {
+			return nil, fmt.Errorf("could not read attribute name; %w", err)
+		}
+
+		value, err := readSized()
+		if err != nil {
+			return nil, fmt.Errorf("could not read value of '%s'; %w", name, err)
+		}
+
+		if len(name) > 0 {
+			attr = &Attribute{Name: string(name)}
+			group.Attributes = append(group.Attributes, attr)
+		} else if attr == nil {
+			return nil, ErrNoAttribute
+		}
+
+		attr.Values = append(attr.Values, Value{Tag: t, Data: value})
+	}
+}
+
+// DecodeBytes decodes the message at the start of b and returns the offset at
+// which the document data starts.
+func DecodeBytes(b []byte) (m *Message, offset int, err error) {
+	r := bytes.NewReader(b)
+	m, err = Decode(r)
+	offset = len(b) - r.Len()
+	return
+}
+
+// Encode writes the message to w, including the end-of-attributes-tag.
+func (m *Message) Encode(w io.Writer) error {
+	b := make([]byte, 0, m.Size())
+
+	b = append(b, m.Major, m.Minor)
+	b = binary.BigEndian.AppendUint16(b, m.Code)
+	b = binary.BigEndian.AppendUint32(b, m.RequestID)
+	for _, g := range m.Groups {
+		b = append(b, byte(g.Tag))
+		for _, a := range g.Attributes {
+			for k, v := range a.Values {
+				b = append(b, byte(v.Tag))
+
+				var name string
+				if k == 0 {
+					name = a.Name
+				}
+
+				b = binary.BigEndian.AppendUint16(b, uint16(len(name)))
+				b = append(b, name...)
+				b = binary.BigEndian.AppendUint16(b, uint16(len(v.Data)))
+				b = append(b, v.Data...)
+			}
+		}
+	}
+
+	b = append(b, byte(TagEnd))
+	_, err := w.Write(b)
+	return err
+}
+
+// Bytes returns the encoded message.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	_ = m.Encode(&b)
+	return b.Bytes()
+}
+
+// Size returns the number of bytes the encoded message occupies.
+func (m *Message) Size() int {
+	size := 9
+	for _, g := range m.Groups {
+		size++
+		for _, a := range g.Attributes {
+			size += len(a.Name)
+			for _, v := range a.Values {
+				size += 5 + len(v.Data)
+			}
+		}
+	}
+
+	return size
+}
+
+// Operation returns the operation-id of a request.
+func (m *Message) Operation() Operation {
+	return Operation(m.Code)
+}
+
+// Status returns the status-code of a response.
+func (m *Message) Status() Status {
+	return Status(m.Code)
+}
+
+// Group returns the first group with the tag, or nil when there is none.
+func (m *Message) Group(tag Tag) *Group {
+	for _, g := range m.Groups {
+		if g.Tag == tag {
+			return g
+		}
+	}
+
+	return nil
+}
+
+// AddGroup returns the first group with the tag, the group is appended when
+// there is none.
+func (m *Message) AddGroup(tag Tag) *Group {
+	if g := m.Group(tag); g != nil {
+		return g
+	}
+
+	g := &Group{Tag: tag}
+	m.Groups = append(m.Groups, g)
+	return g
+}
+
+// Attribute returns the first attribute called name within the first group
+// with the tag.
+func (m *Message) Attribute(tag Tag, name string) *Attribute {
+	return m.Group(tag).Attribute(name)
+}
+
+// Range calls fn for every attribute in every group, until fn returns false.
+func (m *Message) Range(fn func(g *Group, a *Attribute) bool) {
+	for _, g := range m.Groups {
+		for _, a := range g.Attributes {
+			if !fn(g, a) {
+				return
+			}
+		}
+	}
+}
+
+// Attribute returns the attribute called name, or nil when there is none. It
+// is safe to call on a nil group.
+func (g *Group) Attribute(name string) *Attribute {
+	if g == nil {
+		return nil
+	}
+
+	for _, a := range g.Attributes {
+		if a.Name == name {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// Set replaces the values of the attribute called name, or appends it when it
+// does not yet exist.
+func (g *Group) Set(name string, values ...Value) {
+	if a := g.Attribute(name); a != nil {
+		a.Values = values
+		return
+	}
+
+	g.Attributes = append(g.Attributes, &Attribute{Name: name, Values: values})
+}
+
+// Delete removes all attributes called name.
+func (g *Group) Delete(name string) {
+	attrs := g.Attributes[:0]
+	for _, a := range g.Attributes {
+		if a.Name != name {
+			attrs = append(attrs, a)
+		}
+	}
+
+	g.Attributes = attrs
+}
+
+// Int returns the first value as an integer. It is safe to call on a nil
+// attribute.
+func (a *Attribute) Int() (int32, bool) {
+	if a == nil || len(a.Values) == 0 {
+		return 0, false
+	}
+
+	return a.Values[0].Int()
+}
+
+// Bool returns the first value as a boolean. It is safe to call on a nil
+// attribute.
+func (a *Attribute) Bool() (bool, bool) {
+	if a == nil || len(a.Values) == 0 {
+		return false, false
+	}
+
+	return a.Values[0].Bool()
+}
+
+// String returns the first value as a string. It is safe to call on a nil
+// attribute.
+func (a *Attribute) String() string {
+	if a == nil || len(a.Values) == 0 {
+		return ""
+	}
+
+	return a.Values[0].String()
+}
+
+// Int returns the value as an integer, only integers and enums of exactly four
+// bytes are considered to be valid.
+func (v Value) Int() (int32, bool) {
+	if (v.Tag != TagInteger && v.Tag != TagEnum) || len(v.Data) != 4 {
+		return 0, false
+	}
+
+	return int32(binary.BigEndian.Uint32(v.Data)), true
+}
+
+// Bool returns the value as a boolean.
+func (v Value) Bool() (bool, bool) {
+	if v.Tag != TagBoolean || len(v.Data) != 1 {
+		return false, false
+	}
+
+	return v.Data[0] != 0, true
+}
+
+func (v Value) String() string {
+	return string(v.Data)
+}
+
+// Integer constructs an integer, or enum, value.
+func Integer(tag Tag, i int32) Value {
+	return Value{Tag: tag, Data: binary.BigEndian.AppendUint32(nil, uint32(i))}
+}
+
+// Boolean constructs a boolean value.
+func Boolean(b bool) Value {
+	v := Value{Tag: TagBoolean, Data: []byte{0}}
+	if b {
+		v.Data[0] = 1
+	}
+
+	return v
+}
+
+// String constructs a string-like value, such as a keyword, uri, or
+// mime-type.
+func String(tag Tag, s string) Value {
+	return Value{Tag: tag, Data: []byte(s)}
+}
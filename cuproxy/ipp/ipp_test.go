@@ -0,0 +1,153 @@
+package ipp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func golden(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/*.bin")
+	require.NoError(t, err)
+	require.NotEmpty(t, fixtures)
+
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			b := golden(t, filepath.Base(fixture))
+			m, offset, err := DecodeBytes(b)
+			require.NoError(t, err)
+
+			var out bytes.Buffer
+			require.NoError(t, m.Encode(&out))
+			assert.Equal(t, b[:offset], out.Bytes())
+			assert.Equal(t, offset, m.Size())
+		})
+	}
+}
+
+func TestDecodeLeavesData(t *testing.T) {
+	r := bytes.NewReader(golden(t, "send-document-request.bin"))
+	m, err := Decode(r)
+	require.NoError(t, err)
+
+	assert.Equal(t, OperationSendDocument, m.Operation())
+	assert.EqualValues(t, 2, m.RequestID)
+	last, ok := m.Attribute(TagOperation, "last-document").Bool()
+	assert.True(t, ok)
+	assert.True(t, last)
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, []byte("%PDF-1.4")))
+	assert.True(t, bytes.HasSuffix(data, []byte("%%EOF\n")))
+}
+
+func TestAttributes(t *testing.T) {
+	m, _, err := DecodeBytes(golden(t, "create-job-response.bin"))
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusOK, m.Status())
+	id, ok := m.Attribute(TagJob, "job-id").Int()
+	assert.True(t, ok)
+	assert.EqualValues(t, 795, id)
+
+	assert.Equal(t, "ipp://printserver:631/jobs/795", m.Attribute(TagJob, "job-uri").String())
+	assert.Nil(t, m.Attribute(TagPrinter, "job-id"))
+
+	_, ok = m.Attribute(TagJob, "job-state-message").Int()
+	assert.False(t, ok)
+}
+
+func TestCollectionsAndMultipleValues(t *testing.T) {
+	m, _, err := DecodeBytes(golden(t, "get-printer-attributes-response.bin"))
+	require.NoError(t, err)
+
+	require.Len(t, m.Groups, 3)
+	assert.Equal(t, TagUnsupportedGroup, m.Groups[2].Tag)
+
+	formats := m.Attribute(TagPrinter, "document-format-supported")
+	require.NotNil(t, formats)
+	require.Len(t, formats.Values, 4)
+	assert.Equal(t, "image/urf", formats.Values[2].String())
+
+	col := m.Attribute(TagPrinter, "media-col-default")
+	require.NotNil(t, col)
+	assert.Equal(t, TagBeginCollection, col.Values[0].Tag)
+	assert.Equal(t, TagEndCollection, col.Values[len(col.Values)-1].Tag)
+
+	// The attribute following the collection must not be swallowed by it
+	copies := m.Attribute(TagPrinter, "copies-supported")
+	require.NotNil(t, copies)
+	assert.Equal(t, TagRangeOfInteger, copies.Values[0].Tag)
+}
+
+func TestSetAndDelete(t *testing.T) {
+	m, _, err := DecodeBytes(golden(t, "create-job-request.bin"))
+	require.NoError(t, err)
+
+	op := m.Group(TagOperation)
+	op.Set("printer-uri", String(TagURI, "ipp://printserver:631/printers/Actual_Printer"))
+	op.Set("job-id", Integer(TagInteger, 12))
+	m.Group(TagJob).Delete("copies")
+
+	d, _, err := DecodeBytes(m.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "ipp://printserver:631/printers/Actual_Printer", d.Attribute(TagOperation, "printer-uri").String())
+	id, _ := d.Attribute(TagOperation, "job-id").Int()
+	assert.EqualValues(t, 12, id)
+	assert.Nil(t, d.Attribute(TagJob, "copies"))
+	assert.Equal(t, "two-sided-long-edge", d.Attribute(TagJob, "sides").String())
+}
+
+func TestNewResponse(t *testing.T) {
+	req, _, err := DecodeBytes(golden(t, "create-job-request.bin"))
+	require.NoError(t, err)
+
+	resp := NewResponse(req, StatusClientErrorNotPossible)
+	resp.AddGroup(TagJob).Set("job-state", Integer(TagEnum, JobStatePendingHeld))
+	resp.AddGroup(TagOperation).Set("status-message", String(TagTextWithoutLanguage, "quota exceeded"))
+
+	d, _, err := DecodeBytes(resp.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, req.RequestID, d.RequestID)
+	assert.Equal(t, req.Major, d.Major)
+	assert.Equal(t, StatusClientErrorNotPossible, d.Status())
+	assert.Equal(t, "utf-8", d.Attribute(TagOperation, "attributes-charset").String())
+	assert.Equal(t, "quota exceeded", d.Attribute(TagOperation, "status-message").String())
+	state, _ := d.Attribute(TagJob, "job-state").Int()
+	assert.Equal(t, JobStatePendingHeld, state)
+	assert.Len(t, d.Groups, 2)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"short header":      {0x02, 0x00, 0x00},
+		"no group":          {0x02, 0x00, 0x00, 0x0B, 0, 0, 0, 1, 0x21, 0, 1, 'a', 0, 0},
+		"no end":            {0x02, 0x00, 0x00, 0x0B, 0, 0, 0, 1, 0x01},
+		"dangling value":    {0x02, 0x00, 0x00, 0x0B, 0, 0, 0, 1, 0x01, 0x21, 0, 0, 0, 0, 0x03},
+		"truncated value":   {0x02, 0x00, 0x00, 0x0B, 0, 0, 0, 1, 0x01, 0x21, 0, 1, 'a', 0, 4, 0},
+		"truncated name":    {0x02, 0x00, 0x00, 0x0B, 0, 0, 0, 1, 0x01, 0x21, 0, 9, 'a'},
+		"truncated attr":    {0x02, 0x00, 0x00, 0x0B, 0, 0, 0, 1, 0x01, 0x21},
+		"plain http body":   []byte("GET / HTTP/1.1\r\n"),
+		"empty":             {},
+		"only version":      {0x02, 0x00},
+		"operation only id": {0x02, 0x00, 0x00, 0x0B, 0, 0, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := DecodeBytes(b)
+			assert.Error(t, err)
+		})
+	}
+}
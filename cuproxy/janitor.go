@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/tuupke/pixie/env"
+	"github.com/tuupke/pixie/lifecycle"
+)
+
+var (
+	janitorInterval = env.DurationFb("JANITOR_INTERVAL", time.Minute)
+	promiseExpiry   = env.DurationFb("PROMISE_EXPIRY", time.Hour)
+	fileMaxAge      = env.DurationFb("FILE_MAX_AGE", 12*time.Hour)
+	fileMaxSize     = int64(env.IntFb("FILE_MAX_SIZE", 256<<20)) // 256 MiB
+	dumpMaxAge      = env.DurationFb("DUMP_MAX_AGE", 0)
+	dumpMaxSize     = int64(env.IntFb("DUMP_MAX_SIZE", 1<<30)) // 1 GiB
+)
+
+// janitor periodically expires promises, and prunes banners, images and dumps,
+// until the context is done.
+func janitor(ctx context.Context, log zerolog.Logger) {
+	if janitorInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweep(log, now)
+		}
+	}
+}
+
+// sweep expires the promises, and prunes the files, once.
+func sweep(log zerolog.Logger, now time.Time) {
+	expirePromises(log, now)
+
+	referenced := referencedFiles()
+	prune(log, pdfLocation, func(name string) bool {
+		return ownedFile(name, ".pdf")
+	}, fileMaxAge, fileMaxSize, now)
+
+	prune(log, downloadTo, func(name string) bool {
+		return ownedFile(name, ".jpeg", ".png", ".gif") && !referenced[filepath.Join(downloadTo, name)]
+	}, fileMaxAge, fileMaxSize, now)
+
+	if dumpsPath != "" && (dumpReplacements || dumpOriginal) {
+		prune(log, dumpsPath, func(name string) bool {
+			return strings.HasSuffix(name, ".bin")
+		}, dumpMaxAge, dumpMaxSize, now)
+	}
+}
+
+// forgetPromise removes the promise of the job, the banner is released once
+// rendered.
+func forgetPromise(log zerolog.Logger, jobId int32) {
+	if v, ok := requestPromises.LoadAndDelete(jobId); ok {
+		log.Debug().Int32("job-id", jobId).Msg("forgot promise")
+		v.release()
+	}
+}
+
+// expirePromises removes the promises of jobs created longer than
+// PROMISE_EXPIRY ago, i.e. jobs of which the documents never arrived.
+func expirePromises(log zerolog.Logger, now time.Time) {
+	if promiseExpiry <= 0 {
+		return
+	}
+
+	var expired []int32
+	requestPromises.Range(func(jobId int32, v promiseInteraction) bool {
+		if now.Sub(v.created) > promiseExpiry {
+			expired = append(expired, jobId)
+		}
+
+		return true
+	})
+
+	for _, jobId := range expired {
+		forgetPromise(log, jobId)
+	}
+
+	if len(expired) > 0 {
+		log.Info().Int("expired", len(expired)).Int("remaining", requestPromises.Size()).Msg("expired promises")
+	}
+}
+
+// release stops waiting for the banner-data, and closes the banner once it is
+// rendered. Only to be used for promises no job awaits.
+func (v promiseInteraction) release() {
+	if v.callItIn != nil {
+		v.callItIn()
+	}
+
+	if v.pdfPromise == nil {
+		return
+	}
+
+	go func() {
+		if f, err := v.pdfPromise.Await(lifecycle.ApplicationContext()); err == nil && f != nil && *f != nil {
+			_ = (*f).Close()
+		}
+	}()
+}
+
+// ownedFile returns whether the file is named after the ip of a client, see
+// ipFileName, using one of the extensions. Banners and images are stored in
+// directories that default to the temporary directory, other files must be
+// left alone.
+func ownedFile(name string, exts ...string) bool {
+	ext := filepath.Ext(name)
+	return slices.Contains(exts, ext) && net.ParseIP(strings.ReplaceAll(strings.TrimSuffix(name, ext), "-", ":")) != nil
+}
+
+// referencedFiles returns the images that are part of the banner-data of a
+// client. These are not pruned, as webhooks might not download them again.
+func referencedFiles() map[string]bool {
+	referenced := make(map[string]bool)
+	add := func(key, value string) bool {
+		if strings.HasPrefix(key, "img") {
+			referenced[filepath.Clean(value)] = true
+		}
+
+		return true
+	}
+
+	for _, p := range allProps() {
+		p.Range(add)
+	}
+
+	persistedProps.Range(func(_ string, p cachedProps) bool {
+		for k, v := range p.Data {
+			add(k, v)
+		}
+
+		return true
+	})
+
+	return referenced
+}
+
+// prune removes the files in the directory accepted by owned which are older
+// than maxAge, and then the oldest files until the remainder fits in maxSize.
+// A maxAge, or maxSize, of zero disables that limit.
+func prune(log zerolog.Logger, dir string, owned func(name string) bool, maxAge time.Duration, maxSize int64, now time.Time) (removed int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Err(err).Str("dir", dir).Msg("cannot list files to prune")
+		return 0
+	}
+
+	var files []fs.FileInfo
+	var size int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !owned(entry.Name()) {
+			continue
+		}
+
+		if fi, err := entry.Info(); err == nil {
+			files = append(files, fi)
+			size += fi.Size()
+		}
+	}
+
+	slices.SortFunc(files, func(a, b fs.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+
+	var freed int64
+	for _, fi := range files {
+		expired := maxAge > 0 && now.Sub(fi.ModTime()) > maxAge
+		if !expired && (maxSize <= 0 || size <= maxSize) {
+			break
+		}
+
+		name := filepath.Join(dir, fi.Name())
+		if err := os.Remove(name); err != nil {
+			log.Err(err).Str("file", name).Msg("cannot prune file")
+			continue
+		}
+
+		size -= fi.Size()
+		freed += fi.Size()
+		removed++
+	}
+
+	if removed > 0 {
+		log.Info().Str("dir", dir).Int("removed", removed).Int64("freed", freed).Int64("remaining", size).Msg("pruned files")
+	}
+
+	return removed
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chebyrash/promise"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile creates the file of the given size, modified at the time.
+func writeFile(t *testing.T, name string, size int, modified time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(name, make([]byte, size), 0644))
+	require.NoError(t, os.Chtimes(name, modified, modified))
+}
+
+func TestExpirePromises(t *testing.T) {
+	now := time.Now()
+	banner, err := os.CreateTemp(t.TempDir(), "banner-*")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	expired := promiseInteraction{
+		callItIn: cancel,
+		pdfPromise: promise.New(func(resolve func(*os.File), _ func(error)) {
+			resolve(banner)
+		}),
+		created: now.Add(-2 * promiseExpiry),
+	}
+
+	requestPromises.Store(-181, expired)
+	requestPromises.Store(-182, promiseInteraction{created: now})
+	t.Cleanup(func() { requestPromises.Delete(-182) })
+
+	expirePromises(zlog.Logger, now)
+	_, ok := requestPromises.Load(-181)
+	assert.False(t, ok, "the promise expired")
+	_, ok = requestPromises.Load(-182)
+	assert.True(t, ok)
+
+	assert.Error(t, ctx.Err(), "waiting for the banner-data is cancelled")
+	assert.Eventually(t, func() bool {
+		_, err := banner.Stat()
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "the banner is closed")
+
+	forgetPromise(zlog.Logger, -182)
+	_, ok = requestPromises.Load(-182)
+	assert.False(t, ok)
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "10.18.0.1.pdf"), 10, now.Add(-48*time.Hour))
+	writeFile(t, filepath.Join(dir, "10.18.0.2.pdf"), 10, now.Add(-3*time.Hour))
+	writeFile(t, filepath.Join(dir, "10.18.0.3.pdf"), 10, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(dir, "10.18.0.4.pdf"), 10, now.Add(-time.Hour))
+	writeFile(t, filepath.Join(dir, "report.pdf"), 10, now.Add(-48*time.Hour))
+	writeFile(t, filepath.Join(dir, "10.18.0.5.png"), 10, now.Add(-48*time.Hour))
+	writeFile(t, filepath.Join(dir, "2001-db8--18.pdf"), 10, now.Add(-48*time.Hour))
+
+	owned := func(name string) bool { return ownedFile(name, ".pdf") }
+	assert.Equal(t, 2, prune(zlog.Logger, dir, owned, 24*time.Hour, 0, now), "only expired files are removed")
+	assert.Equal(t, 1, prune(zlog.Logger, dir, owned, 24*time.Hour, 20, now), "the oldest files are removed to fit the size")
+	assert.Equal(t, 0, prune(zlog.Logger, dir, owned, 0, 0, now))
+
+	var names []string
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	assert.ElementsMatch(t, []string{"10.18.0.3.pdf", "10.18.0.4.pdf", "report.pdf", "10.18.0.5.png"}, names)
+	assert.Zero(t, prune(zlog.Logger, filepath.Join(dir, "missing"), owned, time.Hour, 0, now))
+}
+
+func TestSweepKeepsReferencedImages(t *testing.T) {
+	oldDownload, oldPdf := downloadTo, pdfLocation
+	downloadTo, pdfLocation = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { downloadTo, pdfLocation = oldDownload, oldPdf })
+
+	old := time.Now().Add(-2 * fileMaxAge)
+	referenced := filepath.Join(downloadTo, "10.18.1.1.png")
+	unreferenced := filepath.Join(downloadTo, "10.18.1.2.png")
+	writeFile(t, referenced, 10, old)
+	writeFile(t, unreferenced, 10, old)
+	writeFile(t, filepath.Join(pdfLocation, "10.18.1.1.pdf"), 10, old)
+
+	data := Load(net.ParseIP("10.18.1.1"), nil, "janitor")
+	data.Store("img_logo", referenced)
+
+	sweep(zlog.Logger, time.Now())
+	assert.FileExists(t, referenced)
+	assert.NoFileExists(t, unreferenced)
+	assert.NoFileExists(t, filepath.Join(pdfLocation, "10.18.1.1.pdf"), "banners are rendered again when needed")
+}
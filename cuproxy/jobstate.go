@@ -0,0 +1,202 @@
+package main
+
+import (
+	"github.com/rs/zerolog"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+// clientJobId returns the job-id the client knows the recorded job by. Print-Job
+// jobs that never reached a printer have no job-id, their ledger-id is offset
+// like that of held jobs.
+func clientJobId(job Job) int32 {
+	if job.JobID != 0 {
+		return job.JobID
+	}
+
+	return heldJobOffset + int32(job.ID)
+}
+
+// knownJob returns the latest recorded job the client, at the ip, knows by the
+// job-id. Jobs of other clients are not found.
+func knownJob(jobId int32, ip string) (job Job, found bool) {
+	if ledger == nil || jobId <= 0 {
+		return job, false
+	}
+
+	q := ledger.Where("job_id = ?", jobId)
+	if jobId >= heldJobOffset {
+		q = q.Or("job_id = 0 AND id = ?", jobId-heldJobOffset)
+	}
+
+	return job, ledger.Where(q).Where("requesting_ip = ?", ip).Order("id DESC").First(&job).Error == nil
+}
+
+// listedJob returns the latest recorded job listed by the printer using the
+// local job-id. Jobs that were migrated, or released, are known to the printer
+// by their upstream job-id.
+func listedJob(jobId int32) (job Job, found bool) {
+	if ledger == nil || jobId <= 0 {
+		return job, false
+	}
+
+	q := ledger.Where("job_id = ?", jobId)
+	if p, upstream := upstreamJob(jobId); p != nil {
+		q = q.Or("printer = ? AND upstream_job_id = ?", p.name, upstream)
+	}
+
+	return job, q.Order("id DESC").First(&job).Error == nil
+}
+
+// jobState returns the state of the recorded job. Only jobs that did not reach
+// the printer have a state of their own, the state of other jobs is what the
+// printer reports.
+func jobState(job Job) (state int32, reason, message string, own bool) {
+	switch job.Status {
+	case JobHeld:
+		message = job.Reason
+		if message == "" {
+			message = "awaiting approval"
+		}
+
+		return ipp.JobStatePendingHeld, "job-hold-until-specified", message, true
+	case JobRejected:
+		return ipp.JobStateAborted, "aborted-by-system", job.Reason, true
+	case JobDiscarded:
+		return ipp.JobStateCanceled, "job-canceled-by-operator", "discarded by the operator", true
+	case JobFailed:
+		return ipp.JobStateAborted, "aborted-by-system", "cannot send job to printer", true
+	}
+
+	if job.Flagged {
+		message = job.Reason
+	}
+
+	return 0, "", message, false
+}
+
+// overlayJob sets what cuproxy knows about the job on the job attributes.
+func overlayJob(attrs *ipp.Group, job Job) {
+	state, reason, message, own := jobState(job)
+	if own {
+		attrs.Set("job-state", ipp.Integer(ipp.TagEnum, state))
+		attrs.Set("job-state-reasons", ipp.String(ipp.TagKeyword, reason))
+	}
+
+	if message != "" {
+		attrs.Set("job-state-message", ipp.String(ipp.TagTextWithoutLanguage, message))
+	}
+
+	// The printer only counts the pages it received, the banner included.
+	// Copies printed by the printer itself are not counted.
+	if job.Impressions > 0 {
+		attrs.Set("job-impressions", ipp.Integer(ipp.TagInteger, int32(job.Impressions)))
+	}
+}
+
+// jobAttributes constructs the job attributes of a job the printer does not
+// know.
+func jobAttributes(job Job, printerUrl string) *ipp.Group {
+	id := clientJobId(job)
+	attrs := &ipp.Group{Tag: ipp.TagJob}
+	attrs.Set("job-id", ipp.Integer(ipp.TagInteger, id))
+	attrs.Set("job-uri", ipp.String(ipp.TagURI, jobUri(printerUrl, id)))
+	attrs.Set("job-printer-uri", ipp.String(ipp.TagURI, printerUrl))
+	attrs.Set("time-at-creation", ipp.Integer(ipp.TagInteger, int32(job.CreatedAt.Unix())))
+	attrs.Set("job-k-octets", ipp.Integer(ipp.TagInteger, int32((job.OriginalSize+1023)/1024)))
+	if job.JobName != "" {
+		attrs.Set("job-name", ipp.String(ipp.TagNameWithoutLanguage, job.JobName))
+	}
+
+	if job.User != "" {
+		attrs.Set("job-originating-user-name", ipp.String(ipp.TagNameWithoutLanguage, job.User))
+	}
+
+	overlayJob(attrs, job)
+	return attrs
+}
+
+// jobAttributesResponse constructs the response to a Get-Job-Attributes request
+// for a job the printer does not know.
+func jobAttributesResponse(req *ipp.Message, job Job, printerUrl string) *ipp.Message {
+	resp := ipp.NewResponse(req, ipp.StatusOK)
+	resp.Groups = append(resp.Groups, jobAttributes(job, printerUrl))
+	return resp
+}
+
+// unlistedStatuses returns the statuses of recorded jobs the printer does not
+// list, that match the which-jobs of the Get-Jobs request.
+func unlistedStatuses(req *ipp.Message) []string {
+	switch req.Attribute(ipp.TagOperation, "which-jobs").String() {
+	case "completed":
+		return []string{JobRejected, JobDiscarded, JobFailed}
+	case "all":
+		return []string{JobHeld, JobRejected, JobDiscarded, JobFailed}
+	default:
+		return []string{JobHeld}
+	}
+}
+
+// overlayJobs sets what cuproxy knows on the jobs in the response to the
+// Get-Jobs, or Get-Job-Attributes, request. Jobs of the client that did not
+// reach the printer are added to the response of Get-Jobs.
+func overlayJobs(log zerolog.Logger, resp, req *ipp.Message, printerUrl, ip string) {
+	if ledger == nil {
+		return
+	}
+
+	listed := make(map[int32]bool)
+	for _, attrs := range resp.Groups {
+		if attrs.Tag != ipp.TagJob {
+			continue
+		}
+
+		id, ok := attrs.Attribute("job-id").Int()
+		if !ok {
+			continue
+		}
+
+		job, found := listedJob(id)
+		if !found {
+			listed[id] = true
+			continue
+		}
+
+		// The client keeps using the job-id of the job it created.
+		if clientId := clientJobId(job); clientId != id {
+			attrs.Set("job-id", ipp.Integer(ipp.TagInteger, clientId))
+			if a := attrs.Attribute("job-uri"); a != nil {
+				a.Values = []ipp.Value{ipp.String(ipp.TagURI, setJobUriId(a.String(), clientId))}
+			}
+
+			id = clientId
+		}
+
+		listed[id] = true
+		overlayJob(attrs, job)
+	}
+
+	if req.Operation() != ipp.OperationGetJobs {
+		return
+	}
+
+	q := ledger.Where("requesting_ip = ? AND status IN ?", ip, unlistedStatuses(req))
+	if mine, _ := req.Attribute(ipp.TagOperation, "my-jobs").Bool(); mine {
+		q = q.Where("user = ?", req.Attribute(ipp.TagOperation, "requesting-user-name").String())
+	}
+
+	limit := 100
+	if l, ok := req.Attribute(ipp.TagOperation, "limit").Int(); ok && l > 0 && int(l) < limit {
+		limit = int(l)
+	}
+
+	var jobs []Job
+	err := q.Order("id DESC").Limit(limit).Find(&jobs).Error
+	log.Err(err).Int("jobs", len(jobs)).Msg("listed jobs unknown to printer")
+	for _, job := range jobs {
+		if id := clientJobId(job); !listed[id] {
+			listed[id] = true
+			resp.Groups = append(resp.Groups, jobAttributes(job, printerUrl))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+func TestOverlayJobs(t *testing.T) {
+	testLedger(t)
+	pool := testPool(t, "A=a:631,B=b:631")
+	const ip, printerUrl = "10.0.0.7", "ipp://localhost:6631/printers/team"
+
+	forwarded := &Job{JobID: localJobId(pool[0], 12), RequestingIP: ip, Printer: "A", Status: JobForwarded, Pages: 3, Impressions: 4, Flagged: true, Reason: "document contains blocked text"}
+	migrated := &Job{JobID: localJobId(pool[0], 13), UpstreamJobID: 7, RequestingIP: ip, Printer: "B", Status: JobForwarded, Impressions: 2}
+	held := &Job{RequestingIP: ip, User: "team7", JobName: "main.c", Status: JobHeld, Reason: "quota exceeded"}
+	rejected := &Job{RequestingIP: ip, User: "team7", Status: JobRejected, Reason: "document is encrypted"}
+	other := &Job{RequestingIP: "10.0.0.8", Status: JobHeld}
+	for _, job := range []*Job{forwarded, migrated, held, rejected, other} {
+		recordJob(zlog.Logger, job)
+	}
+
+	held.JobID = heldJobOffset + int32(held.ID)
+	recordJob(zlog.Logger, held)
+
+	known, found := knownJob(heldJobOffset+int32(rejected.ID), ip)
+	require.True(t, found, "rejected Print-Job jobs are known by their offset ledger-id")
+	assert.Equal(t, rejected.ID, known.ID)
+	_, found = knownJob(localJobId(pool[1], 7), ip)
+	assert.False(t, found)
+
+	// Other clients do not know the jobs
+	_, found = knownJob(heldJobOffset+int32(rejected.ID), "10.0.0.8")
+	assert.False(t, found)
+	_, found = knownJob(forwarded.JobID, "10.0.0.8")
+	assert.False(t, found)
+	_, found = knownJob(held.JobID, "10.0.0.8")
+	assert.False(t, found)
+	_, found = knownJob(heldJobOffset+int32(other.ID), "10.0.0.8")
+	assert.True(t, found)
+
+	// Jobs that did not reach the printer are answered by cuproxy
+	req := ipp.NewRequest(ipp.OperationGetJobAttributes, 1)
+	resp := jobAttributesResponse(req, known, printerUrl)
+	assert.Equal(t, ipp.StatusOK, resp.Status())
+	state, _ := resp.Attribute(ipp.TagJob, "job-state").Int()
+	assert.Equal(t, ipp.JobStateAborted, state)
+	assert.Equal(t, "aborted-by-system", resp.Attribute(ipp.TagJob, "job-state-reasons").String())
+	assert.Equal(t, "document is encrypted", resp.Attribute(ipp.TagJob, "job-state-message").String())
+	assert.Equal(t, "ipp://localhost:6631/jobs/"+itoa(heldJobOffset+int32(rejected.ID)), resp.Attribute(ipp.TagJob, "job-uri").String())
+
+	// The printer lists the forwarded and migrated jobs, the migrated job by
+	// its job-id on the other printer.
+	listing := func() *ipp.Message {
+		resp := ipp.NewResponse(ipp.NewRequest(ipp.OperationGetJobs, 2), ipp.StatusOK)
+		for _, id := range []int32{localJobId(pool[0], 12), localJobId(pool[1], 7)} {
+			attrs := &ipp.Group{Tag: ipp.TagJob}
+			attrs.Set("job-id", ipp.Integer(ipp.TagInteger, id))
+			attrs.Set("job-uri", ipp.String(ipp.TagURI, jobUri(printerUrl, id)))
+			attrs.Set("job-state", ipp.Integer(ipp.TagEnum, ipp.JobStateProcessing))
+			attrs.Set("job-impressions", ipp.Integer(ipp.TagInteger, 3))
+			resp.Groups = append(resp.Groups, attrs)
+		}
+
+		return resp
+	}
+
+	jobs := func(resp *ipp.Message) map[int32]*ipp.Group {
+		groups := make(map[int32]*ipp.Group)
+		for _, g := range resp.Groups {
+			if id, ok := g.Attribute("job-id").Int(); ok && g.Tag == ipp.TagJob {
+				groups[id] = g
+			}
+		}
+
+		return groups
+	}
+
+	req = ipp.NewRequest(ipp.OperationGetJobs, 2)
+	resp = listing()
+	overlayJobs(zlog.Logger, resp, req, printerUrl, ip)
+	groups := jobs(resp)
+	require.Len(t, groups, 3, "the held job is added, the job of the other client is not")
+
+	g := groups[forwarded.JobID]
+	require.NotNil(t, g)
+	impressions, _ := g.Attribute("job-impressions").Int()
+	assert.EqualValues(t, 4, impressions, "the banner is counted")
+	state, _ = g.Attribute("job-state").Int()
+	assert.Equal(t, ipp.JobStateProcessing, state)
+	assert.Equal(t, "document contains blocked text", g.Attribute("job-state-message").String())
+
+	g = groups[migrated.JobID]
+	require.NotNil(t, g, "the client keeps the job-id of the job it created")
+	assert.Equal(t, jobUri(printerUrl, migrated.JobID), g.Attribute("job-uri").String())
+
+	g = groups[held.JobID]
+	require.NotNil(t, g)
+	state, _ = g.Attribute("job-state").Int()
+	assert.Equal(t, ipp.JobStatePendingHeld, state)
+	assert.Equal(t, "quota exceeded", g.Attribute("job-state-message").String())
+	assert.Equal(t, "main.c", g.Attribute("job-name").String())
+
+	// Completed jobs include the rejected job
+	req.AddGroup(ipp.TagOperation).Set("which-jobs", ipp.String(ipp.TagKeyword, "completed"))
+	resp = listing()
+	overlayJobs(zlog.Logger, resp, req, printerUrl, ip)
+	groups = jobs(resp)
+	assert.Len(t, groups, 3)
+	assert.NotNil(t, groups[heldJobOffset+int32(rejected.ID)])
+
+	// Other users are left out of my-jobs
+	req.AddGroup(ipp.TagOperation).Set("which-jobs", ipp.String(ipp.TagKeyword, "all"))
+	req.AddGroup(ipp.TagOperation).Set("my-jobs", ipp.Boolean(true))
+	req.AddGroup(ipp.TagOperation).Set("requesting-user-name", ipp.String(ipp.TagNameWithoutLanguage, "team8"))
+	resp = listing()
+	overlayJobs(zlog.Logger, resp, req, printerUrl, ip)
+	assert.Len(t, jobs(resp), 2)
+}
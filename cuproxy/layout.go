@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasttemplate"
+	"gopkg.in/yaml.v3"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	elementText    = "text"
+	elementBox     = "box"
+	elementImage   = "image"
+	elementQR      = "qr"
+	elementCode128 = "code128"
+	elementKeys    = "keys"
+
+	// minFitSize is the smallest font size, in points, text is shrunk to.
+	minFitSize = 4
+)
+
+var (
+	// bannerTemplate replaces the key-value listing of the banner, when set.
+	bannerTemplateFile = env.String("BANNER_TEMPLATE")
+	bannerTemplate     = mustLoadLayout(bannerTemplateFile)
+
+	alignments  = map[string]string{"": "L", "left": "L", "center": "C", "right": "R"}
+	vAlignments = map[string]string{"": "T", "top": "T", "middle": "M", "bottom": "B"}
+)
+
+type (
+	// layout describes the banner page. Positions and sizes are in PDF_UNIT,
+	// font sizes in points. All texts, and values of barcodes and images, can
+	// contain `{{key}}` placeholders, which are replaced by the banner-data.
+	layout struct {
+		Size        string          `yaml:"size"`
+		Landscape   *bool           `yaml:"landscape"`
+		Fonts       []layoutFont    `yaml:"fonts"`
+		Elements    []layoutElement `yaml:"elements"`
+		DefaultFont string          `yaml:"font"`
+
+		utf8Fonts map[string]bool
+	}
+
+	// layoutFont is a TrueType font, the file is relative to PDF_FONT_DIR.
+	layoutFont struct {
+		Family string `yaml:"family"`
+		Style  string `yaml:"style"`
+		File   string `yaml:"file"`
+	}
+
+	// layoutElement is a single element of the banner, drawn in order.
+	layoutElement struct {
+		Type string  `yaml:"type"`
+		X    float64 `yaml:"x"`
+		Y    float64 `yaml:"y"`
+		W    float64 `yaml:"w"`
+		H    float64 `yaml:"h"`
+
+		// Value is the text, the encoded value of a barcode, or the location of
+		// an image.
+		Value string `yaml:"value"`
+
+		// Keys are the banner-data keys listed by a keys element, "*" lists
+		// all keys.
+		Keys []string `yaml:"keys"`
+
+		Font   string  `yaml:"font"`
+		Style  string  `yaml:"style"`
+		Size   float64 `yaml:"size"`
+		Align  string  `yaml:"align"`
+		VAlign string  `yaml:"valign"`
+
+		// Fit shrinks the text until it fits the width, Wrap breaks it into
+		// multiple lines instead.
+		Fit  bool `yaml:"fit"`
+		Wrap bool `yaml:"wrap"`
+
+		Color  string  `yaml:"color"`
+		Fill   string  `yaml:"fill"`
+		Border float64 `yaml:"border"`
+	}
+)
+
+func mustLoadLayout(file string) *layout {
+	l, err := loadLayout(file)
+	if err != nil {
+		panic(fmt.Errorf("invalid BANNER_TEMPLATE; %w", err))
+	}
+
+	return l
+}
+
+// loadLayout reads the layout from the YAML, or JSON, file. The layout is
+// validated by rendering it once without any data. No layout is returned when
+// the file is empty.
+func loadLayout(file string) (*layout, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read banner template '%v'; %w", file, err)
+	}
+
+	return parseLayout(b)
+}
+
+func parseLayout(b []byte) (*layout, error) {
+	l := new(layout)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(l); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot parse banner template; %w", err)
+	}
+
+	if err := l.validate(); err != nil {
+		return nil, err
+	}
+
+	if _, err := l.render(zerolog.Nop(), io.Discard, kvs{}); err != nil {
+		return nil, fmt.Errorf("cannot render banner template; %w", err)
+	}
+
+	return l, nil
+}
+
+// validate checks the layout for mistakes that do not prevent rendering, but
+// do result in a banner missing elements.
+func (l *layout) validate() error {
+	if len(l.Elements) == 0 {
+		return fmt.Errorf("banner template does not contain any elements")
+	}
+
+	l.utf8Fonts = make(map[string]bool, len(l.Fonts))
+	for _, f := range l.Fonts {
+		if f.Family == "" || f.File == "" {
+			return fmt.Errorf("font '%v' requires both a family and a file", f.Family)
+		}
+
+		l.utf8Fonts[strings.ToLower(f.Family)] = true
+	}
+
+	for k, e := range l.Elements {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("element %v (%v); %w", k+1, e.Type, err)
+		}
+	}
+
+	return nil
+}
+
+func (e layoutElement) validate() error {
+	if _, ok := alignments[e.Align]; !ok {
+		return fmt.Errorf("invalid align '%v'", e.Align)
+	}
+
+	if _, ok := vAlignments[e.VAlign]; !ok {
+		return fmt.Errorf("invalid valign '%v'", e.VAlign)
+	}
+
+	for _, c := range []string{e.Color, e.Fill} {
+		if _, err := parseColor(c); err != nil {
+			return err
+		}
+	}
+
+	switch e.Type {
+	case elementText, elementKeys:
+		if e.W <= 0 {
+			return fmt.Errorf("width must be positive")
+		}
+	case elementBox, elementCode128:
+		if e.W <= 0 || e.H <= 0 {
+			return fmt.Errorf("width and height must be positive")
+		}
+	case elementQR:
+		if e.W <= 0 {
+			return fmt.Errorf("width must be positive")
+		}
+	case elementImage:
+		if e.W <= 0 && e.H <= 0 {
+			return fmt.Errorf("width or height must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown element type '%v'", e.Type)
+	}
+
+	return nil
+}
+
+// parseColor parses a "#rrggbb" color, the empty string is black.
+func parseColor(c string) (color.RGBA, error) {
+	if c == "" {
+		return color.RGBA{A: 0xFF}, nil
+	}
+
+	v, err := strconv.ParseUint(strings.TrimPrefix(c, "#"), 16, 32)
+	if err != nil || len(c) != 7 || c[0] != '#' {
+		return color.RGBA{}, fmt.Errorf("invalid color '%v', expected '#rrggbb'", c)
+	}
+
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xFF}, nil
+}
+
+// expand replaces the `{{key}}` placeholders by the banner-data, unknown keys
+// are replaced by the empty string.
+func expand(s string, data bannerData) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+
+	return fasttemplate.ExecuteFuncString(s, "{{", "}}", func(w io.Writer, tag string) (int, error) {
+		v, _ := data.Load(strings.TrimSpace(tag))
+		return w.Write([]byte(v))
+	})
+}
+
+// render draws the elements of the layout onto a single page, and returns the
+// content that does not fit.
+func (l *layout) render(log zerolog.Logger, out io.Writer, data bannerData) ([]bannerOverflow, error) {
+	orientation := "P"
+	if (l.Landscape == nil && pdfInLandscape) || (l.Landscape != nil && *l.Landscape) {
+		orientation = "L"
+	}
+
+	size := pdfSize
+	if l.Size != "" {
+		size = l.Size
+	}
+
+	pdf := gofpdf.New(orientation, pdfUnit, size, pdfFontDir)
+	pdf.SetAutoPageBreak(false, 0)
+	for _, f := range l.Fonts {
+		pdf.AddUTF8Font(f.Family, f.Style, f.File)
+	}
+
+	pdf.AddPage()
+	width, height := pdf.GetPageSize()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	var overflow []bannerOverflow
+	for k, e := range l.Elements {
+		if e.X < 0 || e.Y < 0 || e.X+e.W > width || e.Y+e.H > height {
+			overflow = append(overflow, bannerOverflow{Element: k + 1, Reason: "element exceeds the page"})
+		}
+
+		family := e.Font
+		if family == "" {
+			family = l.DefaultFont
+		}
+
+		if family == "" {
+			family = font
+		}
+
+		size := e.Size
+		if size <= 0 {
+			size = fontSize
+		}
+
+		translate := tr
+		if l.utf8Fonts[strings.ToLower(family)] {
+			translate = func(s string) string { return s }
+		}
+
+		pdf.SetFont(family, e.Style, size)
+		c, _ := parseColor(e.Color)
+		pdf.SetTextColor(int(c.R), int(c.G), int(c.B))
+		pdf.SetDrawColor(int(c.R), int(c.G), int(c.B))
+		pdf.SetFillColor(int(c.R), int(c.G), int(c.B))
+
+		value := expand(e.Value, data)
+		switch e.Type {
+		case elementBox:
+			e.drawBox(pdf)
+		case elementText:
+			e.drawBox(pdf)
+			if reason := e.drawText(pdf, translate(value)); reason != "" {
+				overflow = append(overflow, bannerOverflow{Element: k + 1, Text: value, Reason: reason})
+			}
+		case elementKeys:
+			e.drawBox(pdf)
+			for _, key := range e.drawKeys(pdf, translate, data) {
+				overflow = append(overflow, bannerOverflow{Element: k + 1, Key: key, Reason: "key exceeds the element"})
+			}
+		case elementImage:
+			e.drawImage(log, pdf, value)
+		case elementQR, elementCode128:
+			e.drawBarcode(log, pdf, value)
+		}
+	}
+
+	return overflow, pdf.Output(out)
+}
+
+// drawBox draws the background and border of the element, if any.
+func (e layoutElement) drawBox(pdf *gofpdf.Fpdf) {
+	style := ""
+	if e.Fill != "" {
+		c, _ := parseColor(e.Fill)
+		pdf.SetFillColor(int(c.R), int(c.G), int(c.B))
+		style += "F"
+	}
+
+	if e.Border > 0 {
+		pdf.SetLineWidth(e.Border)
+		style += "D"
+	}
+
+	if style != "" && e.H > 0 {
+		pdf.Rect(e.X, e.Y, e.W, e.H, style)
+	}
+}
+
+// drawText writes the text within the box of the element. Text that does not
+// fit is either shrunk, or wrapped. The reason is returned when the text still
+// does not fit.
+func (e layoutElement) drawText(pdf *gofpdf.Fpdf, text string) (overflow string) {
+	if text == "" {
+		return ""
+	}
+
+	available := e.W - 2*pdf.GetCellMargin()
+	if e.Fit {
+		size, _ := pdf.GetFontSize()
+		for size > minFitSize && pdf.GetStringWidth(text) > available {
+			size = max(minFitSize, size-0.5)
+			pdf.SetFontSize(size)
+		}
+	}
+
+	_, lineHeight := pdf.GetFontSize()
+	lineHeight *= 1.2
+	pdf.SetXY(e.X, e.Y)
+	if e.Wrap {
+		if e.H > 0 && float64(len(pdf.SplitText(text, e.W)))*lineHeight > e.H {
+			overflow = "wrapped text exceeds the height of the element"
+		}
+
+		pdf.MultiCell(e.W, lineHeight, text, "", alignments[e.Align], false)
+		return overflow
+	}
+
+	if pdf.GetStringWidth(text) > available {
+		overflow = "text exceeds the width of the element"
+	}
+
+	h := e.H
+	if h <= 0 {
+		h = lineHeight
+	}
+
+	pdf.CellFormat(e.W, h, text, "", 0, alignments[e.Align]+vAlignments[e.VAlign], false, 0, "")
+	return overflow
+}
+
+// drawKeys lists the banner-data as "key: value" lines, like the default
+// banner. The keys whose line exceeds the element, or the page when the
+// element has no height, are returned.
+func (e layoutElement) drawKeys(pdf *gofpdf.Fpdf, translate func(string) string, data bannerData) (overflow []string) {
+	keys := e.Keys
+	if len(keys) == 0 || (len(keys) == 1 && keys[0] == "*") {
+		keys = sortedKeys(data)
+	}
+
+	bottom := e.Y + e.H
+	if e.H <= 0 {
+		_, bottom = pdf.GetPageSize()
+	}
+
+	_, lineHeight := pdf.GetFontSize()
+	lineHeight *= 1.2
+	available := e.W - 2*pdf.GetCellMargin()
+	pdf.SetXY(e.X, e.Y)
+	for _, k := range keys {
+		if v, ok := data.Load(k); ok && !strings.HasPrefix(k, "img") {
+			line := translate(fmt.Sprintf("%v: %v", k, v))
+			if pdf.GetY()+lineHeight > bottom || pdf.GetStringWidth(line) > available {
+				overflow = append(overflow, k)
+			}
+
+			pdf.SetX(e.X)
+			pdf.CellFormat(e.W, lineHeight, line, "", 2, alignments[e.Align], false, 0, "")
+		}
+	}
+
+	return overflow
+}
+
+// drawImage places the image at the location, images that cannot be found are
+// skipped. When only the width or the height is given, the aspect ratio is
+// kept.
+func (e layoutElement) drawImage(log zerolog.Logger, pdf *gofpdf.Fpdf, location string) {
+	if location == "" {
+		return
+	}
+
+	if _, err := os.Stat(location); err != nil {
+		log.Err(err).Str("image", location).Msg("cannot open image")
+		return
+	}
+
+	mime := strings.TrimPrefix(strings.ToLower(filepath.Ext(location)), ".")
+	pdf.ImageOptions(location, e.X, e.Y, e.W, e.H, false, gofpdf.ImageOptions{ImageType: mime, ReadDpi: true}, 0, "")
+}
+
+// drawBarcode draws the value as a QR-code, or Code 128 barcode. The modules
+// are drawn as rectangles, keeping them sharp regardless of the printer.
+func (e layoutElement) drawBarcode(log zerolog.Logger, pdf *gofpdf.Fpdf, value string) {
+	if value == "" {
+		return
+	}
+
+	var code barcode.Barcode
+	var err error
+	w, h := e.W, e.H
+	if e.Type == elementQR {
+		code, err = qr.Encode(value, qr.M, qr.Auto)
+		h = w
+	} else {
+		code, err = code128.Encode(value)
+	}
+
+	if err != nil {
+		log.Err(err).Str("value", value).Str("type", e.Type).Msg("cannot encode barcode")
+		return
+	}
+
+	b := code.Bounds()
+	mw, mh := w/float64(b.Dx()), h/float64(b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; {
+			if !isDark(code.At(x, y)) {
+				x++
+				continue
+			}
+
+			start := x
+			for x < b.Max.X && isDark(code.At(x, y)) {
+				x++
+			}
+
+			pdf.Rect(e.X+float64(start-b.Min.X)*mw, e.Y+float64(y-b.Min.Y)*mh, float64(x-start)*mw, mh, "F")
+		}
+	}
+}
+
+func isDark(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r+g+b < 3*0x8000
+}
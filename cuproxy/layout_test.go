@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadLayout(t *testing.T) {
+	l, err := loadLayout("testdata/banner.yaml")
+	require.NoError(t, err)
+	require.Len(t, l.Elements, 6)
+	assert.Equal(t, "{{team_name}}", l.Elements[1].Value)
+
+	l, err = loadLayout("")
+	assert.NoError(t, err)
+	assert.Nil(t, l, "the default banner is used without a template")
+
+	_, err = loadLayout("testdata/missing.yaml")
+	assert.Error(t, err)
+
+	for name, template := range map[string]string{
+		"empty":         ``,
+		"unknown field": `elements: [{type: text, w: 10, colour: "#000000"}]`,
+		"unknown type":  `elements: [{type: circle, w: 10}]`,
+		"no width":      `elements: [{type: text, value: foo}]`,
+		"align":         `elements: [{type: text, w: 10, align: justify}]`,
+		"color":         `elements: [{type: box, w: 10, h: 10, fill: red}]`,
+		"font":          `{fonts: [{family: Missing, file: missing.ttf}], elements: [{type: text, w: 10, font: Missing}]}`,
+		"json":          `{"elements": [{"type": "qr"}]}`,
+	} {
+		_, err = parseLayout([]byte(template))
+		assert.Error(t, err, name)
+	}
+
+	_, err = parseLayout([]byte(`{"elements": [{"type": "qr", "w": 20, "value": "{{team_id}}"}]}`))
+	assert.NoError(t, err, "JSON templates are supported as well")
+}
+
+func TestExpand(t *testing.T) {
+	data := kvs{"team_name": "Segmentation Fault", "seat": "12"}
+	assert.Equal(t, "Segmentation Fault", expand("{{team_name}}", data))
+	assert.Equal(t, "seat 12 in ", expand("seat {{ seat }} in {{room}}", data))
+	assert.Equal(t, "no placeholders", expand("no placeholders", data))
+}
+
+func TestRenderLayout(t *testing.T) {
+	l, err := loadLayout("testdata/banner.yaml")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	data := kvs{"team_name": "A team name that is far too long to fit the banner", "location": "Hall B", "seat": "12", "team_id": "42"}
+	overflow, err := l.render(zlog.Logger, &out, data)
+	require.NoError(t, err)
+	assert.Empty(t, overflow, "the team name is shrunk to fit")
+
+	pages, err := pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pages)
+
+	// The template replaces the default banner
+	bannerTemplate = l
+	t.Cleanup(func() { bannerTemplate = nil })
+	var banner bytes.Buffer
+	require.NoError(t, BannerPage(zlog.Logger, &banner, data, printKeys...))
+	assert.Equal(t, out.Len(), banner.Len())
+}
+
+func TestLayoutOverflow(t *testing.T) {
+	l, err := parseLayout([]byte(`
+elements:
+  - {type: text, x: 10, y: 10, w: 20, value: "{{team_name}}"}
+  - {type: text, x: 10, y: 20, w: 20, h: 10, value: "{{team_name}}", wrap: true}
+  - {type: text, x: 10, y: 40, w: 60, value: "{{team_name}}", fit: true}
+  - {type: keys, x: 10, y: 60, w: 100, h: 6, keys: [room, seat]}
+  - {type: box, x: 200, y: 10, w: 20, h: 10}
+`))
+	require.NoError(t, err)
+
+	data := kvs{"team_name": "Segmentation Fault and Friends of the Core Dump", "room": "A", "seat": "12"}
+	overflow, err := l.render(zlog.Logger, io.Discard, data)
+	require.NoError(t, err)
+	assert.Equal(t, []bannerOverflow{
+		{Element: 1, Text: data["team_name"], Reason: "text exceeds the width of the element"},
+		{Element: 2, Text: data["team_name"], Reason: "wrapped text exceeds the height of the element"},
+		{Element: 4, Key: "seat", Reason: "key exceeds the element"},
+		{Element: 5, Reason: "element exceeds the page"},
+	}, overflow)
+}
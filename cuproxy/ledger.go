@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+
+	"github.com/tuupke/pixie/crud"
+	"github.com/tuupke/pixie/env"
+	"github.com/tuupke/pixie/lifecycle"
+)
+
+const (
+	JobForwarded = "forwarded"
+	JobFailed    = "failed"
+	JobHeld      = "held"
+	JobRejected  = "rejected"
+	JobDiscarded = "discarded"
+)
+
+type (
+	kvs map[string]string
+
+	// Job is a single print job as recorded in the ledger.
+	Job struct {
+		ID             uint       `gorm:"primaryKey" json:"id"`
+		SeqID          uint64     `gorm:"index" json:"seq_id"`
+		JobID          int32      `gorm:"index" json:"job_id"`
+		UpstreamJobID  int32      `json:"upstream_job_id,omitempty"`
+		Operation      string     `json:"operation"`
+		RequestingIP   string     `gorm:"index" json:"requesting_ip"`
+		Identity       string     `gorm:"index" json:"identity"`
+		User           string     `json:"user"`
+		JobName        string     `json:"job_name"`
+		Props          kvs        `json:"props"`
+		Pages          int        `json:"pages"`
+		Copies         int        `json:"copies"`
+		Impressions    int        `json:"impressions"`
+		OriginalSize   int64      `json:"original_size"`
+		ConvertedSize  int64      `json:"converted_size"`
+		BannerHash     string     `json:"banner_hash"`
+		Printer        string     `gorm:"index" json:"printer"`
+		UpstreamStatus int        `json:"upstream_status"`
+		IppStatus      string     `json:"ipp_status"`
+		Status         string     `gorm:"index" json:"status"`
+		Reason         string     `json:"reason,omitempty"`
+		Flagged        bool       `gorm:"index" json:"flagged,omitempty"`
+		CreatedAt      time.Time  `gorm:"index" json:"created_at"`
+		UpdatedAt      time.Time  `json:"updated_at"`
+		ForwardedAt    *time.Time `json:"forwarded_at"`
+		ReleasedAt     *time.Time `json:"released_at,omitempty"`
+		DeliveredAt    *time.Time `gorm:"index" json:"delivered_at,omitempty"`
+	}
+)
+
+var (
+	ledgerDsn = env.StringFb("LEDGER_DSN", pdfLocation+"/ledger.sqlite")
+	ledger    *gorm.DB
+
+	_ sql.Scanner   = (*kvs)(nil)
+	_ driver.Valuer = kvs(nil)
+)
+
+func (k *kvs) Scan(val any) error {
+	if val == nil {
+		*k = make(kvs)
+		return nil
+	}
+
+	var ba []byte
+	switch v := val.(type) {
+	case []byte:
+		ba = v
+	case string:
+		ba = []byte(v)
+	default:
+		return fmt.Errorf("failed to unmarshal JSON value: %v", val)
+	}
+
+	return json.Unmarshal(ba, k)
+}
+
+func (k kvs) Value() (driver.Value, error) {
+	if k == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(k)
+	return string(b), err
+}
+
+// Load implements bannerData, allowing the printer of a recorded job to be
+// selected using its data.
+func (k kvs) Load(key string) (string, bool) {
+	v, ok := k[key]
+	return v, ok
+}
+
+func (k kvs) Range(f func(key, value string) bool) {
+	for key, v := range k {
+		if !f(key, v) {
+			return
+		}
+	}
+}
+
+// GormDataType gorm common data type
+func (kvs) GormDataType() string {
+	return "json"
+}
+
+// GormDBDataType gorm db data type
+func (kvs) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return "JSON"
+}
+
+// openLedger opens, and migrates, the ledger. The sequence-id is continued from
+// the last recorded job, ensuring it is unique across restarts.
+func openLedger(log zerolog.Logger) error {
+	db, err := sql.Open("sqlite", ledgerDsn)
+	if err != nil {
+		return fmt.Errorf("cannot open ledger '%v'; %w", ledgerDsn, err)
+	}
+
+	lifecycle.EFinally(db.Close)
+	orm, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return fmt.Errorf("cannot load ledger; %w", err)
+	}
+
+	if err = orm.AutoMigrate(&Job{}); err != nil {
+		return fmt.Errorf("cannot migrate ledger; %w", err)
+	}
+
+	var lastSeq sql.NullInt64
+	err = orm.Model(&Job{}).Select("MAX(seq_id)").Scan(&lastSeq).Error
+	if lastSeq.Valid {
+		atomic.StoreUint64(seqId, uint64(lastSeq.Int64))
+	}
+
+	log.Info().Err(err).Str("dsn", ledgerDsn).Int64("last_seq_id", lastSeq.Int64).Msg("opened ledger")
+	ledger = orm
+	return err
+}
+
+// recordJob stores, or updates, the job in the ledger. Failing to record a job
+// never fails the print itself.
+func recordJob(log zerolog.Logger, job *Job) {
+	if ledger == nil || job == nil {
+		return
+	}
+
+	err := ledger.Save(job).Error
+	log.Err(err).Uint("ledger-id", job.ID).Str("status", job.Status).Msg("recorded job")
+}
+
+// hashReader returns the hex encoded sha256 of everything read from r.
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listJobs lists the recorded jobs, newest first. Jobs can be filtered using
+// the query string, the parameters `ip`, `identity`, `job_id`, `seq_id`,
+// `status`, `delivered`, `flagged`, `since`, `until`, and `limit` are handled
+// separately.
+// All other parameters filter on the Props snapshot, e.g. `?team_id=42`.
+func listJobs(ctx *fasthttp.RequestCtx) {
+	limit := 100
+	q := ledger.Model(&Job{}).Order("id DESC")
+
+	var err error
+	ctx.QueryArgs().VisitAll(func(key, value []byte) {
+		if err != nil {
+			return
+		}
+
+		v := string(value)
+		switch k := string(key); k {
+		case "ip":
+			q = q.Where("requesting_ip = ?", v)
+		case "identity":
+			q = q.Where("identity = ?", v)
+		case "job_id":
+			q = q.Where("job_id = ?", v)
+		case "seq_id":
+			q = q.Where("seq_id = ?", v)
+		case "status":
+			q = q.Where("status = ?", v)
+		case "delivered":
+			var delivered bool
+			if delivered, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("cannot parse delivered; %w", err)
+			} else if delivered {
+				q = q.Where("delivered_at IS NOT NULL")
+			} else {
+				q = q.Where("delivered_at IS NULL")
+			}
+		case "flagged":
+			var flagged bool
+			if flagged, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("cannot parse flagged; %w", err)
+			} else {
+				q = q.Where("flagged = ?", flagged)
+			}
+		case "since", "until":
+			var t time.Time
+			if t, err = time.Parse(time.RFC3339, v); err != nil {
+				err = fmt.Errorf("cannot parse '%v' as RFC3339; %w", k, err)
+				return
+			}
+
+			op := ">="
+			if k == "until" {
+				op = "<"
+			}
+
+			q = q.Where("created_at "+op+" ?", t)
+		case "limit":
+			if limit, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("cannot parse limit; %w", err)
+			}
+		default:
+			q = q.Where("json_extract(props, ?) = ?", `$."`+strings.ReplaceAll(k, `"`, `\"`)+`"`, v)
+		}
+	})
+
+	crud.HandleError(ctx, http.StatusBadRequest, err)
+
+	var jobs []Job
+	crud.HandleError(ctx, http.StatusInternalServerError, q.Limit(limit).Find(&jobs).Error)
+	crud.Respond(ctx, jobs)
+}
+
+// getJob retrieves a single job by its ledger id.
+func getJob(ctx *fasthttp.RequestCtx) {
+	var job Job
+	err := ledger.First(&job, "id = ?", ctx.UserValue("id")).Error
+	status := http.StatusInternalServerError
+	if err == gorm.ErrRecordNotFound {
+		status = http.StatusNotFound
+	}
+
+	crud.HandleError(ctx, status, err)
+	crud.Respond(ctx, job)
+}
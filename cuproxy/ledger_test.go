@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func testLedger(t *testing.T) {
+	t.Helper()
+	ledgerDsn = t.TempDir() + "/ledger.sqlite"
+	require.NoError(t, openLedger(zlog.Logger))
+	t.Cleanup(func() { ledger = nil })
+}
+
+func queryJobs(t *testing.T, query string) (jobs []Job) {
+	t.Helper()
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/jobs?" + query)
+	listJobs(ctx)
+
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &jobs))
+	return
+}
+
+func TestLedger(t *testing.T) {
+	testLedger(t)
+
+	recordJob(zlog.Logger, &Job{SeqID: 4, JobID: 12, RequestingIP: "10.0.0.1", Props: kvs{"team_id": "42"}, Pages: 3, Status: JobForwarded})
+	recordJob(zlog.Logger, &Job{SeqID: 7, JobID: 13, RequestingIP: "10.0.0.2", Props: kvs{"team_id": "43"}, Pages: 1, Status: JobFailed})
+	recordJob(zlog.Logger, &Job{SeqID: 5, JobID: 14, RequestingIP: "10.0.0.1", Status: JobForwarded, Flagged: true, Reason: "document only contains images"})
+
+	all := queryJobs(t, "")
+	require.Len(t, all, 3)
+	assert.EqualValues(t, 14, all[0].JobID, "newest job must be listed first")
+
+	team := queryJobs(t, "team_id=42")
+	require.Len(t, team, 1)
+	assert.Equal(t, "10.0.0.1", team[0].RequestingIP)
+	assert.Equal(t, kvs{"team_id": "42"}, team[0].Props)
+
+	assert.Len(t, queryJobs(t, "status=failed&ip=10.0.0.2"), 1)
+	assert.Len(t, queryJobs(t, "status=failed&ip=10.0.0.1"), 0)
+	assert.Len(t, queryJobs(t, "limit=1"), 1)
+
+	flagged := queryJobs(t, "flagged=true")
+	require.Len(t, flagged, 1)
+	assert.Equal(t, "document only contains images", flagged[0].Reason)
+	assert.Len(t, queryJobs(t, "flagged=false"), 2)
+
+	// The sequence-id continues where the ledger left off
+	atomic.StoreUint64(seqId, 0)
+	require.NoError(t, openLedger(zlog.Logger))
+	assert.EqualValues(t, 7, atomic.LoadUint64(seqId))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+
+	"github.com/tuupke/pixie/env"
+	"github.com/tuupke/pixie/lifecycle"
+)
+
+const metricsNamespace = "cuproxy"
+
+var (
+	metricsListen = env.String("METRICS_LISTEN")
+	metricsPath   = env.StringFb("METRICS_PATH", "/metrics")
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests received from clients, including those that are not IPP.",
+	}, func() float64 { return float64(atomic.LoadUint64(numPrints)) })
+
+	operationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ipp_operations_total",
+		Help:      "IPP requests received from clients, by operation-id.",
+	}, []string{"operation"})
+
+	receivedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "received_bytes_total",
+		Help:      "Bytes received from clients.",
+	})
+
+	forwardedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forwarded_bytes_total",
+		Help:      "Bytes forwarded to the printers, including banners.",
+	})
+
+	conversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Duration of converting documents to PDF, by converter.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"converter"})
+
+	mergeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "merge_duration_seconds",
+		Help:      "Duration of merging banners with documents.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+
+	webhookDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_duration_seconds",
+		Help:      "Latency of webhook calls, by webhook name.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"webhook"})
+
+	webhookResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_responses_total",
+		Help:      "Webhook calls, by webhook name and status.",
+	}, []string{"webhook", "status"})
+
+	bannersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "banners_total",
+		Help:      "Banners, by whether they were reused from the cache, rendered ahead of the job, or rendered containing job specific data.",
+	}, []string{"source"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_promises",
+		Help:      "Jobs created using Create-Job of which the banner-data is retained.",
+	}, func() float64 { return float64(requestPromises.Size()) })
+
+	upstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_responses_total",
+		Help:      "Responses of the printers, by printer and HTTP status code.",
+	}, []string{"printer", "status"})
+)
+
+// countingReader counts the bytes read from the reader.
+type countingReader struct {
+	io.Reader
+	counter prometheus.Counter
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+// observeWebhook records the latency and status of a single webhook call.
+// Successful calls are recorded as "2xx", as the exact status is not kept.
+func observeWebhook(name string, took time.Duration, loaded bool, err error) {
+	var status statusError
+	label := "2xx"
+	switch {
+	case errors.As(err, &status):
+		label = strconv.Itoa(status.code)
+	case errors.Is(err, errBreakerOpen):
+		webhookResponses.WithLabelValues(name, "breaker_open").Inc()
+		return
+	case err != nil:
+		label = "error"
+	case !loaded:
+		label = "304"
+	}
+
+	webhookDuration.WithLabelValues(name).Observe(took.Seconds())
+	webhookResponses.WithLabelValues(name, label).Inc()
+}
+
+// serveMetrics starts the metrics listener, when configured.
+func serveMetrics() {
+	if metricsListen == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", metricsListen)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("listen", metricsListen).Msg("metrics listener cannot be started")
+	}
+
+	lifecycle.EFinally(ln.Close)
+	go fasthttp.Serve(ln, metricsHandler())
+	zlog.Info().Str("listen", metricsListen).Str("path", metricsPath).Msg("started metrics listener")
+}
+
+// metricsHandler exposes the metrics on METRICS_PATH.
+func metricsHandler() fasthttp.RequestHandler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	return func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != metricsPath {
+			ctx.NotFound()
+			return
+		}
+
+		handler(ctx)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestObserveWebhook(t *testing.T) {
+	for _, status := range []string{"2xx", "304", "502", "error", "breaker_open"} {
+		webhookResponses.DeleteLabelValues("metrics", status)
+	}
+
+	observeWebhook("metrics", 0, true, nil)
+	observeWebhook("metrics", 0, false, nil)
+	observeWebhook("metrics", 0, false, fmt.Errorf("wrapped; %w", statusError{code: http.StatusBadGateway}))
+	observeWebhook("metrics", 0, false, io.ErrUnexpectedEOF)
+	observeWebhook("metrics", 0, false, errBreakerOpen)
+	observeWebhook("metrics", 0, false, errBreakerOpen)
+
+	for status, count := range map[string]float64{"2xx": 1, "304": 1, "502": 1, "error": 1, "breaker_open": 2} {
+		assert.Equal(t, count, testutil.ToFloat64(webhookResponses.WithLabelValues("metrics", status)), status)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	before := testutil.ToFloat64(receivedBytes)
+	n, err := io.Copy(io.Discard, countingReader{strings.NewReader("12345"), receivedBytes})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, n)
+	assert.Equal(t, before+5, testutil.ToFloat64(receivedBytes))
+
+	requestPromises.Store(-17, promiseInteraction{})
+	t.Cleanup(func() { requestPromises.Delete(-17) })
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/metrics")
+	metricsHandler()(ctx)
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "cuproxy_received_bytes_total")
+	assert.Regexp(t, `(?m)^cuproxy_request_promises [1-9]`, string(ctx.Response.Body()))
+
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/other")
+	metricsHandler()(ctx)
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+}
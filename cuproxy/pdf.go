@@ -28,6 +28,54 @@ var (
 	imgDpi = float64(env.IntFb("IMAGE_PPI", 120))
 )
 
+type (
+	// bannerData is the data that can be printed on a banner.
+	bannerData interface {
+		Load(key string) (string, bool)
+		Range(f func(key, value string) bool)
+	}
+
+	// overlay adds job specific data, such as the remaining quota, to the
+	// banner-data. The extra values take precedence.
+	overlay struct {
+		bannerData
+		extra map[string]string
+	}
+
+	// bannerOverflow is content which does not fit the banner page, or the
+	// element of the banner template, and is therefore cut off.
+	bannerOverflow struct {
+		Key     string `json:"key,omitempty"`
+		Element int    `json:"element,omitempty"`
+		Text    string `json:"text,omitempty"`
+		Reason  string `json:"reason"`
+	}
+)
+
+func (o overlay) Load(key string) (string, bool) {
+	if v, ok := o.extra[key]; ok {
+		return v, true
+	}
+
+	return o.bannerData.Load(key)
+}
+
+func (o overlay) Range(f func(key, value string) bool) {
+	for k, v := range o.extra {
+		if !f(k, v) {
+			return
+		}
+	}
+
+	o.bannerData.Range(func(key, value string) bool {
+		if _, ok := o.extra[key]; ok {
+			return true
+		}
+
+		return f(key, value)
+	})
+}
+
 // pointsToUnits converts a fontsize in points to the unit stored in pdfUnit.
 func pointsToUnits(points float64) float64 {
 	switch pdfUnit {
@@ -44,15 +92,41 @@ func pointsToUnits(points float64) float64 {
 	panic("Unknown pdf unit: " + pdfUnit)
 }
 
-func BannerPage(log zerolog.Logger, outWrite io.Writer, data *Props, keys ...string) error {
-	if len(keys) == 1 && keys[0] == "*" {
-		keys = make([]string, 0, 100)
-		data.Range(func(key, _ string) bool {
-			keys = append(keys, key)
-			return true
-		})
+// sortedKeys returns all keys of the banner-data, sorted.
+func sortedKeys(data bannerData) []string {
+	keys := make([]string, 0, 100)
+	data.Range(func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
 
-		slices.Sort(keys)
+	slices.Sort(keys)
+	return keys
+}
+
+// BannerPage renders the banner using the banner template, when configured.
+// Otherwise, the keys are listed as "key: value" lines, and images of keys
+// starting with "img" are placed below each other. Content that does not fit
+// is logged.
+func BannerPage(log zerolog.Logger, outWrite io.Writer, data bannerData, keys ...string) error {
+	overflow, err := renderBanner(log, outWrite, data, keys...)
+	for _, o := range overflow {
+		log.Warn().Str("key", o.Key).Int("element", o.Element).Str("text", o.Text).Str("reason", o.Reason).Msg("banner content is cut off")
+	}
+
+	return err
+}
+
+// renderBanner renders the banner like BannerPage, and returns the content that
+// does not fit.
+func renderBanner(log zerolog.Logger, outWrite io.Writer, data bannerData, keys ...string) ([]bannerOverflow, error) {
+	if bannerTemplate != nil {
+		log.Info().Str("template", bannerTemplateFile).Msg("rendering new banner")
+		return bannerTemplate.render(log, outWrite, data)
+	}
+
+	if len(keys) == 1 && keys[0] == "*" {
+		keys = sortedKeys(data)
 	}
 
 	orientation := "P"
@@ -63,15 +137,26 @@ func BannerPage(log zerolog.Logger, outWrite io.Writer, data *Props, keys ...str
 	log.Info().Bool("landscape", pdfInLandscape).Int("num_keys", len(keys)).Msg("rendering new banner")
 
 	pdf := gofpdf.New(orientation, pdfUnit, pdfSize, pdfFontDir)
-	if bannerOnBack {
-		// Add an empty page if the banner is supposed to be printed on the back. Assumes a duplexer is installed.
-		pdf.AddPage()
-	}
-
+	pdf.SetAutoPageBreak(false, 0)
 	pdf.AddPage()
+	drawDeliveryCodes(log, pdf, data)
 	pdf.SetFont(font, "", fontSize)
 
+	// The top and left margins are used for the bottom and right as well
+	width, height := pdf.GetPageSize()
+	right, bottom := width-pdfLeftMargin, height-pdfTopMargin
+
 	yTop := pdfTopMargin
+	var overflow []bannerOverflow
+	fits := func(key string, w, h float64) {
+		switch {
+		case yTop+h > bottom:
+			overflow = append(overflow, bannerOverflow{Key: key, Reason: "beyond the bottom margin"})
+		case pdfLeftMargin+w > right:
+			overflow = append(overflow, bannerOverflow{Key: key, Reason: "beyond the right margin"})
+		}
+	}
+
 	for _, k := range keys {
 		val, ok := data.Load(k)
 		if !ok {
@@ -95,21 +180,40 @@ func BannerPage(log zerolog.Logger, outWrite io.Writer, data *Props, keys ...str
 				ext = ext[1:]
 			}
 
-			mime := "image/" + ext
 			defer image.Close()
 
 			// Attempt to load the image
-			iopts := gofpdf.ImageOptions{ReadDpi: true, ImageType: mime}
+			iopts := gofpdf.ImageOptions{ReadDpi: true, ImageType: ext}
 			opts := pdf.RegisterImageOptionsReader(k, iopts, image)
 			opts.SetDpi(imgDpi)
-			pdf.ImageOptions(k, pdfLeftMargin, yTop, 0, 0, true, iopts, 0, "")
+			w, h := opts.Extent()
+			fits(k, w, h)
+			pdf.ImageOptions(k, pdfLeftMargin, yTop, w, h, false, iopts, 0, "")
 
-			yTop += opts.Height()
+			yTop += h
 		} else {
-			pdf.Text(pdfLeftMargin, yTop+pdfLineHeight, fmt.Sprintf("%v: %v", k, val))
+			line := fmt.Sprintf("%v: %v", k, val)
+			fits(k, pdf.GetStringWidth(line), pdfLineHeight)
+			pdf.Text(pdfLeftMargin, yTop+pdfLineHeight, line)
 			yTop += pdfLineHeight
 		}
 	}
 
-	return pdf.Output(outWrite)
+	return overflow, pdf.Output(outWrite)
+}
+
+// jobBanner renders a banner containing job specific data. Unlike the banners
+// rendered ahead of the job, these are not cached.
+func jobBanner(log zerolog.Logger, data bannerData, extra map[string]string) (*os.File, error) {
+	f, err := os.CreateTemp(spoolLocation, "cuproxy-banner-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create banner-file; %w", err)
+	}
+
+	bannersTotal.WithLabelValues("job").Inc()
+	if err = BannerPage(log, f, overlay{data, extra}, printKeys...); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	return f, err
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/rs/zerolog"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	policyReject = "reject"
+	policyHold   = "hold"
+	policyFlag   = "flag"
+)
+
+var (
+	policyAction      = env.StringFb("POLICY_ACTION", policyReject)
+	policyMaxPages    = env.IntFb("POLICY_MAX_PAGES", 0)
+	policyBlockedFile = env.String("POLICY_BLOCKED_TEXT")
+	policyImagesOnly  = env.Bool("POLICY_IMAGES_ONLY")
+	policyEncrypted   = env.Bool("POLICY_ENCRYPTED")
+	policyCommand     = env.String("POLICY_COMMAND")
+	policyTextCommand = env.String("POLICY_TEXT_COMMAND")
+
+	blockedText = mustBlockedText(policyBlockedFile)
+)
+
+// policyDocument is what the content policy knows about a document.
+type policyDocument struct {
+	pages     int
+	encrypted bool
+	images    int
+	text      string
+}
+
+func init() {
+	if policyAction != policyReject && policyAction != policyHold && policyAction != policyFlag {
+		panic(fmt.Errorf("invalid POLICY_ACTION '%v', expected '%v', '%v' or '%v'", policyAction, policyReject, policyHold, policyFlag))
+	}
+}
+
+// policyEnabled returns whether any rule of the content policy is configured.
+func policyEnabled() bool {
+	return policyMaxPages > 0 || len(blockedText) > 0 || policyImagesOnly || policyEncrypted || policyCommand != ""
+}
+
+// parseBlockedText parses the regular expressions, one per line. Empty lines,
+// and lines starting with `#`, are skipped.
+func parseBlockedText(r io.Reader) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern on line %v; %w", line, err)
+		}
+
+		patterns = append(patterns, re)
+	}
+
+	return patterns, scanner.Err()
+}
+
+func mustBlockedText(file string) []*regexp.Regexp {
+	if file == "" {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err == nil {
+		defer f.Close()
+
+		var patterns []*regexp.Regexp
+		if patterns, err = parseBlockedText(f); err == nil {
+			return patterns
+		}
+	}
+
+	panic(fmt.Errorf("invalid POLICY_BLOCKED_TEXT '%v'; %w", file, err))
+}
+
+// inspectDocument reads what the content policy needs from the pdf. The text
+// is only extracted when a rule needs it.
+func inspectDocument(log zerolog.Logger, document *io.SectionReader, pages int) (doc policyDocument, err error) {
+	doc.pages = pages
+	// The document is not validated, printers accept slightly malformed pdfs.
+	// Optimizing the document lists the images of the pages.
+	ctx, err := pdfcpuapi.ReadContext(io.NewSectionReader(document, 0, document.Size()), nil)
+	if err == nil {
+		err = pdfcpuapi.OptimizeContext(ctx)
+	}
+
+	if err != nil {
+		// Documents requiring a password to open cannot be inspected at all.
+		if errors.Is(err, pdfcpu.ErrWrongPassword) {
+			doc.encrypted = true
+			return doc, nil
+		}
+
+		return doc, fmt.Errorf("cannot read document; %w", err)
+	}
+
+	doc.encrypted = ctx.Encrypt != nil
+	if err = ctx.EnsurePageCount(); err != nil {
+		return doc, fmt.Errorf("cannot count pages; %w", err)
+	}
+
+	withText := len(blockedText) > 0 || policyImagesOnly
+	var text strings.Builder
+	for p := 1; p <= ctx.PageCount; p++ {
+		if policyImagesOnly {
+			images, err := pdfcpu.ExtractPageImages(ctx, p, false)
+			log.Err(err).Int("page", p).Int("images", len(images)).Msg("listed images")
+			doc.images += len(images)
+		}
+
+		if !withText || policyTextCommand != "" {
+			continue
+		}
+
+		r, err := pdfcpu.ExtractPageContent(ctx, p)
+		if err != nil || r == nil {
+			log.Err(err).Int("page", p).Msg("page has no content")
+			continue
+		}
+
+		content, err := io.ReadAll(r)
+		log.Err(err).Int("page", p).Int("size", len(content)).Msg("read page content")
+		text.WriteString(contentText(content))
+		text.WriteByte('\n')
+	}
+
+	doc.text = text.String()
+	if withText && policyTextCommand != "" {
+		doc.text, err = runPolicyCommand(policyTextCommand, document)
+	}
+
+	return doc, err
+}
+
+// violation returns why the document violates the content policy, or the
+// empty string when it does not. POLICY_COMMAND is consulted last.
+func (doc policyDocument) violation(log zerolog.Logger, document *io.SectionReader) string {
+	switch {
+	case policyEncrypted && doc.encrypted:
+		return "document is encrypted"
+	case policyMaxPages > 0 && doc.pages > policyMaxPages:
+		return fmt.Sprintf("document has %v pages, at most %v pages are allowed", doc.pages, policyMaxPages)
+	case policyImagesOnly && doc.images > 0 && strings.TrimSpace(doc.text) == "":
+		return "document only contains images"
+	}
+
+	for _, re := range blockedText {
+		if re.MatchString(doc.text) {
+			return fmt.Sprintf("document contains blocked text '%v'", re)
+		}
+	}
+
+	if policyCommand == "" {
+		return ""
+	}
+
+	out, err := runPolicyCommand(policyCommand, document)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		if out = strings.TrimSpace(out); out == "" {
+			out = "document is rejected by the content policy"
+		}
+
+		return out
+	}
+
+	log.Err(err).Str("command", policyCommand).Msg("checked document using policy command")
+	return ""
+}
+
+// runPolicyCommand runs the command with the document as stdin, and returns
+// its stdout.
+func runPolicyCommand(command string, document *io.SectionReader) (string, error) {
+	cmdRaw := strings.Fields(command)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(cmdRaw[0], cmdRaw[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = io.NewSectionReader(document, 0, document.Size()), &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("cannot run '%v' (%v); %w", cmdRaw[0], strings.TrimSpace(stderr.String()), err)
+	}
+
+	return stdout.String(), nil
+}
+
+// contentText extracts the strings shown by the text operators of a content
+// stream. Fonts are not decoded, text using fonts without a standard encoding
+// is unreadable; POLICY_TEXT_COMMAND extracts the text of these instead.
+func contentText(content []byte) string {
+	var text strings.Builder
+	inArray := false
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '(':
+			s, end := literalString(content, i)
+			text.WriteString(s)
+			i = end
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			i++
+		case c == '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return text.String()
+			}
+
+			digits := strings.Join(strings.Fields(string(content[i+1:i+end])), "")
+			if len(digits)%2 == 1 {
+				digits += "0"
+			}
+
+			decoded, _ := hex.DecodeString(digits)
+			text.Write(decoded)
+			i += end
+		case c == '/' || c == '%':
+			// Skip names and comments.
+			for i+1 < len(content) && !isDelimiter(content[i+1], c == '%') {
+				i++
+			}
+		case c == '[':
+			inArray = true
+		case c == ']':
+			inArray = false
+		case inArray && (c == '-' || c == '.' || (c >= '0' && c <= '9')):
+			start := i
+			for i+1 < len(content) && (content[i+1] == '.' || (content[i+1] >= '0' && content[i+1] <= '9')) {
+				i++
+			}
+
+			// Large negative kerning in TJ arrays separates words.
+			if n, err := strconv.ParseFloat(string(content[start:i+1]), 64); err == nil && n < -200 {
+				text.WriteByte(' ')
+			}
+		case c == '\'' || c == '"':
+			text.WriteByte('\n')
+		case (c == 'T' || c == 'E') && i+1 < len(content) && i > 0 && isDelimiter(content[i-1], false):
+			if next := content[i+1]; (c == 'T' && (next == '*' || next == 'd' || next == 'D')) || (c == 'E' && next == 'T') {
+				text.WriteByte('\n')
+			}
+		}
+	}
+
+	return text.String()
+}
+
+// isDelimiter returns whether c ends a name, or the line of a comment.
+func isDelimiter(c byte, comment bool) bool {
+	if comment {
+		return c == '\n' || c == '\r'
+	}
+
+	return strings.IndexByte(" \t\r\n\f()<>[]{}/%", c) >= 0
+}
+
+// literalString decodes the literal string starting at the opening
+// parenthesis, and returns the index of the closing parenthesis.
+func literalString(content []byte, start int) (string, int) {
+	var s strings.Builder
+	depth := 0
+	for i := start; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '(':
+			if depth++; depth == 1 {
+				continue
+			}
+		case c == ')':
+			if depth--; depth == 0 {
+				return s.String(), i
+			}
+		case c == '\\' && i+1 < len(content):
+			i++
+			switch e := content[i]; e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\n', '\r':
+				continue
+			default:
+				if e < '0' || e > '7' {
+					c = e
+					break
+				}
+
+				end := i
+				for end < len(content) && end < i+3 && content[end] >= '0' && content[end] <= '7' {
+					end++
+				}
+
+				v, _ := strconv.ParseUint(string(content[i:end]), 8, 8)
+				c, i = byte(v), end-1
+			}
+		}
+
+		s.WriteByte(c)
+	}
+
+	return s.String(), len(content) - 1
+}
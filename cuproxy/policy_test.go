@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jung-kurt/gofpdf"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// policyPDF renders a single page, containing the text and image when given.
+func policyPDF(t *testing.T, text, img string, protect bool) *io.SectionReader {
+	t.Helper()
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	if protect {
+		pdf.SetProtection(gofpdf.CnProtectPrint, "", "owner")
+	}
+
+	pdf.AddPage()
+	if text != "" {
+		pdf.SetFont("Courier", "", 10)
+		pdf.MultiCell(0, 5, text, "", "L", false)
+	}
+
+	if img != "" {
+		pdf.ImageOptions(img, 10, 10, 50, 0, false, gofpdf.ImageOptions{ImageType: "png"}, 0, "")
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pdf.Output(&buf))
+	return io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+}
+
+func TestParseBlockedText(t *testing.T) {
+	patterns, err := parseBlockedText(strings.NewReader("# problem statements\n\n(?i)the jury has prepared\nInput Specification\n"))
+	require.NoError(t, err)
+	require.Len(t, patterns, 2)
+	assert.True(t, patterns[0].MatchString("The Jury has prepared a test"))
+
+	_, err = parseBlockedText(strings.NewReader("valid\n(unclosed"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestContentText(t *testing.T) {
+	content := `BT /F1 10 Tf 10 10 Td (int main\(\) {) Tj T* (\treturn 0;\040}) Tj ET
+BT [(Hello) -300 (W) 20 (orld)] TJ <4a7572> Tj ET % (comment)
+<< /Type /XObject >>`
+	assert.Equal(t, "\nint main() {\n\treturn 0; }\nHello WorldJur\n", contentText([]byte(content)))
+}
+
+func TestContentPolicy(t *testing.T) {
+	oldAction, oldMax, oldBlocked, oldImages, oldEncrypted, oldCommand := policyAction, policyMaxPages, blockedText, policyImagesOnly, policyEncrypted, policyCommand
+	t.Cleanup(func() {
+		policyAction, policyMaxPages, blockedText, policyImagesOnly, policyEncrypted, policyCommand = oldAction, oldMax, oldBlocked, oldImages, oldEncrypted, oldCommand
+	})
+
+	policyMaxPages, blockedText, policyImagesOnly, policyEncrypted, policyCommand = 0, nil, false, false, ""
+	assert.False(t, policyEnabled())
+
+	logo := filepath.Join(t.TempDir(), "scan.png")
+	f, err := os.Create(logo)
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewGray(image.Rect(0, 0, 120, 60))))
+	require.NoError(t, f.Close())
+
+	source := policyPDF(t, "#include <stdio.h>\nint main() { return 0; }", "", false)
+	scan := policyPDF(t, "", logo, false)
+	statement := policyPDF(t, "Problem A: Input Specification", "", false)
+	encrypted := policyPDF(t, "int main() {}", "", true)
+	locked := func() *io.SectionReader {
+		pdf := gofpdf.New("P", "mm", "A4", "")
+		pdf.SetProtection(gofpdf.CnProtectPrint, "user", "owner")
+		pdf.AddPage()
+
+		var buf bytes.Buffer
+		require.NoError(t, pdf.Output(&buf))
+		return io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+	}()
+
+	violation := func(document *io.SectionReader, pages int) string {
+		t.Helper()
+		doc, err := inspectDocument(zlog.Logger, document, pages)
+		require.NoError(t, err)
+		return doc.violation(zlog.Logger, document)
+	}
+
+	policyMaxPages, blockedText, policyImagesOnly, policyEncrypted = 10, []*regexp.Regexp{regexp.MustCompile("Input Specification")}, true, true
+	require.True(t, policyEnabled())
+	assert.Empty(t, violation(source, 1))
+	assert.Equal(t, "document has 11 pages, at most 10 pages are allowed", violation(source, 11))
+	assert.Equal(t, "document only contains images", violation(scan, 1))
+	assert.Equal(t, "document contains blocked text 'Input Specification'", violation(statement, 1))
+	assert.Equal(t, "document is encrypted", violation(encrypted, 1))
+	assert.Equal(t, "document is encrypted", violation(locked, 1), "documents requiring a password to open are encrypted")
+
+	// Unreadable documents cannot be inspected, they are not encrypted
+	broken := "%PDF-1.4\n/Password (secret)\n"
+	doc, err := inspectDocument(zlog.Logger, io.NewSectionReader(strings.NewReader(broken), 0, int64(len(broken))), 1)
+	assert.ErrorContains(t, err, "cannot read document")
+	assert.False(t, doc.encrypted)
+
+	policyCommand = "true"
+	assert.Empty(t, violation(source, 1))
+
+	policyCommand = "false"
+	assert.Equal(t, "document is rejected by the content policy", violation(source, 1))
+
+	policyCommand = "cuproxy-missing-policy"
+	assert.Empty(t, violation(source, 1), "a failing policy command does not reject jobs")
+}
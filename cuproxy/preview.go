@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasttemplate"
+
+	"github.com/tuupke/pixie/crud"
+	"github.com/tuupke/pixie/env"
+)
+
+// previewPNGCommand converts the banner, read from stdin, to a PNG written to
+// stdout. The `{{page}}` placeholder is replaced by the number of the banner
+// page.
+var previewPNGCommand = env.StringFb("PREVIEW_PNG_COMMAND", "pdftoppm -png -singlefile -r 96 -f {{page}} -l {{page}} -")
+
+// bannerPreview reports whether the banner fits, without the banner itself.
+type bannerPreview struct {
+	Page     int              `json:"page"`
+	Overflow []bannerOverflow `json:"overflow"`
+}
+
+// previewData returns the banner-data to preview. The key-values in the JSON
+// body take precedence over the Props of the client given by the id, or ip and
+// identity, parameters.
+func previewData(ctx *fasthttp.RequestCtx) bannerData {
+	body := make(kvs)
+	if len(ctx.PostBody()) > 0 {
+		crud.HandleError(ctx, http.StatusBadRequest, json.Unmarshal(ctx.PostBody(), &body))
+	}
+
+	args := ctx.QueryArgs()
+	id, ip, identity := string(args.Peek("id")), string(args.Peek("ip")), string(args.Peek("identity"))
+	if id == "" && ip == "" {
+		return body
+	}
+
+	var found []*Props
+	for _, p := range allProps() {
+		if p.key == id || (id == "" && sameIP(p.ip, ip) && (identity == "" || p.identity == identity)) {
+			found = append(found, p)
+		}
+	}
+
+	if len(found) == 0 {
+		crud.HandleError(ctx, http.StatusNotFound, fmt.Errorf("unknown client"))
+	} else if len(found) > 1 {
+		crud.HandleError(ctx, http.StatusConflict, fmt.Errorf("%v clients use ip '%v', select one using the identity", len(found), ip))
+	}
+
+	return overlay{found[0], body}
+}
+
+// previewBanner renders the banner for the previewData, as BannerPage would for
+// a job. The format parameter selects the pdf (default), a png of the banner
+// page, or a json report of the content that does not fit. The number of keys
+// that do not fit is always reported in the X-Banner-Overflow header.
+func previewBanner(ctx *fasthttp.RequestCtx) {
+	data := previewData(ctx)
+
+	var pdf bytes.Buffer
+	overflow, err := renderBanner(zlog.Logger, &pdf, data, printKeys...)
+	crud.HandleError(ctx, http.StatusInternalServerError, err)
+
+	// The blank page of BANNER_ON_BACK is added when stitching.
+	const page = 1
+	ctx.Response.Header.Set("X-Banner-Overflow", strconv.Itoa(len(overflow)))
+	switch format := string(ctx.QueryArgs().Peek("format")); format {
+	case "", "pdf":
+		ctx.SetContentType(formatPDF)
+		ctx.SetBody(pdf.Bytes())
+	case "png":
+		png, err := rasterize(&pdf, page)
+		if errors.Is(err, exec.ErrNotFound) || previewPNGCommand == "" {
+			crud.HandleError(ctx, http.StatusNotImplemented, fmt.Errorf("cannot render png, set PREVIEW_PNG_COMMAND; %w", err))
+		}
+
+		crud.HandleError(ctx, http.StatusInternalServerError, err)
+		ctx.SetContentType(formatPNG)
+		ctx.SetBody(png)
+	case "json":
+		if overflow == nil {
+			overflow = []bannerOverflow{}
+		}
+
+		crud.Respond(ctx, bannerPreview{Page: page, Overflow: overflow})
+	default:
+		crud.HandleError(ctx, http.StatusBadRequest, fmt.Errorf("unknown format '%v', expected pdf, png or json", format))
+	}
+}
+
+// rasterize converts the page of the pdf to a png, using PREVIEW_PNG_COMMAND.
+func rasterize(pdf *bytes.Buffer, page int) ([]byte, error) {
+	cmdRaw := strings.Fields(fasttemplate.ExecuteString(previewPNGCommand, "{{", "}}", map[string]any{"page": strconv.Itoa(page)}))
+	if len(cmdRaw) == 0 {
+		return nil, exec.ErrNotFound
+	}
+
+	var png, stderr bytes.Buffer
+	cmd := exec.Command(cmdRaw[0], cmdRaw[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pdf, &png, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cannot convert banner using '%v' (%v); %w", cmdRaw[0], strings.TrimSpace(stderr.String()), err)
+	}
+
+	return png.Bytes(), nil
+}
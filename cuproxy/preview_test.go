@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+// previewRequest executes the preview request with the JSON body.
+func previewRequest(method, uri, body string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	adminRouter().Handler(ctx)
+	return ctx
+}
+
+func TestRenderBannerOverflow(t *testing.T) {
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	f, err := os.Create(logo)
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewGray(image.Rect(0, 0, 120, 60))))
+	require.NoError(t, f.Close())
+
+	data := kvs{"img_logo": logo, "team_name": "Segmentation Fault"}
+	var out bytes.Buffer
+	overflow, err := renderBanner(zlog.Logger, &out, data, "img_logo", "team_name")
+	require.NoError(t, err, "images are placed on the banner")
+	assert.Empty(t, overflow)
+
+	pages, err := pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pages)
+
+	keys := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%02d", i))
+		data[keys[i]] = "value"
+	}
+
+	data["key00"] = strings.Repeat("far too wide ", 30)
+	overflow, err = renderBanner(zlog.Logger, &out, data, keys...)
+	require.NoError(t, err)
+	require.NotEmpty(t, overflow)
+	assert.Equal(t, bannerOverflow{Key: "key00", Reason: "beyond the right margin"}, overflow[0])
+	assert.Equal(t, bannerOverflow{Key: "key99", Reason: "beyond the bottom margin"}, overflow[len(overflow)-1])
+}
+
+func TestPreviewBanner(t *testing.T) {
+	ctx := previewRequest(http.MethodPost, "/preview", `{"team_name": "Segmentation Fault"}`)
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, formatPDF, string(ctx.Response.Header.ContentType()))
+	assert.Equal(t, "0", string(ctx.Response.Header.Peek("X-Banner-Overflow")))
+	assert.True(t, bytes.HasPrefix(ctx.Response.Body(), []byte("%PDF")))
+
+	many := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		many[fmt.Sprintf("key%02d", i)] = "value"
+	}
+
+	body, err := json.Marshal(many)
+	require.NoError(t, err)
+	ctx = previewRequest(http.MethodPost, "/preview?format=json", string(body))
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	var report bannerPreview
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &report))
+	assert.Equal(t, 1, report.Page)
+	assert.NotEmpty(t, report.Overflow)
+	assert.Equal(t, fmt.Sprint(len(report.Overflow)), string(ctx.Response.Header.Peek("X-Banner-Overflow")))
+
+	// The banner-data of a client is borrowed, the body takes precedence
+	Load(net.ParseIP("10.16.0.1"), map[string]string{"team_name": "Borrowed", "room": "A"}, "preview")
+	bannerTemplate, err = parseLayout([]byte(`elements: [{type: text, w: 10, value: "{{team_name}} in {{room}}"}]`))
+	require.NoError(t, err)
+	t.Cleanup(func() { bannerTemplate = nil })
+
+	ctx = previewRequest(http.MethodPost, "/preview?format=json&ip=10.16.0.1", `{"room": "B"}`)
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode())
+	report = bannerPreview{}
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &report))
+	require.Len(t, report.Overflow, 1)
+	assert.Equal(t, bannerOverflow{Element: 1, Text: "Borrowed in B", Reason: "text exceeds the width of the element"}, report.Overflow[0])
+
+	ctx = previewRequest(http.MethodGet, "/preview?ip=10.16.0.2", "")
+	assert.Equal(t, http.StatusNotFound, ctx.Response.StatusCode())
+
+	ctx = previewRequest(http.MethodPost, "/preview?format=svg", "{}")
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+
+	ctx = previewRequest(http.MethodPost, "/preview", "not json")
+	assert.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+
+	old := previewPNGCommand
+	t.Cleanup(func() { previewPNGCommand = old })
+	previewPNGCommand = "cuproxy-missing-rasterizer {{page}}"
+	ctx = previewRequest(http.MethodPost, "/preview?format=png", "{}")
+	assert.Equal(t, http.StatusNotImplemented, ctx.Response.StatusCode())
+
+	// The page is passed to the command, which reads the pdf from stdin
+	previewPNGCommand = "head -c {{page}}"
+	ctx = previewRequest(http.MethodPost, "/preview?format=png", "{}")
+	require.Equal(t, http.StatusOK, ctx.Response.StatusCode(), string(ctx.Response.Body()))
+	assert.Equal(t, formatPNG, string(ctx.Response.Header.ContentType()))
+	assert.Equal(t, "%", string(ctx.Response.Body()))
+}
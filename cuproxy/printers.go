@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/tuupke/pixie/env"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+const (
+	strategyRoundRobin  = "round-robin"
+	strategyLeastQueued = "least-queued"
+	strategySticky      = "sticky"
+
+	// printerIdShift is the number of bits reserved for the job-ids of a single
+	// printer. The index of the printer is stored in the bits above, which
+	// leaves room for 63 printers below heldJobOffset.
+	printerIdShift = 24
+	maxPrinters    = heldJobOffset >> printerIdShift
+)
+
+var (
+	printerStrategy  = env.StringFb("PRINTER_STRATEGY", strategyRoundRobin)
+	printerStickyKey = env.StringFb("PRINTER_STICKY_KEY", "room")
+	printerPoll      = env.DurationFb("PRINTER_POLL_INTERVAL", 15*time.Second)
+
+	// printers is the pool of printers jobs are sent to, the first printer is
+	// used when a request is not bound to a job.
+	printers = mustParsePrinters(printerTo)
+
+	// roundRobin is the number of jobs distributed using round-robin.
+	roundRobin = new(uint32)
+
+	// failoverReasons are the printer-state-reasons which prevent a printer from
+	// printing, jobs are sent to another printer instead.
+	failoverReasons = []string{"media-empty", "media-needed", "media-jam", "paused", "offline", "shutdown"}
+)
+
+type (
+	// printer is a single upstream printer of the pool.
+	printer struct {
+		index   int
+		name    string
+		address string
+		uri     string
+
+		// secure is set for printers connected to using ipps.
+		secure bool
+
+		mu     sync.Mutex
+		status printerStatus
+	}
+
+	// printerStatus is the state of the printer, as last polled.
+	printerStatus struct {
+		available bool
+		queued    int
+		reason    string
+		polled    time.Time
+	}
+)
+
+func init() {
+	switch printerStrategy {
+	case strategyRoundRobin, strategyLeastQueued, strategySticky:
+	default:
+		panic(fmt.Errorf("invalid PRINTER_STRATEGY '%v', expected '%v', '%v' or '%v'", printerStrategy, strategyRoundRobin, strategyLeastQueued, strategySticky))
+	}
+}
+
+// parsePrinters parses the comma-separated list of printers. Every printer is
+// written as `host:port/path`, optionally prefixed by a name and '='. The
+// address is used as name when none is given. The address can be prefixed by
+// `ipps://` to connect using TLS, or by `ipp://`.
+func parsePrinters(spec string) ([]*printer, error) {
+	entries := strings.Split(spec, ",")
+	if len(entries) > maxPrinters {
+		return nil, fmt.Errorf("at most %v printers are supported, got %v", maxPrinters, len(entries))
+	}
+
+	pool := make([]*printer, 0, len(entries))
+	names := make(map[string]bool, len(entries))
+	for k, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" && len(entries) > 1 {
+			return nil, fmt.Errorf("printer %v of '%v' is empty", k+1, spec)
+		}
+
+		name, address, found := strings.Cut(entry, "=")
+		if !found || strings.Contains(name, "://") {
+			name, address = entry, entry
+		}
+
+		scheme, address := splitScheme(address)
+		if scheme != "" && scheme != schemeIPP && scheme != schemeIPPS {
+			return nil, fmt.Errorf("printer '%v' uses unsupported scheme '%v', expected '%v' or '%v'", name, scheme, schemeIPP, schemeIPPS)
+		}
+
+		if !found {
+			name = address
+		}
+
+		if scheme == "" {
+			scheme = schemeIPP
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("printer '%v' is configured twice", name)
+		}
+
+		names[name] = true
+		pool = append(pool, &printer{
+			index:   k,
+			name:    name,
+			address: address,
+			uri:     scheme + "://" + address,
+			secure:  scheme == schemeIPPS,
+			status:  printerStatus{available: true},
+		})
+	}
+
+	return pool, nil
+}
+
+func mustParsePrinters(spec string) []*printer {
+	pool, err := parsePrinters(spec)
+	if err != nil {
+		panic(fmt.Errorf("invalid PRINTER_TO; %w", err))
+	}
+
+	return pool
+}
+
+// url returns the http url requests to the printer are sent to.
+func (p *printer) url() string {
+	if p.secure {
+		return "https://" + p.address
+	}
+
+	return "http://" + p.address
+}
+
+// Status returns the state of the printer, as last polled.
+func (p *printer) Status() printerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// available returns whether the printer is able to print.
+func (p *printer) available() bool {
+	return p.Status().available
+}
+
+// dispatched counts a job sent to the printer until the next poll, keeping the
+// queue length up-to-date between polls.
+func (p *printer) dispatched() {
+	p.mu.Lock()
+	p.status.queued++
+	p.mu.Unlock()
+}
+
+// failed marks the printer as unavailable until it is polled successfully.
+func (p *printer) failed(log zerolog.Logger, reason string) {
+	p.mu.Lock()
+	wasAvailable := p.status.available
+	p.status.available, p.status.reason = false, reason
+	p.mu.Unlock()
+
+	if wasAvailable && len(printers) > 1 {
+		log.Warn().Str("printer", p.name).Str("reason", reason).Msg("printer unavailable, failing over")
+	}
+}
+
+// poll retrieves the printer-state, printer-state-reasons and queued-job-count
+// of the printer. A printer is available unless it is stopped, or one of the
+// failoverReasons is reported.
+func (p *printer) poll(log zerolog.Logger) {
+	req := newUpstreamRequest(p, ipp.OperationGetPrinterAttributes, "")
+	req.Group(ipp.TagOperation).Set("requested-attributes",
+		ipp.String(ipp.TagKeyword, "printer-state"),
+		ipp.String(ipp.TagKeyword, "printer-state-reasons"),
+		ipp.String(ipp.TagKeyword, "queued-job-count"),
+	)
+
+	resp, err := sendUpstream(log, p, req, nil)
+	if err == nil && !resp.Status().IsSuccessful() {
+		err = fmt.Errorf("printer refused %v; status %v", req.Operation(), resp.Status())
+	}
+
+	if err != nil {
+		p.failed(log, err.Error())
+		return
+	}
+
+	status := printerStatus{available: true, polled: time.Now()}
+	queued, _ := resp.Attribute(ipp.TagPrinter, "queued-job-count").Int()
+	status.queued = int(queued)
+	if state, _ := resp.Attribute(ipp.TagPrinter, "printer-state").Int(); state == ipp.PrinterStateStopped {
+		status.available, status.reason = false, "stopped"
+	}
+
+	if a := resp.Attribute(ipp.TagPrinter, "printer-state-reasons"); a != nil {
+		for _, v := range a.Values {
+			if reason := failoverReason(v.String()); reason != "" {
+				status.available, status.reason = false, reason
+			}
+		}
+	}
+
+	p.mu.Lock()
+	wasAvailable := p.status.available
+	p.status = status
+	p.mu.Unlock()
+
+	log.Debug().Str("printer", p.name).Bool("available", status.available).Int("queued", status.queued).Str("reason", status.reason).Msg("polled printer")
+	if wasAvailable != status.available {
+		log.Warn().Str("printer", p.name).Bool("available", status.available).Str("reason", status.reason).Msg("printer availability changed")
+	}
+}
+
+// failoverReason returns the printer-state-reason without its severity suffix
+// when it prevents printing, and the empty string otherwise. Warnings and
+// reports do not prevent printing.
+func failoverReason(reason string) string {
+	if strings.HasSuffix(reason, "-warning") || strings.HasSuffix(reason, "-report") {
+		return ""
+	}
+
+	reason = strings.TrimSuffix(reason, "-error")
+	for _, r := range failoverReasons {
+		if reason == r {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+// pollPrinters polls all printers until the context is done. A single printer
+// is never polled, as there is nothing to fail over to.
+func pollPrinters(ctx context.Context, log zerolog.Logger) {
+	if len(printers) < 2 || printerPoll <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(printerPoll)
+	defer ticker.Stop()
+	for {
+		for _, p := range printers {
+			p.poll(log)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// defaultPrinter returns the first available printer, used for requests not
+// bound to a job.
+func defaultPrinter() *printer {
+	for _, p := range printers {
+		if p.available() {
+			return p
+		}
+	}
+
+	return printers[0]
+}
+
+// selectPrinter selects the printer to send a job to using the strategy.
+// Unavailable printers are skipped, unless no printer is available.
+func selectPrinter(data bannerData) *printer {
+	candidates := make([]*printer, 0, len(printers))
+	for _, p := range printers {
+		if p.available() {
+			candidates = append(candidates, p)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = printers
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch printerStrategy {
+	case strategyLeastQueued:
+		least := candidates[0]
+		for _, p := range candidates[1:] {
+			if p.Status().queued < least.Status().queued {
+				least = p
+			}
+		}
+
+		return least
+	case strategySticky:
+		if p := stickyPrinter(data); p != nil {
+			return p
+		}
+	}
+
+	return candidates[atomic.AddUint32(roundRobin, 1)%uint32(len(candidates))]
+}
+
+// stickyPrinter returns the printer for the value of the sticky key, or nil
+// when the value is unknown. The printer named after the value is used if it
+// exists, otherwise the value is hashed. When the printer is unavailable, the
+// next available printer is used, keeping all jobs of a room together.
+func stickyPrinter(data bannerData) *printer {
+	if data == nil {
+		return nil
+	}
+
+	value, ok := data.Load(printerStickyKey)
+	if !ok || value == "" {
+		return nil
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(value))
+	start := int(h.Sum32() % uint32(len(printers)))
+	for _, p := range printers {
+		if p.name == value {
+			start = p.index
+		}
+	}
+
+	for k := range printers {
+		if p := printers[(start+k)%len(printers)]; p.available() {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// localJobId converts the job-id of the printer into the job-id exposed to
+// clients, which identifies the printer as well. The job-ids of the first
+// printer are left as-is. The job-id must fit in the bits reserved for a
+// printer, see localizeJobs.
+func localJobId(p *printer, id int32) int32 {
+	return int32(p.index)<<printerIdShift | id
+}
+
+// upstreamJob returns the printer, and its job-id, of the job-id exposed to
+// clients. No printer is returned for held jobs, and unknown printers.
+func upstreamJob(id int32) (*printer, int32) {
+	index := int(id >> printerIdShift)
+	if id < 0 || id >= heldJobOffset || index >= len(printers) {
+		return nil, id
+	}
+
+	return printers[index], id & (1<<printerIdShift - 1)
+}
+
+// routeJob replaces the job-id, and job-uri, of the request with those of the
+// printer the job was sent to. The printer and the job-id exposed to the
+// client are returned, found is false when the request does not reference a
+// job.
+func routeJob(msg *ipp.Message) (p *printer, id int32, found bool) {
+	op := msg.Group(ipp.TagOperation)
+	id, found = op.Attribute("job-id").Int()
+	if !found {
+		id, found = jobUriId(op.Attribute("job-uri").String())
+	}
+
+	if !found {
+		return nil, 0, false
+	}
+
+	p, upstream := upstreamJob(id)
+	if p == nil {
+		return nil, id, true
+	}
+
+	setRequestJobId(msg, upstream)
+	return p, id, true
+}
+
+// setRequestJobId replaces the job-id, and job-uri, referenced by the request.
+func setRequestJobId(msg *ipp.Message, id int32) {
+	op := msg.Group(ipp.TagOperation)
+	if a := op.Attribute("job-id"); a != nil {
+		a.Values = []ipp.Value{ipp.Integer(ipp.TagInteger, id)}
+	}
+
+	if a := op.Attribute("job-uri"); a != nil {
+		a.Values = []ipp.Value{ipp.String(ipp.TagURI, setJobUriId(a.String(), id))}
+	}
+}
+
+// printerNamed returns the printer called name, or nil when there is none.
+func printerNamed(name string) *printer {
+	for _, p := range printers {
+		if p.name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// localizeJobs replaces all job-ids, and job-uris, in the response of the
+// printer with those exposed to clients. Jobs with a job-id that does not fit
+// in the bits reserved for a printer cannot be routed back, they are left out.
+// A single printer has nothing to encode, its job-ids are passed through.
+func localizeJobs(log zerolog.Logger, msg *ipp.Message, p *printer) {
+	if len(printers) <= 1 {
+		return
+	}
+
+	groups := msg.Groups[:0]
+	for _, g := range msg.Groups {
+		if g.Tag != ipp.TagJob || localizeJob(g, p) {
+			groups = append(groups, g)
+			continue
+		}
+
+		id, _ := g.Attribute("job-id").Int()
+		log.Error().Str("printer", p.name).Int32("job_id", id).Msg("job-id of printer out of range, leaving out job")
+	}
+
+	msg.Groups = groups
+}
+
+// localizeJob replaces the job-id, and job-uri, of the job attributes. False is
+// returned when a job-id is out of range, the attributes are left as-is then.
+func localizeJob(g *ipp.Group, p *printer) bool {
+	for _, a := range g.Attributes {
+		for _, v := range a.Values {
+			var id int32
+			var ok bool
+			switch {
+			case a.Name == "job-id":
+				id, ok = v.Int()
+			case a.Name == "job-uri" && v.Tag == ipp.TagURI:
+				id, ok = jobUriId(v.String())
+			}
+
+			if ok && (id < 0 || id >= 1<<printerIdShift) {
+				return false
+			}
+		}
+	}
+
+	for _, a := range g.Attributes {
+		for k, v := range a.Values {
+			switch id, isInt := v.Int(); {
+			case a.Name == "job-id" && isInt:
+				a.Values[k] = ipp.Integer(v.Tag, localJobId(p, id))
+			case a.Name == "job-uri" && v.Tag == ipp.TagURI:
+				if id, ok := jobUriId(v.String()); ok {
+					a.Values[k] = ipp.String(ipp.TagURI, setJobUriId(v.String(), localJobId(p, id)))
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// jobUriId extracts the job-id from a job-uri, which ends in "/jobs/<id>".
+func jobUriId(uri string) (int32, bool) {
+	i := strings.LastIndex(uri, "/jobs/")
+	if i < 0 {
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(uri[i+len("/jobs/"):], 10, 32)
+	return int32(id), err == nil
+}
+
+// setJobUriId replaces the job-id of the job-uri.
+func setJobUriId(uri string, id int32) string {
+	i := strings.LastIndex(uri, "/jobs/")
+	if i < 0 {
+		return uri
+	}
+
+	return uri[:i+len("/jobs/")] + strconv.Itoa(int(id))
+}
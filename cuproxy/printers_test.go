@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+// testPool replaces the printers by the pool, for the duration of the test.
+func testPool(t *testing.T, spec string) []*printer {
+	t.Helper()
+	old := printers
+	printers = mustParsePrinters(spec)
+	t.Cleanup(func() { printers = old })
+	return printers
+}
+
+// statusPrinter starts a printer responding to Get-Printer-Attributes with the
+// state, reasons and queued-job-count, its address is returned.
+func statusPrinter(t *testing.T, state int32, queued int32, reasons ...string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := ipp.Decode(r.Body)
+		require.NoError(t, err)
+
+		resp := ipp.NewResponse(req, ipp.StatusOK)
+		attrs := resp.AddGroup(ipp.TagPrinter)
+		attrs.Set("printer-state", ipp.Integer(ipp.TagEnum, state))
+		attrs.Set("queued-job-count", ipp.Integer(ipp.TagInteger, queued))
+		values := make([]ipp.Value, 0, len(reasons))
+		for _, reason := range reasons {
+			values = append(values, ipp.String(ipp.TagKeyword, reason))
+		}
+
+		attrs.Set("printer-state-reasons", values...)
+		_, _ = w.Write(resp.Bytes())
+	}))
+
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://") + "/printers/test"
+}
+
+func itoa(i int32) string {
+	return strconv.Itoa(int(i))
+}
+
+func TestParsePrinters(t *testing.T) {
+	pool, err := parsePrinters("north=ps:631/printers/North, ps:631/printers/South")
+	require.NoError(t, err)
+	require.Len(t, pool, 2)
+	assert.Equal(t, "north", pool[0].name)
+	assert.Equal(t, "ipp://ps:631/printers/North", pool[0].uri)
+	assert.Equal(t, "ps:631/printers/South", pool[1].name)
+	assert.Equal(t, 1, pool[1].index)
+	assert.True(t, pool[1].available())
+	assert.Equal(t, "http://ps:631/printers/South", pool[1].url())
+
+	pool, err = parsePrinters("secure=ipps://ps:631/printers/North,ipps://ps:631/printers/South")
+	require.NoError(t, err)
+	assert.Equal(t, "ipps://ps:631/printers/North", pool[0].uri)
+	assert.Equal(t, "https://ps:631/printers/North", pool[0].url())
+	assert.Equal(t, "ps:631/printers/South", pool[1].name, "the scheme is not part of the name")
+	assert.True(t, pool[1].secure)
+
+	pool, err = parsePrinters("v6=ipps://[2001:db8::5]:631/printers/North")
+	require.NoError(t, err)
+	assert.Equal(t, "https://[2001:db8::5]:631/printers/North", pool[0].url())
+
+	// A single printer, or none, is configured as before
+	pool, err = parsePrinters("")
+	require.NoError(t, err)
+	assert.Len(t, pool, 1)
+
+	for _, spec := range []string{"a:631,,b:631", "x=a:631,x=b:631", strings.Repeat("a,", maxPrinters) + "a", "http://a:631"} {
+		_, err = parsePrinters(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestFailoverReason(t *testing.T) {
+	for reason, expected := range map[string]string{
+		"none":                "",
+		"media-empty":         "media-empty",
+		"media-empty-error":   "media-empty",
+		"media-empty-warning": "",
+		"media-low-report":    "",
+		"toner-low-warning":   "",
+		"paused":              "paused",
+	} {
+		assert.Equal(t, expected, failoverReason(reason), reason)
+	}
+}
+
+func TestPollPrinter(t *testing.T) {
+	pool := testPool(t, strings.Join([]string{
+		"idle=" + statusPrinter(t, ipp.PrinterStateIdle, 3),
+		"stopped=" + statusPrinter(t, ipp.PrinterStateStopped, 0),
+		"empty=" + statusPrinter(t, ipp.PrinterStateProcessing, 0, "media-empty-error"),
+		"low=" + statusPrinter(t, ipp.PrinterStateProcessing, 1, "media-low-warning"),
+		"gone=127.0.0.1:1/printers/gone",
+	}, ","))
+
+	for _, p := range pool {
+		p.poll(zlog.Logger)
+	}
+
+	assert.True(t, pool[0].available())
+	assert.Equal(t, 3, pool[0].Status().queued)
+	assert.False(t, pool[1].available())
+	assert.Equal(t, "stopped", pool[1].Status().reason)
+	assert.False(t, pool[2].available())
+	assert.Equal(t, "media-empty", pool[2].Status().reason)
+	assert.True(t, pool[3].available())
+	assert.False(t, pool[4].available(), "unreachable printers are unavailable")
+
+	// Least-queued only considers available printers
+	printerStrategy = strategyLeastQueued
+	t.Cleanup(func() { printerStrategy = strategyRoundRobin })
+	assert.Same(t, pool[3], selectPrinter(nil))
+	pool[3].dispatched()
+	pool[3].dispatched()
+	pool[3].dispatched()
+	assert.Same(t, pool[0], selectPrinter(nil), "dispatched jobs count towards the queue")
+}
+
+func TestSelectPrinter(t *testing.T) {
+	pool := testPool(t, "A=a:631,B=b:631,C=c:631")
+
+	seen := make(map[*printer]int)
+	for range pool {
+		seen[selectPrinter(nil)]++
+	}
+
+	assert.Len(t, seen, 3, "round-robin must use every printer")
+
+	pool[1].failed(zlog.Logger, "stopped")
+	for range pool {
+		assert.NotSame(t, pool[1], selectPrinter(nil))
+	}
+
+	printerStrategy = strategySticky
+	t.Cleanup(func() { printerStrategy = strategyRoundRobin })
+
+	// Rooms named after a printer use that printer, others are hashed
+	assert.Same(t, pool[2], selectPrinter(kvs{"room": "C"}))
+	hashed := selectPrinter(kvs{"room": "lab-3"})
+	for range pool {
+		assert.Same(t, hashed, selectPrinter(kvs{"room": "lab-3"}))
+	}
+
+	// Failing over keeps the room together on the next available printer
+	assert.Same(t, pool[2], selectPrinter(kvs{"room": "B"}))
+	pool[2].failed(zlog.Logger, "stopped")
+	assert.Same(t, pool[0], selectPrinter(kvs{"room": "C"}))
+
+	// Without any available printer, the job is still sent somewhere
+	pool[0].failed(zlog.Logger, "stopped")
+	assert.NotNil(t, selectPrinter(kvs{"room": "C"}))
+	assert.Same(t, pool[0], defaultPrinter())
+}
+
+func TestRouteJob(t *testing.T) {
+	pool := testPool(t, "A=a:631,B=b:631")
+
+	send := testMessage(t, "send-document-request.bin")
+	id, _ := send.Attribute(ipp.TagOperation, "job-id").Int()
+	send.Group(ipp.TagOperation).Set("job-id", ipp.Integer(ipp.TagInteger, localJobId(pool[1], id)))
+	send.Group(ipp.TagOperation).Set("job-uri", ipp.String(ipp.TagURI, "ipp://localhost:6631/jobs/"+itoa(localJobId(pool[1], id))))
+
+	p, local, found := routeJob(send)
+	require.True(t, found)
+	assert.Same(t, pool[1], p)
+	assert.Equal(t, localJobId(pool[1], id), local)
+	upstream, _ := send.Attribute(ipp.TagOperation, "job-id").Int()
+	assert.Equal(t, id, upstream)
+	assert.Equal(t, "ipp://localhost:6631/jobs/"+itoa(id), send.Attribute(ipp.TagOperation, "job-uri").String())
+
+	// Held jobs are not known to any printer
+	send.Group(ipp.TagOperation).Set("job-id", ipp.Integer(ipp.TagInteger, heldJobOffset+1))
+	p, local, found = routeJob(send)
+	assert.True(t, found)
+	assert.Nil(t, p)
+	assert.EqualValues(t, heldJobOffset+1, local)
+
+	_, _, found = routeJob(testMessage(t, "create-job-request.bin"))
+	assert.False(t, found)
+
+	resp := testMessage(t, "create-job-response.bin")
+	localizeJobs(zlog.Logger, resp, pool[1])
+	local, _ = resp.Attribute(ipp.TagJob, "job-id").Int()
+	assert.Equal(t, localJobId(pool[1], 795), local)
+	assert.Equal(t, "ipp://printserver:631/jobs/"+itoa(local), resp.Attribute(ipp.TagJob, "job-uri").String())
+
+	p, upstream = upstreamJob(local)
+	assert.Same(t, pool[1], p)
+	assert.EqualValues(t, 795, upstream)
+
+	// Job-ids that do not fit cannot be routed back, those jobs are left out
+	listing := func() *ipp.Message {
+		resp := ipp.NewResponse(ipp.NewRequest(ipp.OperationGetJobs, 3), ipp.StatusOK)
+		for _, id := range []int32{796, 1 << printerIdShift} {
+			attrs := &ipp.Group{Tag: ipp.TagJob}
+			attrs.Set("job-id", ipp.Integer(ipp.TagInteger, id))
+			attrs.Set("job-uri", ipp.String(ipp.TagURI, jobUri("ipp://printserver:631/printers/b", id)))
+			resp.Groups = append(resp.Groups, attrs)
+		}
+
+		return resp
+	}
+
+	ids := func(resp *ipp.Message) []int32 {
+		var ids []int32
+		for _, g := range resp.Groups {
+			if id, ok := g.Attribute("job-id").Int(); ok && g.Tag == ipp.TagJob {
+				ids = append(ids, id)
+			}
+		}
+
+		return ids
+	}
+
+	resp = listing()
+	localizeJobs(zlog.Logger, resp, pool[0])
+	assert.Equal(t, []int32{796}, ids(resp))
+	assert.NotNil(t, resp.Group(ipp.TagOperation), "other groups are kept")
+
+	// A single printer has nothing to encode, all jobs are kept as-is
+	single := testPool(t, "A=a:631")
+	resp = listing()
+	localizeJobs(zlog.Logger, resp, single[0])
+	assert.Equal(t, []int32{796, 1 << printerIdShift}, ids(resp))
+
+	p, upstream = upstreamJob(1 << printerIdShift)
+	assert.Nil(t, p, "the job is asked to the only printer")
+	assert.EqualValues(t, 1<<printerIdShift, upstream)
+}
@@ -11,7 +11,9 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chebyrash/promise"
@@ -23,15 +25,33 @@ import (
 
 	"github.com/tuupke/pixie/env"
 	"github.com/tuupke/pixie/lifecycle"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
 )
 
 type (
 	Props struct {
 		ip net.IP
 
+		// key is the cache key of the Props, used to persist them.
+		key string
+
+		// identity is the basic-auth username, or the ip when there is none.
+		identity string
+
 		*xsync.MapOf[string, string]
 
-		latestData time.Time
+		// overrides contains the values set using the admin API, webhooks do
+		// not change them.
+		overrides *xsync.MapOf[string, string]
+
+		// latestData is the time, in unix nanoseconds, at which the data last
+		// changed.
+		latestData atomic.Int64
+
+		// validated is the time, in unix nanoseconds, at which all webhooks last
+		// succeeded.
+		validated atomic.Int64
 	}
 
 	// promiseInteraction is a promise used to interact with external data and the
@@ -39,6 +59,13 @@ type (
 	promiseInteraction struct {
 		callItIn   func()
 		pdfPromise *promise.Promise[*os.File]
+		data       *Props
+
+		// create is the Create-Job request, if the job was created using one.
+		create *ipp.Message
+
+		// created is used to expire the promises of jobs that never complete.
+		created time.Time
 	}
 )
 
@@ -49,6 +76,8 @@ var (
 	basicAuthUser    = env.StringFb("BASIC_AUTH_USERNAME", "ba_username")
 	basicAuthPass    = env.StringFb("BASIC_AUTH_PASSWORD", "ba_password")
 	alwaysFreshData  = env.Bool("BANNER_DATA_ALWAYS_FRESH")
+	dataFreshFor     = env.DurationFb("BANNER_DATA_FRESH_FOR", 0)
+	dataMaxStaleness = env.DurationFb("BANNER_DATA_MAX_STALENESS", 0)
 )
 
 func init() {
@@ -73,36 +102,31 @@ var empty = e{}
 func loadValues(log zerolog.Logger, ctx *fasthttp.RequestCtx, jobId int32) promiseInteraction {
 	// Load or create a Props instance
 	data := LoadFromRequest(ctx)
-	isInitial := data.latestData.IsZero() || alwaysFreshData
+
+	age, _ := data.Staleness()
+	fresh, isInitial := data.revalidation()
 
 	log = log.With().IPAddr("for", data.ip).Int32("job-id", jobId).Logger()
 
-	awaitCtx, cancel := context.WithCancel(lifecycle.ApplicationContext())
-	waitFor := len(toCall)
-	c := make(chan e, waitFor)
-	log.Info().Int("num_hooks", waitFor).Msg("loading data")
-	for _, set := range toCall {
-		ioPool.Go(set.handle(c, log, data))
+	hooks := toCall
+	if fresh {
+		hooks = nil
 	}
 
+	awaitCtx, cancel := context.WithCancel(lifecycle.ApplicationContext())
+	log.Info().Int("num_hooks", len(hooks)).Dur("age", age).Bool("fresh", fresh).Msg("loading data")
+	done := data.refresh(log, hooks)
+
 	// fanin is a promise that awaits until all
 	fanin := promise.New(func(resolve func(e), reject func(error)) {
-		log.Info().Bool("will-wait", isInitial).Int("webhooks-to-finish", waitFor).Msg("awaiting finish")
-
-		var ctxEnd bool
-		for !ctxEnd && waitFor > 0 {
-			if isInitial {
-				<-c
-				waitFor--
-				log.Debug().Int("remaining", waitFor).Msg("waiting for more hooks")
-			} else {
-				select {
-				case <-c:
-					waitFor--
-				case <-awaitCtx.Done():
-					log.Warn().Msg("called in")
-					ctxEnd = true
-				}
+		log.Info().Bool("will-wait", isInitial).Int("webhooks-to-finish", len(hooks)).Msg("awaiting finish")
+		if isInitial {
+			<-done
+		} else {
+			select {
+			case <-done:
+			case <-awaitCtx.Done():
+				log.Warn().Dur("age", age).Msg("called in, using stale data")
 			}
 		}
 
@@ -111,25 +135,76 @@ func loadValues(log zerolog.Logger, ctx *fasthttp.RequestCtx, jobId int32) promi
 
 	// computes result based on the fetched data, runs on cpuOptimizedPool
 	pdfPromise := promise.ThenWithPool(fanin, lifecycle.ApplicationContext(), func(_ e) (*os.File, error) {
-		// Load the stat on the pdf
-		fn := pdfLocation + "/" + data.ip.String() + ".pdf"
-		file, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0755)
-		if err != nil {
-			// Something went really wrong here, unrecoverable
-			return nil, fmt.Errorf("encountered error opening file '%v'; %w", fn, err)
+		return data.banner(log, false)
+	}, cpuPool)
+
+	return promiseInteraction{callItIn: cancel, pdfPromise: pdfPromise, data: data, created: time.Now()}
+}
+
+// refresh calls the webhooks for the Props. The returned channel is closed once
+// all hooks finished, the data is revalidated when none of them failed.
+func (p *Props) refresh(log zerolog.Logger, hooks endpointsSet) <-chan e {
+	age, validated := p.Staleness()
+	waitFor := len(hooks)
+	c := make(chan error, waitFor)
+	started := time.Now()
+	for _, set := range hooks {
+		ioPool.Go(set.handle(c, log, p))
+	}
+
+	done := make(chan e)
+	go func() {
+		defer close(done)
+		var failed int
+		for i := 0; i < waitFor; i++ {
+			if err := <-c; err != nil {
+				failed++
+			}
+
+			log.Debug().Int("remaining", waitFor-i-1).Msg("waiting for more hooks")
 		}
 
-		if fi, err := file.Stat(); err == nil && fi.Size() > 0 && fi != nil && fi.ModTime().After(data.latestData) && !data.latestData.IsZero() {
-			log.Info().Msg("reusing cached banner")
-			return file, err
+		if failed == 0 && waitFor > 0 {
+			p.validated.Store(started.UnixNano())
+		} else if failed > 0 && validated {
+			log.Warn().Int("failed", failed).Dur("age", age).Msg("revalidation failed, using stale data")
 		}
 
-		log.Err(file.Truncate(0)).Msg("creating new banner, truncated file")
-		// Render the pdf, data is either up-to or out-of-date, we don't care!
-		return file, BannerPage(log, file, data, printKeys...)
-	}, cpuPool)
+		if waitFor > 0 {
+			persistProps(log, p)
+		}
+	}()
 
-	return promiseInteraction{callItIn: cancel, pdfPromise: pdfPromise}
+	return done
+}
+
+// banner returns the banner of the Props, it is rendered unless the banner
+// rendered previously is still valid or when forced.
+func (p *Props) banner(log zerolog.Logger, force bool) (*os.File, error) {
+	// Load the stat on the pdf
+	fn := pdfLocation + "/" + ipFileName(p.ip) + ".pdf"
+	file, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		// Something went really wrong here, unrecoverable
+		return nil, fmt.Errorf("encountered error opening file '%v'; %w", fn, err)
+	}
+
+	// Banners are stored by ip, only reuse those rendered for these Props
+	if fi, err := file.Stat(); !force && err == nil && fi.Size() > 0 && fi != nil && fi.ModTime().After(p.LatestData()) && !p.LatestData().IsZero() && bannerValid(p, file) {
+		log.Info().Msg("reusing cached banner")
+		bannersTotal.WithLabelValues("cached").Inc()
+		return file, err
+	}
+
+	log.Err(file.Truncate(0)).Msg("creating new banner, truncated file")
+	// Render the pdf, data is either up-to or out-of-date, we don't care!
+	if err = BannerPage(log, file, p, printKeys...); err != nil {
+		return file, err
+	}
+
+	storeBanner(log, p, file)
+	bannersTotal.WithLabelValues("rendered").Inc()
+	return file, nil
 }
 
 type mapWriter map[string]string
@@ -219,12 +294,18 @@ func parseToCallString(toCallString string) (e endpointsSet, gerr error) {
 }
 
 func init() {
-	if len(toCallString) > 0 {
-		var err error
+	var err error
+	switch {
+	case webhookConfigFile != "" && toCallString != "":
+		panic(fmt.Errorf("both WEBHOOK_CONFIG and WEBHOOKS_TO_CALL are set, use only WEBHOOK_CONFIG"))
+	case webhookConfigFile != "":
+		toCall, err = loadWebhookConfig(webhookConfigFile)
+	case toCallString != "":
 		toCall, err = parseToCallString(toCallString)
-		if err != nil {
-			panic(err)
-		}
+	}
+
+	if err != nil {
+		panic(err)
 	}
 
 	if downloadTo == "" {
@@ -248,7 +329,7 @@ func decodeBasicAuth(auth []byte) (ok bool, user, pass string) {
 		return
 	}
 
-	credentials := bytes.Split(decoded, []byte(":"))
+	credentials := bytes.SplitN(decoded, []byte(":"), 2)
 	if len(credentials) <= 1 {
 		return
 	}
@@ -282,22 +363,132 @@ func LoadFromRequest(ctx *fasthttp.RequestCtx) *Props {
 	return Load(ip, baseData, user, pass, ctx.Request.URI().String())
 }
 
+// Load loads, or creates, the Props for the ip and segments. The first segment
+// is assumed to be the basic-auth username.
 func Load(ip net.IP, baseData map[string]string, segments ...string) *Props {
-	key := ip.String() + "::" + strings.Join(segments, "::")
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	key := propsKey(ip, segments)
+	identity := ip.String()
+	if len(segments) > 0 && segments[0] != "" {
+		identity = segments[0]
+	}
+
 	props, load := (*xsync.MapOf[string, *Props])(props).LoadOrStore(key, &Props{
-		ip:    ip,
-		MapOf: xsync.NewMapOf[string](),
+		ip:        ip,
+		key:       cacheKey(key),
+		identity:  identity,
+		MapOf:     xsync.NewMapOf[string](),
+		overrides: xsync.NewMapOf[string](),
 	})
 
 	if !load {
 		for k, v := range baseData {
 			props.Store(k, v)
 		}
+
+		props.restore()
 	}
 
 	return props
 }
 
+// propsKey encodes the ip and segments into the key of the Props. Every part is
+// quoted, as IPv6 addresses, and the segments, can contain any separator.
+func propsKey(ip net.IP, segments []string) string {
+	var b strings.Builder
+	b.WriteString(strconv.Quote(ip.String()))
+	for _, s := range segments {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Quote(s))
+	}
+
+	return b.String()
+}
+
+// ipFileName returns the ip as part of a filename, the colons of IPv6
+// addresses are replaced by dashes.
+func ipFileName(ip net.IP) string {
+	return strings.ReplaceAll(ip.String(), ":", "-")
+}
+
+// sameIP returns whether the ip equals the textual ip, in any notation.
+func sameIP(ip net.IP, s string) bool {
+	return ip.Equal(net.ParseIP(s))
+}
+
+// set stores the value retrieved by a webhook, unless the key is overridden.
+func (p *Props) set(key, value string) {
+	if _, ok := p.overrides.Load(key); !ok {
+		p.Store(key, value)
+	}
+}
+
+// Override sets the value of the key, webhooks no longer change it.
+func (p *Props) Override(key, value string) {
+	p.overrides.Store(key, value)
+	p.Store(key, value)
+	p.touch()
+}
+
+// Forget deletes the key and its override, webhooks can set it again.
+func (p *Props) Forget(key string) {
+	p.overrides.Delete(key)
+	p.Delete(key)
+	p.touch()
+}
+
+// Overrides returns a copy of the overridden key-value pairs.
+func (p *Props) Overrides() map[string]string {
+	mp := make(map[string]string)
+	p.overrides.Range(func(key, value string) bool {
+		mp[key] = value
+		return true
+	})
+
+	return mp
+}
+
+// LatestData returns the time the data last changed, the zero time when it
+// never did.
+func (p *Props) LatestData() time.Time {
+	if latest := p.latestData.Load(); latest != 0 {
+		return time.Unix(0, latest)
+	}
+
+	return time.Time{}
+}
+
+// touch marks the data as changed now.
+func (p *Props) touch() {
+	p.latestData.Store(time.Now().UnixNano())
+}
+
+// Staleness returns the time since all webhooks last succeeded for the Props,
+// and whether they ever did.
+func (p *Props) Staleness() (time.Duration, bool) {
+	validated := p.validated.Load()
+	if validated == 0 {
+		return 0, false
+	}
+
+	return time.Since(time.Unix(0, validated)), true
+}
+
+// revalidation returns whether the data is fresh, and need not be revalidated,
+// and whether the revalidation must be awaited. Stale data is used while it is
+// revalidated, unless it is staler than BANNER_DATA_MAX_STALENESS.
+func (p *Props) revalidation() (fresh, await bool) {
+	age, validated := p.Staleness()
+	if !validated || alwaysFreshData {
+		return false, true
+	}
+
+	return age < dataFreshFor, dataMaxStaleness > 0 && age > dataMaxStaleness
+}
+
 func (p *Props) Reduce(keys ...string) (mp map[string]string) {
 	mp = make(map[string]string)
 	for _, key := range keys {
@@ -309,6 +500,30 @@ func (p *Props) Reduce(keys ...string) (mp map[string]string) {
 	return
 }
 
+// Identity returns the identity used to account quotas. This is the value of
+// QUOTA_IDENTITY_KEY when configured and present, otherwise the basic-auth
+// username or ip.
+func (p *Props) Identity() string {
+	if quotaIdentityKey != "" {
+		if v, ok := p.Load(quotaIdentityKey); ok && v != "" {
+			return v
+		}
+	}
+
+	return p.identity
+}
+
+// Snapshot returns a copy of all key-value pairs currently stored.
+func (p *Props) Snapshot() map[string]string {
+	mp := make(map[string]string, p.Size())
+	p.Range(func(key, value string) bool {
+		mp[key] = value
+		return true
+	})
+
+	return mp
+}
+
 func (p *Props) json(extra map[string]string) io.Reader {
 	// TODO create a pool of buffers to use
 	b := new(bytes.Buffer)
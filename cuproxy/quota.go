@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/puzpuzpuz/xsync"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	quotaReject = "reject"
+	quotaHold   = "hold"
+)
+
+var (
+	quotaIdentityKey = env.String("QUOTA_IDENTITY_KEY")
+	quotaPagesPerJob = env.IntFb("QUOTA_PAGES_PER_JOB", 0)
+	quotaJobs        = env.IntFb("QUOTA_JOBS", 0)
+	quotaJobsWindow  = env.DurationFb("QUOTA_JOBS_WINDOW", 10*time.Minute)
+	quotaTotalPages  = env.IntFb("QUOTA_TOTAL_PAGES", 0)
+	quotaExceeded    = env.StringFb("QUOTA_EXCEEDED", quotaReject)
+
+	// quotaLocks serializes the jobs of an identity, from loading its quota
+	// until the job is recorded.
+	quotaLocks = xsync.NewMapOf[*sync.Mutex]()
+)
+
+// quota is the usage of a single identity, as recorded in the ledger. Only
+// forwarded, and held, jobs count towards the quota. Every copy of a job counts.
+type quota struct {
+	identity string
+	jobs     int
+	pages    int
+}
+
+func init() {
+	if quotaExceeded != quotaReject && quotaExceeded != quotaHold {
+		panic(fmt.Errorf("invalid QUOTA_EXCEEDED '%v', expected '%v' or '%v'", quotaExceeded, quotaReject, quotaHold))
+	}
+}
+
+// quotaEnabled returns whether any limit is configured.
+func quotaEnabled() bool {
+	return quotaPagesPerJob > 0 || quotaJobs > 0 || quotaTotalPages > 0
+}
+
+// lockQuota locks the quota of the identity, the returned function unlocks it.
+func lockQuota(identity string) func() {
+	mu, _ := quotaLocks.LoadOrStore(identity, new(sync.Mutex))
+	mu.Lock()
+	return mu.Unlock
+}
+
+// loadQuota retrieves the usage of the identity from the ledger.
+func loadQuota(identity string) (q quota, err error) {
+	q.identity = identity
+	if ledger == nil || !quotaEnabled() {
+		return
+	}
+
+	counted := []string{JobForwarded, JobHeld}
+	if quotaJobs > 0 {
+		var jobs int64
+		err = ledger.Model(&Job{}).
+			Where("identity = ? AND status IN ? AND created_at >= ?", identity, counted, time.Now().Add(-quotaJobsWindow)).
+			Count(&jobs).Error
+		if err != nil {
+			return q, fmt.Errorf("cannot count jobs of '%v'; %w", identity, err)
+		}
+
+		q.jobs = int(jobs)
+	}
+
+	if quotaTotalPages > 0 {
+		err = ledger.Model(&Job{}).
+			Select("COALESCE(SUM(pages * MAX(copies, 1)), 0)").
+			Where("identity = ? AND status IN ?", identity, counted).
+			Scan(&q.pages).Error
+		if err != nil {
+			return q, fmt.Errorf("cannot count pages of '%v'; %w", identity, err)
+		}
+	}
+
+	return
+}
+
+// exceeded returns why a job of the number of pages exceeds the quota, or the
+// empty string when it does not. A negative number of pages depicts a job of
+// which the pages cannot be counted, it exceeds any page limit.
+func (q quota) exceeded(pages int) string {
+	switch {
+	case pages < 0 && (quotaPagesPerJob > 0 || quotaTotalPages > 0):
+		return "the pages of the job cannot be counted"
+	case quotaPagesPerJob > 0 && pages > quotaPagesPerJob:
+		return fmt.Sprintf("job has %v pages, at most %v pages per job are allowed", pages, quotaPagesPerJob)
+	case quotaJobs > 0 && q.jobs >= quotaJobs:
+		return fmt.Sprintf("at most %v jobs per %v are allowed", quotaJobs, quotaJobsWindow)
+	case quotaTotalPages > 0 && q.pages+pages > quotaTotalPages:
+		return fmt.Sprintf("job has %v pages, only %v of %v pages remain", pages, max(0, quotaTotalPages-q.pages), quotaTotalPages)
+	}
+
+	return ""
+}
+
+// remaining returns the remaining quota, after printing a job of the number of
+// pages, as banner-data.
+func (q quota) remaining(pages int) map[string]string {
+	r := make(map[string]string)
+	if quotaPagesPerJob > 0 {
+		r["quota_pages_per_job"] = strconv.Itoa(quotaPagesPerJob)
+	}
+
+	if quotaJobs > 0 {
+		r["quota_jobs_remaining"] = strconv.Itoa(max(0, quotaJobs-q.jobs-1))
+	}
+
+	if quotaTotalPages > 0 {
+		r["quota_pages_remaining"] = strconv.Itoa(max(0, quotaTotalPages-q.pages-pages))
+	}
+
+	return r
+}
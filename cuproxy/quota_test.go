@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuota(t *testing.T) {
+	testLedger(t)
+	quotaPagesPerJob, quotaJobs, quotaJobsWindow, quotaTotalPages = 10, 2, time.Hour, 20
+	t.Cleanup(func() { quotaPagesPerJob, quotaJobs, quotaTotalPages = 0, 0, 0 })
+
+	recordJob(zlog.Logger, &Job{Identity: "team42", Pages: 8, Status: JobForwarded})
+	recordJob(zlog.Logger, &Job{Identity: "team42", Pages: 2, Copies: 2, Status: JobHeld})
+	recordJob(zlog.Logger, &Job{Identity: "team42", Pages: 1, Status: JobHeld})
+	recordJob(zlog.Logger, &Job{Identity: "team42", Pages: 100, Status: JobRejected})
+	recordJob(zlog.Logger, &Job{Identity: "team43", Pages: 3, Status: JobForwarded, CreatedAt: time.Now().Add(-2 * time.Hour)})
+
+	q, err := loadQuota("team42")
+	require.NoError(t, err)
+	assert.Equal(t, 3, q.jobs)
+	assert.Equal(t, 13, q.pages, "every copy counts, rejected jobs must not count")
+	assert.Contains(t, q.exceeded(1), "at most 2 jobs")
+	assert.Equal(t, "the pages of the job cannot be counted", q.exceeded(-1))
+
+	q, err = loadQuota("team43")
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.jobs, "jobs outside of the window must not count")
+	assert.Equal(t, 3, q.pages)
+	assert.Empty(t, q.exceeded(10))
+	assert.Contains(t, q.exceeded(11), "at most 10 pages per job")
+	assert.Equal(t, map[string]string{
+		"quota_pages_per_job":   "10",
+		"quota_jobs_remaining":  "1",
+		"quota_pages_remaining": "7",
+	}, q.remaining(10))
+
+	q.pages = 15
+	assert.Contains(t, q.exceeded(6), "only 5 of 20 pages remain")
+
+	quotaPagesPerJob, quotaTotalPages = 0, 0
+	assert.Empty(t, q.exceeded(-1), "uncounted pages only exceed page limits")
+}
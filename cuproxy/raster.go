@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// pwgSync and urfSync are the magic bytes of PWG raster (PWG 5102.4) and
+	// Apple raster (URF) streams.
+	pwgSync = "RaS2"
+	urfSync = "UNIRAST\x00"
+
+	pwgHeaderSize = 1796
+	urfHeaderSize = 32
+
+	// maxRasterPixels guards against page headers describing absurdly large
+	// pages, 1200dpi A4 fits.
+	maxRasterPixels = 1 << 28
+
+	// rasterBudgetFactor bounds the memory of a decoded page, the raster data
+	// and the image together, to a multiple of MAX_REQUEST_SIZE. By default,
+	// 600dpi A3 in RGB fits.
+	rasterBudgetFactor = 4
+)
+
+// colorSpace is the subset of raster color spaces that can be converted.
+type colorSpace int
+
+const (
+	spaceGray colorSpace = iota
+	spaceBlack
+	spaceRGB
+	spaceCMYK
+)
+
+// imageBytes returns the number of bytes a pixel of the color space occupies
+// in the decoded image.
+func (cs colorSpace) imageBytes() int {
+	if cs == spaceGray || cs == spaceBlack {
+		return 1
+	}
+
+	return 4
+}
+
+// channels returns the number of colors of a pixel in the color space.
+func (cs colorSpace) channels() int {
+	switch cs {
+	case spaceRGB:
+		return 3
+	case spaceCMYK:
+		return 4
+	}
+
+	return 1
+}
+
+// rasterPage describes a single page of a raster stream. Both PWG and URF
+// pages are compressed using the same run-length encoding.
+type rasterPage struct {
+	width, height int
+	bitsPerColor  int
+	bitsPerPixel  int
+	bytesPerLine  int
+	space         colorSpace
+	dpiX, dpiY    int
+}
+
+var errRasterOverflow = errors.New("raster line exceeds the page width")
+
+// pwgToPDF converts a PWG raster stream into a PDF, every raster page becomes
+// a PDF page of the same dimensions.
+func pwgToPDF(log zerolog.Logger, in io.Reader, out io.Writer, _ string) error {
+	r := bufio.NewReader(in)
+	sync := make([]byte, len(pwgSync))
+	if _, err := io.ReadFull(r, sync); err != nil || string(sync) != pwgSync {
+		return fmt.Errorf("not a PWG raster stream; %w", err)
+	}
+
+	return rasterToPDF(log, r, out, func() (*rasterPage, error) {
+		h := make([]byte, pwgHeaderSize)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return nil, err
+		}
+
+		u := func(offset int) int {
+			return int(binary.BigEndian.Uint32(h[offset:]))
+		}
+
+		p := &rasterPage{
+			dpiX:         u(276),
+			dpiY:         u(280),
+			width:        u(372),
+			height:       u(376),
+			bitsPerColor: u(384),
+			bitsPerPixel: u(388),
+			bytesPerLine: u(392),
+		}
+
+		if order := u(396); order != 0 {
+			return nil, fmt.Errorf("unsupported PWG color order '%v'", order)
+		}
+
+		switch cs := u(400); cs {
+		case 0, 18: // W, sGray
+			p.space = spaceGray
+		case 3: // K
+			p.space = spaceBlack
+		case 1, 19, 20: // RGB, sRGB, AdobeRGB
+			p.space = spaceRGB
+		case 6: // CMYK
+			p.space = spaceCMYK
+		default:
+			return nil, fmt.Errorf("unsupported PWG color space '%v'", cs)
+		}
+
+		return p, nil
+	})
+}
+
+// urfToPDF converts an Apple raster (URF) stream into a PDF.
+func urfToPDF(log zerolog.Logger, in io.Reader, out io.Writer, _ string) error {
+	r := bufio.NewReader(in)
+
+	// The sync word is followed by the number of pages
+	sync := make([]byte, len(urfSync)+4)
+	if _, err := io.ReadFull(r, sync); err != nil || string(sync[:len(urfSync)]) != urfSync {
+		return fmt.Errorf("not an URF raster stream; %w", err)
+	}
+
+	return rasterToPDF(log, r, out, func() (*rasterPage, error) {
+		h := make([]byte, urfHeaderSize)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return nil, err
+		}
+
+		p := &rasterPage{
+			bitsPerPixel: int(h[0]),
+			bitsPerColor: 8,
+			width:        int(binary.BigEndian.Uint32(h[12:])),
+			height:       int(binary.BigEndian.Uint32(h[16:])),
+			dpiX:         int(binary.BigEndian.Uint32(h[20:])),
+		}
+
+		p.dpiY = p.dpiX
+		p.bytesPerLine = (p.width*p.bitsPerPixel + 7) / 8
+
+		switch cs := h[1]; cs {
+		case 0, 4: // sGray, W
+			p.space = spaceGray
+		case 1, 3, 5: // sRGB, AdobeRGB, RGB
+			p.space = spaceRGB
+		case 6:
+			p.space = spaceCMYK
+		default:
+			return nil, fmt.Errorf("unsupported URF color space '%v'", cs)
+		}
+
+		return p, nil
+	})
+}
+
+// rasterToPDF reads page headers, using next, until the stream ends and
+// writes them to out as a PDF.
+func rasterToPDF(log zerolog.Logger, r *bufio.Reader, out io.Writer, next func() (*rasterPage, error)) error {
+	pdf := gofpdf.New("P", "pt", pdfSize, pdfFontDir)
+
+	var pages int
+	for {
+		p, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot read header of page %v; %w", pages+1, err)
+		}
+
+		img, err := p.decode(r)
+		if err != nil {
+			return fmt.Errorf("cannot decode page %v; %w", pages+1, err)
+		}
+
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		if err = enc.Encode(&buf, img); err != nil {
+			return fmt.Errorf("cannot encode page %v; %w", pages+1, err)
+		}
+
+		pages++
+		size := gofpdf.SizeType{Wd: float64(p.width) * 72 / float64(p.dpiX), Ht: float64(p.height) * 72 / float64(p.dpiY)}
+		name := fmt.Sprintf("page-%d", pages)
+		opts := gofpdf.ImageOptions{ImageType: "png"}
+
+		pdf.AddPageFormat("P", size)
+		pdf.RegisterImageOptionsReader(name, opts, &buf)
+		pdf.ImageOptions(name, 0, 0, size.Wd, size.Ht, false, opts, 0, "")
+		log.Trace().Int("page", pages).Int("width", p.width).Int("height", p.height).Int("dpi", p.dpiX).Msg("converted raster page")
+	}
+
+	if pages == 0 {
+		return fmt.Errorf("raster stream contains no pages")
+	}
+
+	log.Debug().Int("pages", pages).Msg("rendered raster")
+	return pdf.Output(out)
+}
+
+// decode reads, and decompresses, the page data. Every line starts with a
+// repeat count, followed by runs of either repeated or literal pixels.
+func (p *rasterPage) decode(r io.ByteReader) (image.Image, error) {
+	switch {
+	case p.width <= 0 || p.height <= 0 || p.dpiX <= 0 || p.dpiY <= 0:
+		return nil, fmt.Errorf("invalid page dimensions %vx%v at %vx%v dpi", p.width, p.height, p.dpiX, p.dpiY)
+	case p.width > maxRasterPixels || p.height > maxRasterPixels || p.width*p.height > maxRasterPixels:
+		return nil, fmt.Errorf("page of %vx%v pixels is too large", p.width, p.height)
+	case p.bitsPerColor != 1 && p.bitsPerColor != 8 && p.bitsPerColor != 16:
+		return nil, fmt.Errorf("unsupported bits per color '%v'", p.bitsPerColor)
+	case p.bitsPerColor == 1 && p.space != spaceGray && p.space != spaceBlack:
+		return nil, fmt.Errorf("1 bit per color is only supported for grayscale")
+	case p.bitsPerPixel != p.space.channels()*p.bitsPerColor:
+		return nil, fmt.Errorf("%v bits per pixel do not match %v colors of %v bits", p.bitsPerPixel, p.space.channels(), p.bitsPerColor)
+	case p.bytesPerLine != (p.width*p.bitsPerPixel+7)/8:
+		return nil, fmt.Errorf("invalid line length of %v bytes for %v pixels", p.bytesPerLine, p.width)
+	case p.memory() > rasterBudgetFactor*maxRequestSize:
+		return nil, fmt.Errorf("page of %vx%v pixels needs %v bytes to decode, exceeding %v bytes", p.width, p.height, p.memory(), rasterBudgetFactor*maxRequestSize)
+	}
+
+	// Runs are counted in pixels, or in bytes when a pixel is smaller.
+	unit := max(1, p.bitsPerPixel/8)
+	fill := byte(0xFF)
+	if p.space == spaceBlack || p.space == spaceCMYK {
+		fill = 0x00
+	}
+
+	data := make([]byte, p.height*p.bytesPerLine)
+	for y := 0; y < p.height; {
+		repeat, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line := data[y*p.bytesPerLine : (y+1)*p.bytesPerLine]
+		for x := 0; x < len(line); {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case c == 0x80:
+				// Clear the remainder of the line
+				for ; x < len(line); x++ {
+					line[x] = fill
+				}
+			case c < 0x80:
+				// Repeat the next pixel c+1 times
+				n := (int(c) + 1) * unit
+				if x+n > len(line) {
+					return nil, errRasterOverflow
+				}
+
+				for k := 0; k < unit; k++ {
+					if line[x+k], err = r.ReadByte(); err != nil {
+						return nil, err
+					}
+				}
+
+				for k := unit; k < n; k++ {
+					line[x+k] = line[x+k-unit]
+				}
+
+				x += n
+			default:
+				// 257-c literal pixels
+				n := (257 - int(c)) * unit
+				if x+n > len(line) {
+					return nil, errRasterOverflow
+				}
+
+				for k := 0; k < n; k++ {
+					if line[x+k], err = r.ReadByte(); err != nil {
+						return nil, err
+					}
+				}
+
+				x += n
+			}
+		}
+
+		for y++; repeat > 0 && y < p.height; repeat-- {
+			copy(data[y*p.bytesPerLine:], line)
+			y++
+		}
+	}
+
+	return p.image(data), nil
+}
+
+// memory returns the number of bytes needed to decode the page, the raster data
+// and the image together.
+func (p *rasterPage) memory() int {
+	return p.height*p.bytesPerLine + p.width*p.height*p.space.imageBytes()
+}
+
+// image converts the decompressed data into an image.
+func (p *rasterPage) image(data []byte) image.Image {
+	rect := image.Rect(0, 0, p.width, p.height)
+	sample := func(y, x int) byte {
+		switch p.bitsPerColor {
+		case 1:
+			if data[y*p.bytesPerLine+x/8]&(0x80>>(x%8)) != 0 {
+				return 0xFF
+			}
+
+			return 0x00
+		case 16:
+			// Only the most significant byte is kept
+			return data[y*p.bytesPerLine+2*x]
+		}
+
+		return data[y*p.bytesPerLine+x]
+	}
+
+	switch p.space {
+	case spaceRGB:
+		img := image.NewNRGBA(rect)
+		for y := 0; y < p.height; y++ {
+			for x := 0; x < p.width; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{R: sample(y, 3*x), G: sample(y, 3*x+1), B: sample(y, 3*x+2), A: 0xFF})
+			}
+		}
+
+		return img
+	case spaceCMYK:
+		img := image.NewCMYK(rect)
+		for y := 0; y < p.height; y++ {
+			for x := 0; x < p.width; x++ {
+				img.SetCMYK(x, y, color.CMYK{C: sample(y, 4*x), M: sample(y, 4*x+1), Y: sample(y, 4*x+2), K: sample(y, 4*x+3)})
+			}
+		}
+
+		return img
+	}
+
+	img := image.NewGray(rect)
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			v := sample(y, x)
+			if p.space == spaceBlack {
+				v = 0xFF - v
+			}
+
+			img.Pix[y*img.Stride+x] = v
+		}
+	}
+
+	return img
+}
@@ -2,11 +2,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -33,6 +34,17 @@ type (
 		method string
 		name   string
 		url    string
+
+		// The remainder is only configured using WEBHOOK_CONFIG.
+		headers            map[string]string
+		username, password string
+		bearer             string
+		body, contentType  string
+		timeout            time.Duration
+		retries            *int
+		keep               map[string]jsonPath
+		mapping            map[string]string
+		when               webhookCondition
 	}
 
 	endpoints    []endpoint
@@ -40,46 +52,69 @@ type (
 )
 
 var (
-	// etagCache is an etag cache. Stores the retrieved etag for some url
+	// etagCache is an etag cache. Stores the retrieved etag for some url, by the
+	// cache key of the url
 	etagCache  = xsync.NewMapOf[etagPair]()
 	pixieNonce = func() string {
 		nonce := env.String("WEBHOOK_REQUEST_NONCE")
-		if nonce == "" {
-
-			const pixieNonceAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
-			src := rand.New(rand.NewSource(time.Now().UnixNano()))
+		if nonce != "" {
+			return nonce
+		}
 
-			b := make([]byte, 32)
-			for i := range b {
-				b[i] = pixieNonceAlphabet[src.Intn(len(pixieNonceAlphabet))]
-			}
+		// The nonce is secret, it is never logged. Configure it to be able to
+		// check it in the webhooks.
+		const pixieNonceAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			panic(fmt.Errorf("cannot generate nonce; %w", err))
+		}
 
-			nonce = string(b)
+		for i := range b {
+			b[i] = pixieNonceAlphabet[int(b[i])%len(pixieNonceAlphabet)]
 		}
 
-		zlog.Info().Str("nonce", nonce).Msg("X-Pixie-Nonce value")
-		return nonce
+		zlog.Info().Msg("generated random X-Pixie-Nonce, set WEBHOOK_REQUEST_NONCE to use a known value")
+		return string(b)
 	}()
 
 	maxWebhookTime = env.DurationFb("WEBHOOK_MAX_DURATION", time.Second*30)
 )
 
-func Do(ctx context.Context, log zerolog.Logger, url, verb string, ip net.IP, requestBody io.Reader) (responseBody io.ReadCloser, responseType string, loaded bool, err error) {
-	req, err := http.NewRequestWithContext(ctx, verb, url, requestBody)
+func Do(ctx context.Context, log zerolog.Logger, url, verb string, ip net.IP, header http.Header, requestBody io.Reader) (responseBody io.ReadCloser, responseType string, loaded bool, err error) {
+	// The body is signed, it must be known entirely.
+	var body []byte
+	if requestBody != nil {
+		if body, err = io.ReadAll(requestBody); err != nil {
+			err = fmt.Errorf("cannot read request body [%v] '%v'; %w", verb, url, err)
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, verb, url, bytes.NewReader(body))
 	if err != nil {
 		err = fmt.Errorf("cannot create request [%v] '%v'", verb, url)
 		return
 	}
 
+	if requestBody == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+
 	req.Header.Set("User-Agent", "Pixie/CupsProxy")
 	req.Header.Set("Accept", "application/json, image/*")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
 	req.Header.Set("X-Pixie-Nonce", pixieNonce)
 	if ip != nil {
 		req.Header.Set("X-Forwarded-For", ip.String())
 	}
 
+	signature := signRequest(req, body, time.Now())
+
 	// Check for, and add, cached etag values
-	etag, etagLoaded := etagCache.Load(url)
+	etag, etagLoaded := loadEtag(url)
 	if etagLoaded {
 		req.Header.Add("If-None-Match", etag.Key)
 		req.Header.Add("If-Modified-Since", etag.Date)
@@ -93,27 +128,54 @@ func Do(ctx context.Context, log zerolog.Logger, url, verb string, ip net.IP, re
 
 	log.Err(err).Int("status", statusCode).Msg("called hook")
 	if err != nil {
-		err = fmt.Errorf("cannot create request [%v] '%v'", verb, url)
+		err = fmt.Errorf("cannot execute request [%v] '%v'; %w", verb, url, err)
 		return
 	}
 
 	if resp.StatusCode == http.StatusNotModified {
-		// Nothing to do, not loaded, nor an error is thrown. Close body just in case and return
+		// Nothing to do, not loaded, nor an error is thrown. Close body just in case and return.
+		// The response is verified, a forged 304 would keep stale data in place.
 		err = resp.Body.Close()
+		if webhookVerifyResponses {
+			err = verifyResponse(resp.Header, signature, nil, time.Now())
+		}
+
 		log.Err(err).Msg("status not changed, continuing")
 		return
 	}
 
+	if resp.StatusCode/100 != 2 {
+		// Only continue on success, failing webhooks do not sign their response
+		log.Warn().Msg("status not succesfull, not continuing to next hook")
+		_ = resp.Body.Close()
+		return nil, "", false, statusError{code: resp.StatusCode}
+	}
+
 	responseBody, responseType, loaded = resp.Body, resp.Header.Get("content-type"), true
 
-	if key, date := resp.Header.Get("ETag"), resp.Header.Get("Date"); key != "" || date != "" {
-		etagCache.Store(url, etagPair{Key: key, Date: date})
+	// Verify the response before it is used, this requires the entire body.
+	if webhookVerifyResponses {
+		var b []byte
+		b, err = io.ReadAll(io.LimitReader(resp.Body, maxSignedResponseSize+1))
+		_ = resp.Body.Close()
+		if err == nil && len(b) > maxSignedResponseSize {
+			err = fmt.Errorf("response of [%v] '%v' is too large to verify", verb, url)
+		}
+
+		if err == nil {
+			err = verifyResponse(resp.Header, signature, b, time.Now())
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Msg("refusing webhook response")
+			return nil, "", false, err
+		}
+
+		responseBody = io.NopCloser(bytes.NewReader(b))
 	}
 
-	if resp.StatusCode/100 != 2 {
-		// Only continue on success
-		log.Warn().Msg("status not succesfull, not continuing to next hook")
-		err = fmt.Errorf("non-successfull status code received (%v)", resp.StatusCode)
+	if key, date := resp.Header.Get("ETag"), resp.Header.Get("Date"); key != "" || date != "" {
+		storeEtag(log, url, etagPair{Key: key, Date: date})
 	}
 
 	return
@@ -124,7 +186,11 @@ func (ep endpoint) executeRequest(ctx context.Context, log zerolog.Logger, data
 	log.Debug().Str("original", ep.url).Object("relevant-data", params).Str("result", u).Msg("replaced url")
 
 	var reqBody io.Reader
-	if ep.method != http.MethodGet {
+	if ep.body != "" {
+		body, params := replaceParameters(ep.body, data, ep.name)
+		log.Debug().Object("relevant-data", params).Msg("replaced body")
+		reqBody = strings.NewReader(body)
+	} else if ep.method != http.MethodGet {
 		reqBody = data.json(map[string]string{
 			"webhook_name":   ep.name,
 			"webhook_method": ep.method,
@@ -132,10 +198,15 @@ func (ep endpoint) executeRequest(ctx context.Context, log zerolog.Logger, data
 		})
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, maxWebhookTime)
+	timeout := maxWebhookTime
+	if ep.timeout > 0 {
+		timeout = ep.timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	return Do(ctx, log, u, ep.method, data.ip, reqBody)
+	return Do(ctx, log, u, ep.method, data.ip, ep.header(data), reqBody)
 }
 
 func (ep endpoint) handleResponse(log zerolog.Logger, respBody io.ReadCloser, respType string, data *Props) (extra endpoints) {
@@ -145,7 +216,7 @@ func (ep endpoint) handleResponse(log zerolog.Logger, respBody io.ReadCloser, re
 	switch respType {
 	case "image/jpeg", "image/png", "image/gif":
 		// Store in file and
-		fn := downloadTo + "/" + data.ip.String() + "." + respType[6:]
+		fn := downloadTo + "/" + ipFileName(data.ip) + "." + respType[6:]
 		f, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
 		log.Debug().Err(err).Str("filename", fn).Msg("storing image")
 		if err != nil {
@@ -160,22 +231,36 @@ func (ep endpoint) handleResponse(log zerolog.Logger, respBody io.ReadCloser, re
 			break
 		}
 
-		data.Store(imageKey, fn)
+		data.set(imageKey, fn)
 
 		_ = f.Close()
 	case "application/json":
-		var jsonData map[string]interface{}
-		err := json.NewDecoder(respBody).Decode(&jsonData)
+		document, err := decodeJSON(respBody)
 		if err != nil {
 			log.Err(err).Msg("could not decode json")
 			break
 		}
 
-		var str string
-		var ok bool
-		for k, v := range jsonData {
-			if str, ok = interfaceToString(v); !ok {
-				continue
+		if len(ep.keep) > 0 {
+			for k, path := range ep.keep {
+				v, found := path.lookup(document)
+				str, ok := interfaceToString(v)
+				log.Debug().Bool("found", found).Str("key", k).Str("value", str).Msg("kept value")
+				if found && ok {
+					data.set(k, str)
+				}
+			}
+
+			break
+		}
+
+		// Nested values are stored using dotted keys, which can be mapped
+		jsonData := make(map[string]string)
+		flattenJSON("", document, jsonData)
+		for k, str := range jsonData {
+			mapped, isMapped := ep.mapping[k]
+			if isMapped {
+				k = mapped
 			}
 
 			// TODO fix the imageKey handling, this is currently incorrect!
@@ -191,7 +276,7 @@ func (ep endpoint) handleResponse(log zerolog.Logger, respBody io.ReadCloser, re
 						url:    str,
 					})
 				}
-			} else if keyTemplate != "" {
+			} else if keyTemplate != "" && !isMapped {
 				data.Store("webhook_key", k)
 				// Replace they key with the contents of the template
 				orig := k
@@ -200,7 +285,7 @@ func (ep endpoint) handleResponse(log zerolog.Logger, respBody io.ReadCloser, re
 				log.Debug().Str("original", orig).Str("template", keyTemplate).Object("relevant-data", params).Str("result", k).Msg("filled template for key")
 			}
 
-			data.Store(k, str)
+			data.set(k, str)
 		}
 	default:
 		log.Warn().Str("content-type", respType).Msg("unsupported content type encountered, ignored")
@@ -209,9 +294,10 @@ func (ep endpoint) handleResponse(log zerolog.Logger, respBody io.ReadCloser, re
 	return
 }
 
-func (ep endpoints) handle(c chan e, log zerolog.Logger, data *Props) func() {
+func (ep endpoints) handle(c chan error, log zerolog.Logger, data *Props) func() {
 	return func() {
-		defer func(c chan e) { c <- empty }(c)
+		var err error
+		defer func() { c <- err }()
 		eps := slices.Clone(ep)
 
 		// Any endpoint called can have
@@ -220,10 +306,18 @@ func (ep endpoints) handle(c chan e, log zerolog.Logger, data *Props) func() {
 
 			for _, end := range eps {
 				log = log.With().Str("verb", end.method).Str("url", end.url).Bool("with-ip", data.ip != nil).Logger()
+				if !end.when.holds(data) {
+					log.Debug().Str("webhook", end.name).Msg("condition does not hold, skipping webhook")
+					continue
+				}
 
-				respBody, respType, loaded, err := end.executeRequest(lifecycle.ApplicationContext(), log, data)
+				var respBody io.ReadCloser
+				var respType string
+				var loaded bool
+				respBody, respType, loaded, err = end.call(lifecycle.ApplicationContext(), log, data)
 				log.Err(err).Bool("new data", loaded).Msg("request executed")
 				if err != nil {
+					// The data loaded previously is kept, it is used stale
 					return
 				}
 
@@ -233,7 +327,7 @@ func (ep endpoints) handle(c chan e, log zerolog.Logger, data *Props) func() {
 					continue
 				}
 
-				data.latestData = time.Now()
+				data.touch()
 				newEps = append(newEps, end.handleResponse(log, respBody, respType, data)...)
 			}
 
@@ -248,6 +342,8 @@ func interfaceToString(vi interface{}) (strVal string, ok bool) {
 	switch v := vi.(type) {
 	case string:
 		strVal = v
+	case json.Number:
+		strVal = v.String()
 	case int:
 		strVal = strconv.Itoa(v)
 	case uint8:
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+	"github.com/tuupke/pixie/env"
+)
+
+var (
+	sidesDefault   = env.StringFb("SIDES_DEFAULT", "one-sided")
+	separateCopies = env.Bool("BANNER_SEPARATE_COPIES")
+	trailingBanner = env.Bool("BANNER_TRAILING")
+)
+
+// sheetLayout describes how the printer places the pages of a job on sheets,
+// as requested using the sides, number-up and copies job attributes.
+type sheetLayout struct {
+	duplex   bool
+	numberUp int
+	copies   int
+}
+
+// jobLayout reads the sheetLayout from the job attributes of the request.
+// SIDES_DEFAULT is used when the client does not request the sides.
+func jobLayout(msg *ipp.Message) sheetLayout {
+	sides := sidesDefault
+	if a := msg.Attribute(ipp.TagJob, "sides"); a != nil {
+		sides = a.String()
+	}
+
+	layout := sheetLayout{duplex: strings.HasPrefix(sides, "two-sided"), numberUp: 1, copies: 1}
+	if n, ok := msg.Attribute(ipp.TagJob, "number-up").Int(); ok && n > 1 {
+		layout.numberUp = int(n)
+	}
+
+	if n, ok := msg.Attribute(ipp.TagJob, "copies").Int(); ok && n > 1 {
+		layout.copies = int(n)
+	}
+
+	return layout
+}
+
+// pagesPerSheet returns the number of pages printed on a single sheet.
+func (l sheetLayout) pagesPerSheet() int {
+	if l.duplex {
+		return 2 * l.numberUp
+	}
+
+	return l.numberUp
+}
+
+// padding returns the number of blank pages needed after the pages, for the
+// next page to start on a fresh sheet.
+func (l sheetLayout) padding(pages int) int {
+	perSheet := l.pagesPerSheet()
+	return (perSheet - pages%perSheet) % perSheet
+}
+
+// stitch merges the banner with the document, and writes the result to out.
+// The banner, every copy of the document, and every separator start on a
+// fresh sheet. The document is repeated when copies is larger than one, the
+// copies are separated by a page naming the identity and the copy. The number
+// of pages written is returned.
+func stitch(out io.Writer, banner, document *io.SectionReader, layout sheetLayout, copies int, identity string) (int, error) {
+	section := func(r *io.SectionReader) *io.SectionReader {
+		return io.NewSectionReader(r, 0, r.Size())
+	}
+
+	bannerPages, err := pdfcpu.PageCount(section(banner), nil)
+	if err != nil {
+		return 0, fmt.Errorf("cannot count pages of banner; %w", err)
+	}
+
+	documentPages, err := pdfcpu.PageCount(section(document), nil)
+	if err != nil {
+		return 0, fmt.Errorf("cannot count pages of document; %w", err)
+	}
+
+	var parts []io.ReadSeeker
+	total := 0
+	filler := func(pages int, text string) error {
+		if pages == 0 {
+			return nil
+		}
+
+		pdf, err := fillerPages(pages, text)
+		parts, total = append(parts, bytes.NewReader(pdf)), total+pages
+		return err
+	}
+
+	addBanner := func() error {
+		pages := bannerPages
+		if bannerOnBack && layout.duplex {
+			// The front of the sheet is left blank, the banner is on its back.
+			if err := filler(layout.numberUp, ""); err != nil {
+				return err
+			}
+
+			pages += layout.numberUp
+		}
+
+		parts, total = append(parts, section(banner)), total+bannerPages
+		return filler(layout.padding(pages), "")
+	}
+
+	if !appendBanner {
+		if err = addBanner(); err != nil {
+			return 0, err
+		}
+	}
+
+	for i := 1; i <= copies; i++ {
+		if i > 1 {
+			text := fmt.Sprintf("Copy %d of %d", i, copies)
+			if identity != "" {
+				text = identity + " - " + text
+			}
+
+			if err = filler(1+layout.padding(1), text); err != nil {
+				return 0, err
+			}
+		}
+
+		parts, total = append(parts, section(document)), total+documentPages
+		if err = filler(layout.padding(documentPages), ""); err != nil {
+			return 0, err
+		}
+	}
+
+	if appendBanner || trailingBanner {
+		if err = addBanner(); err != nil {
+			return 0, err
+		}
+	}
+
+	return total, pdfcpu.MergeRaw(parts, out, false, nil)
+}
+
+// fillerPages renders the number of pages, the first containing the text.
+func fillerPages(pages int, text string) ([]byte, error) {
+	orientation := "P"
+	if pdfInLandscape {
+		orientation = "L"
+	}
+
+	pdf := gofpdf.New(orientation, pdfUnit, pdfSize, pdfFontDir)
+	pdf.SetAutoPageBreak(false, 0)
+	for i := 0; i < pages; i++ {
+		pdf.AddPage()
+		if i == 0 && text != "" {
+			tr := pdf.UnicodeTranslatorFromDescriptor("")
+			width, height := pdf.GetPageSize()
+			pdf.SetFont(font, "B", 2*fontSize)
+			pdf.SetXY(0, height/2)
+			pdf.CellFormat(width, pointsToUnits(2*fontSize), tr(text), "", 0, "C", false, 0, "")
+		}
+	}
+
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+func TestJobLayout(t *testing.T) {
+	msg := ipp.NewRequest(ipp.OperationPrintJob, 1)
+	assert.Equal(t, sheetLayout{numberUp: 1, copies: 1}, jobLayout(msg))
+
+	job := msg.AddGroup(ipp.TagJob)
+	job.Set("sides", ipp.String(ipp.TagKeyword, "two-sided-long-edge"))
+	job.Set("number-up", ipp.Integer(ipp.TagInteger, 2))
+	job.Set("copies", ipp.Integer(ipp.TagInteger, 3))
+
+	layout := jobLayout(msg)
+	assert.Equal(t, sheetLayout{duplex: true, numberUp: 2, copies: 3}, layout)
+	assert.Equal(t, 4, layout.pagesPerSheet())
+	assert.Equal(t, 0, layout.padding(8))
+	assert.Equal(t, 3, layout.padding(5))
+	assert.Equal(t, 1, sheetLayout{duplex: true, numberUp: 1}.padding(3))
+	assert.Equal(t, 0, sheetLayout{numberUp: 1}.padding(3))
+}
+
+func TestStitch(t *testing.T) {
+	oldAppend, oldTrailing, oldBack := appendBanner, trailingBanner, bannerOnBack
+	t.Cleanup(func() { appendBanner, trailingBanner, bannerOnBack = oldAppend, oldTrailing, oldBack })
+
+	banner, err := fillerPages(1, "banner")
+	require.NoError(t, err)
+	document, err := fillerPages(3, "document")
+	require.NoError(t, err)
+
+	pages := func(layout sheetLayout, copies int) int {
+		t.Helper()
+
+		var out bytes.Buffer
+		total, err := stitch(&out, io.NewSectionReader(bytes.NewReader(banner), 0, int64(len(banner))),
+			io.NewSectionReader(bytes.NewReader(document), 0, int64(len(document))), layout, copies, "team7")
+		require.NoError(t, err)
+
+		n, err := pdfcpu.PageCount(bytes.NewReader(out.Bytes()), nil)
+		require.NoError(t, err)
+		assert.Equal(t, n, total, "the stitched pages are counted")
+		return n
+	}
+
+	simplex, duplex := sheetLayout{numberUp: 1}, sheetLayout{duplex: true, numberUp: 1}
+	appendBanner, trailingBanner, bannerOnBack = false, false, false
+	assert.Equal(t, 4, pages(simplex, 1))
+	assert.Equal(t, 6, pages(duplex, 1), "the banner and the document are padded to a fresh sheet")
+	assert.Equal(t, 12, pages(duplex, 2), "the copies are separated")
+	assert.Equal(t, 8, pages(sheetLayout{numberUp: 4}, 1))
+
+	bannerOnBack = true
+	assert.Equal(t, 4, pages(simplex, 1), "single sided jobs have no back")
+	assert.Equal(t, 6, pages(duplex, 1))
+
+	bannerOnBack, trailingBanner = false, true
+	assert.Equal(t, 5, pages(simplex, 1))
+	assert.Equal(t, 8, pages(duplex, 1))
+
+	appendBanner, trailingBanner = true, false
+	assert.Equal(t, 6, pages(duplex, 1))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	signatureHeader = "X-Pixie-Signature"
+	timestampHeader = "X-Pixie-Timestamp"
+	signaturePrefix = "sha256="
+
+	// maxSignedResponseSize is the maximum size of a webhook response that is
+	// verified, the response is read entirely before it is verified.
+	maxSignedResponseSize = 16 << 20
+)
+
+var (
+	webhookSecret          = env.String("WEBHOOK_SECRET")
+	webhookVerifyResponses = env.Bool("WEBHOOK_VERIFY_RESPONSES")
+	webhookSignatureMaxAge = env.DurationFb("WEBHOOK_SIGNATURE_MAX_AGE", 5*time.Minute)
+
+	errInvalidSignature = errors.New("invalid webhook response signature")
+)
+
+func init() {
+	if webhookVerifyResponses && webhookSecret == "" {
+		panic(fmt.Errorf("WEBHOOK_VERIFY_RESPONSES requires WEBHOOK_SECRET to be set"))
+	}
+}
+
+// sign computes the HMAC-SHA256 of the newline separated parts using the
+// webhook secret.
+func sign(parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest adds the timestamp and signature headers to the webhook request.
+// The signature covers the timestamp, method, url and body, in that order. The
+// signature is returned, as the response signature is bound to it.
+func signRequest(req *http.Request, body []byte, now time.Time) string {
+	if webhookSecret == "" {
+		return ""
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := sign(timestamp, req.Method, req.URL.String(), string(body))
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, signature)
+	return signature
+}
+
+// verifyResponse verifies the signature of the webhook response. The signature
+// covers the timestamp of the response, the signature of the request and the
+// body, in that order. Responses older than WEBHOOK_SIGNATURE_MAX_AGE are
+// refused.
+func verifyResponse(header http.Header, requestSignature string, body []byte, now time.Time) error {
+	timestamp := header.Get(timestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w, cannot parse timestamp '%v'", errInvalidSignature, timestamp)
+	}
+
+	if age := now.Sub(time.Unix(unix, 0)); age > webhookSignatureMaxAge || age < -webhookSignatureMaxAge {
+		return fmt.Errorf("%w, timestamp is %v off", errInvalidSignature, age.Round(time.Second))
+	}
+
+	expected := sign(timestamp, requestSignature, string(body))
+	if !hmac.Equal([]byte(header.Get(signatureHeader)), []byte(expected)) {
+		return fmt.Errorf("%w, signature does not match", errInvalidSignature)
+	}
+
+	return nil
+}
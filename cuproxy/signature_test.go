@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSecret(t *testing.T, verify bool) {
+	webhookSecret, webhookVerifyResponses = "s3cret", verify
+	t.Cleanup(func() { webhookSecret, webhookVerifyResponses = "", false })
+}
+
+func TestSignRequest(t *testing.T) {
+	testSecret(t, false)
+	now := time.Unix(1700000000, 0)
+
+	req := httptest.NewRequest(http.MethodPost, "http://hooks.example/team?ip=10.0.0.4", nil)
+	signature := signRequest(req, []byte(`{"a":"b"}`), now)
+	assert.Equal(t, "1700000000", req.Header.Get(timestampHeader))
+	assert.Equal(t, signature, req.Header.Get(signatureHeader))
+	assert.Equal(t, sign("1700000000", http.MethodPost, "http://hooks.example/team?ip=10.0.0.4", `{"a":"b"}`), signature)
+
+	// Every signed part matters
+	assert.NotEqual(t, signature, signRequest(httptest.NewRequest(http.MethodPut, "http://hooks.example/team?ip=10.0.0.4", nil), []byte(`{"a":"b"}`), now))
+	assert.NotEqual(t, signature, signRequest(httptest.NewRequest(http.MethodPost, "http://hooks.example/team?ip=10.0.0.5", nil), []byte(`{"a":"b"}`), now))
+	assert.NotEqual(t, signature, signRequest(httptest.NewRequest(http.MethodPost, "http://hooks.example/team?ip=10.0.0.4", nil), []byte(`{"a":"c"}`), now))
+	assert.NotEqual(t, signature, signRequest(httptest.NewRequest(http.MethodPost, "http://hooks.example/team?ip=10.0.0.4", nil), []byte(`{"a":"b"}`), now.Add(time.Second)))
+
+	webhookSecret = ""
+	req = httptest.NewRequest(http.MethodGet, "http://hooks.example/", nil)
+	assert.Empty(t, signRequest(req, nil, now))
+	assert.Empty(t, req.Header.Get(signatureHeader), "requests are not signed without a secret")
+}
+
+func TestVerifyResponse(t *testing.T) {
+	testSecret(t, true)
+	now := time.Unix(1700000000, 0)
+	header := func(timestamp, signature string) http.Header {
+		return http.Header{timestampHeader: {timestamp}, signatureHeader: {signature}}
+	}
+
+	valid := sign("1700000000", "sha256=request", `{"team":"42"}`)
+	assert.NoError(t, verifyResponse(header("1700000000", valid), "sha256=request", []byte(`{"team":"42"}`), now))
+	assert.NoError(t, verifyResponse(header("1700000000", valid), "sha256=request", []byte(`{"team":"42"}`), now.Add(time.Minute)))
+
+	for name, err := range map[string]error{
+		"body":      verifyResponse(header("1700000000", valid), "sha256=request", []byte(`{"team":"43"}`), now),
+		"request":   verifyResponse(header("1700000000", valid), "sha256=other", []byte(`{"team":"42"}`), now),
+		"timestamp": verifyResponse(header("1700000001", valid), "sha256=request", []byte(`{"team":"42"}`), now),
+		"stale":     verifyResponse(header("1700000000", valid), "sha256=request", []byte(`{"team":"42"}`), now.Add(time.Hour)),
+		"missing":   verifyResponse(http.Header{}, "sha256=request", []byte(`{"team":"42"}`), now),
+	} {
+		assert.ErrorIs(t, err, errInvalidSignature, name)
+	}
+}
+
+func TestSignedWebhook(t *testing.T) {
+	testSecret(t, true)
+	forge := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requestSignature := sign(r.Header.Get(timestampHeader), r.Method, "http://"+r.Host+r.URL.String(), string(body))
+		if r.Header.Get(signatureHeader) != requestSignature {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		response := `{"team_name":"Segmentation Fault"}`
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		if forge {
+			response = `{"team_name":"Forged"}`
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(timestampHeader, timestamp)
+		w.Header().Set(signatureHeader, sign(timestamp, requestSignature, `{"team_name":"Segmentation Fault"}`))
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+
+	body, _, loaded, err := Do(context.Background(), zlog.Logger, srv.URL+"/team", http.MethodPost, nil, nil, strings.NewReader(`{"ip":"10.0.0.4"}`))
+	require.NoError(t, err)
+	require.True(t, loaded)
+	b, _ := io.ReadAll(body)
+	assert.Equal(t, `{"team_name":"Segmentation Fault"}`, string(b))
+
+	forge = true
+	_, _, loaded, err = Do(context.Background(), zlog.Logger, srv.URL+"/team", http.MethodGet, nil, nil, nil)
+	assert.ErrorIs(t, err, errInvalidSignature)
+	assert.False(t, loaded, "forged data must not be used")
+}
+
+func TestSignedNotModified(t *testing.T) {
+	testSecret(t, true)
+	forge := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !forge {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			w.Header().Set(timestampHeader, timestamp)
+			w.Header().Set(signatureHeader, sign(timestamp, r.Header.Get(signatureHeader), ""))
+		}
+
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, _, loaded, err := Do(context.Background(), zlog.Logger, srv.URL+"/team", http.MethodGet, nil, nil, nil)
+	require.NoError(t, err)
+	assert.False(t, loaded)
+
+	// An unsigned 304 must not keep stale data in place
+	forge = true
+	_, _, loaded, err = Do(context.Background(), zlog.Logger, srv.URL+"/team", http.MethodGet, nil, nil, nil)
+	assert.ErrorIs(t, err, errInvalidSignature)
+	assert.False(t, loaded)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	// bufferedRequestSize is the maximum size of a request body that is kept in
+	// memory, larger bodies are streamed.
+	bufferedRequestSize = 64 << 10
+
+	// pjlSearchSize is the number of bytes at the start, and end, of a document
+	// in which PJL commands are searched for.
+	pjlSearchSize = 64 << 10
+)
+
+type (
+	// sizedReader is a reader of which the total size is known beforehand.
+	sizedReader interface {
+		io.Reader
+		Size() int64
+	}
+
+	// limitedReader returns errRequestTooLarge when more than n bytes can be
+	// read from r.
+	limitedReader struct {
+		r io.Reader
+		n int64
+	}
+
+	// readCloser closes all closers when closed.
+	readCloser struct {
+		io.Reader
+		closers []io.Closer
+	}
+
+	nopWriteCloser struct {
+		io.Writer
+	}
+)
+
+var (
+	spoolLocation = strings.TrimRight(env.StringFb("SPOOL_LOCATION", os.TempDir()), "/")
+
+	errRequestTooLarge = errors.New("request exceeds the maximum request size")
+)
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Probe whether anything remains
+		var probe [1]byte
+		if n, _ := io.ReadFull(l.r, probe[:]); n > 0 {
+			return 0, errRequestTooLarge
+		}
+
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (r *readCloser) Close() (err error) {
+	for _, c := range r.closers {
+		err = errors.Join(err, c.Close())
+	}
+
+	return
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// requestBody returns the body of the request as a stream, which can be read
+// up to the maximum request size.
+func requestBody(ctx *fasthttp.RequestCtx) (io.Reader, error) {
+	if ctx.Request.Header.ContentLength() > maxRequestSize {
+		return nil, errRequestTooLarge
+	}
+
+	stream := ctx.RequestBodyStream()
+	if stream == nil {
+		stream = bytes.NewReader(ctx.Request.Body())
+	}
+
+	return &limitedReader{r: stream, n: int64(maxRequestSize)}, nil
+}
+
+// spool writes everything from r into a new temporary file. The returned file
+// must be removed using removeTemp, also when an error is returned.
+func spool(r io.Reader, pattern string) (f *os.File, n int64, err error) {
+	f, err = os.CreateTemp(spoolLocation, pattern)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot create spool-file; %w", err)
+	}
+
+	if n, err = io.Copy(f, r); err != nil {
+		return f, n, fmt.Errorf("cannot spool to '%v'; %w", f.Name(), err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	return
+}
+
+// removeTemp closes and removes a temporary file.
+func removeTemp(log zerolog.Logger, f *os.File) {
+	if f == nil {
+		return
+	}
+
+	_ = f.Close()
+	err := os.Remove(f.Name())
+	log.Trace().Err(err).Str("file", f.Name()).Msg("removed temporary file")
+}
+
+// concat returns a reader reading all parts sequentially, and the total size.
+func concat(parts ...sizedReader) (io.Reader, int64) {
+	var size int64
+	readers := make([]io.Reader, len(parts))
+	for k, p := range parts {
+		size += p.Size()
+		readers[k] = p
+	}
+
+	return io.MultiReader(readers...), size
+}
+
+// hopHeader returns whether the header must not be copied when proxying, the
+// values of these headers are determined by the proxied body.
+func hopHeader(key []byte) bool {
+	return bytes.EqualFold(key, []byte("Content-Length")) ||
+		bytes.EqualFold(key, []byte("Transfer-Encoding")) ||
+		bytes.EqualFold(key, []byte("Connection"))
+}
+
+// dumpFile opens the file where the request or response must be dumped. When
+// dumping is disabled, everything written is discarded.
+func dumpFile(seqId uint64, request, replaced bool) (io.WriteCloser, error) {
+	if dumpsPath == "" || (replaced && !dumpReplacements) || (!replaced && !dumpOriginal) {
+		return nopWriteCloser{io.Discard}, nil
+	}
+
+	var req, typ = "res", "orig"
+	if request {
+		req = "req"
+	}
+
+	if replaced {
+		typ = "repl"
+	}
+
+	name := fmt.Sprintf("%v/%v-%v-%v.bin", dumpsPath, seqId, req, typ)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		return nopWriteCloser{io.Discard}, fmt.Errorf("could not open dump-file '%v'; %w", name, err)
+	}
+
+	return f, nil
+}
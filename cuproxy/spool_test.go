@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractPJL(t *testing.T) {
+	const (
+		prefix = "\x1b%-12345X@PJL JOB\r\n@PJL ENTER LANGUAGE = PDF\r"
+		body   = "\n%PDF-1.4\n%%EOF\n"
+		suffix = "@PJL EOJ\r\n\x1b%-12345X"
+	)
+
+	doc := prefix + body + suffix
+	p, b, s, err := extractPJL(strings.NewReader(doc), int64(len(doc)))
+	require.NoError(t, err)
+
+	read := func(r io.Reader) string {
+		bts, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(bts)
+	}
+
+	assert.Equal(t, prefix, read(p))
+	assert.Equal(t, body, read(b))
+	assert.Equal(t, suffix, read(s))
+	assert.True(t, isPDF(b))
+
+	// Without PJL, the entire document is the body
+	p, b, s, err = extractPJL(strings.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	assert.Zero(t, p.Size())
+	assert.Zero(t, s.Size())
+	assert.Equal(t, body, read(b))
+
+	// PJL without an end
+	_, _, _, err = extractPJL(strings.NewReader(prefix+body), int64(len(prefix+body)))
+	assert.Error(t, err)
+}
+
+func TestLimitedReader(t *testing.T) {
+	r := &limitedReader{r: strings.NewReader("1234567890"), n: 10}
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "1234567890", string(b))
+
+	r = &limitedReader{r: strings.NewReader("1234567890!"), n: 10}
+	_, err = io.ReadAll(r)
+	assert.True(t, errors.Is(err, errRequestTooLarge))
+}
+
+func TestConcat(t *testing.T) {
+	r, size := concat(bytes.NewReader([]byte("foo")), io.NewSectionReader(strings.NewReader("xbarx"), 1, 3))
+	assert.EqualValues(t, 6, size)
+
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", string(b))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+
+	"github.com/tuupke/pixie/env"
+)
+
+var (
+	stampFooter         = env.String("STAMP_FOOTER")
+	stampFooterStyle    = env.StringFb("STAMP_FOOTER_STYLE", "font:Helvetica, points:8, pos:bc, off:0 10, sc:1 abs, rot:0, c:0.2 0.2 0.2")
+	stampWatermark      = env.String("STAMP_WATERMARK")
+	stampWatermarkStyle = env.StringFb("STAMP_WATERMARK_STYLE", "font:Helvetica-Bold, points:72, d:1, sc:1 abs, op:0.15, c:0.5 0.5 0.5")
+	stampTimeFormat     = env.StringFb("STAMP_TIME_FORMAT", "2006-01-02 15:04")
+)
+
+// stampEnabled returns whether the pages of documents are stamped.
+func stampEnabled() bool {
+	return stampFooter != "" || stampWatermark != ""
+}
+
+// stampData returns the job specific data available to the stamps. The page
+// placeholders are resolved by pdfcpu, for every page.
+func stampData(job *Job, now time.Time) map[string]string {
+	return map[string]string{
+		"job_id":    strconv.Itoa(int(job.JobID)),
+		"seq_id":    strconv.FormatUint(job.SeqID, 10),
+		"page":      "%p",
+		"pages":     "%P",
+		"timestamp": now.Format(stampTimeFormat),
+	}
+}
+
+// stamps returns the footer, and watermark, expanded using the data.
+func stamps(data bannerData) ([]*model.Watermark, error) {
+	var wms []*model.Watermark
+	for _, s := range []struct{ text, style string }{{stampFooter, stampFooterStyle}, {stampWatermark, stampWatermarkStyle}} {
+		if s.text == "" {
+			continue
+		}
+
+		wm, err := pdfcpu.TextWatermark(expand(s.text, data), s.style, true, false, types.POINTS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stamp style '%v'; %w", s.style, err)
+		}
+
+		wms = append(wms, wm)
+	}
+
+	return wms, nil
+}
+
+// stampDocument stamps every page of the document with the footer and
+// watermark, into a temporary file.
+func stampDocument(document *io.SectionReader, data bannerData) (*os.File, error) {
+	wms, err := stamps(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := pdfcpu.PageCount(io.NewSectionReader(document, 0, document.Size()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot count pages to stamp; %w", err)
+	}
+
+	perPage := make(map[int][]*model.Watermark, pages)
+	for i := 1; i <= pages; i++ {
+		perPage[i] = wms
+	}
+
+	f, err := os.CreateTemp(spoolLocation, "cuproxy-stamped-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create file to stamp into; %w", err)
+	}
+
+	if err = pdfcpu.AddWatermarksSliceMap(io.NewSectionReader(document, 0, document.Size()), f, perPage, nil); err != nil {
+		return f, fmt.Errorf("cannot stamp document; %w", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	return f, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStampDocument(t *testing.T) {
+	oldFooter, oldWatermark, oldStyle, oldSpool := stampFooter, stampWatermark, stampWatermarkStyle, spoolLocation
+	t.Cleanup(func() {
+		stampFooter, stampWatermark, stampWatermarkStyle, spoolLocation = oldFooter, oldWatermark, oldStyle, oldSpool
+	})
+
+	stampFooter, stampWatermark, spoolLocation = "", "", t.TempDir()
+	assert.False(t, stampEnabled())
+
+	stampFooter = "{{team_id}} - job {{job_id}} - page {{page}}/{{pages}} - {{timestamp}}"
+	stampWatermark = "{{team_name}}"
+	require.True(t, stampEnabled())
+
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	data := overlay{kvs{"team_id": "7", "team_name": "Seven"}, stampData(&Job{JobID: 42}, now)}
+	wms, err := stamps(data)
+	require.NoError(t, err)
+	require.Len(t, wms, 2)
+	assert.Equal(t, "7 - job 42 - page %p/%P - 2026-10-18 12:30", wms[0].TextString, "pdfcpu resolves the page placeholders")
+	assert.Equal(t, "Seven", wms[1].TextString)
+
+	document, err := fillerPages(3, "document")
+	require.NoError(t, err)
+	stamped, err := stampDocument(io.NewSectionReader(bytes.NewReader(document), 0, int64(len(document))), data)
+	require.NoError(t, err)
+	defer stamped.Close()
+
+	pages, err := pdfcpu.PageCount(stamped, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pages)
+
+	_, _ = stamped.Seek(0, io.SeekStart)
+	ok, err := pdfcpu.HasWatermarks(stamped, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	stampWatermarkStyle = "bogus:1"
+	_, err = stamps(data)
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/tuupke/pixie/env"
+)
+
+const (
+	schemeIPP  = "ipp"
+	schemeIPPS = "ipps"
+)
+
+var (
+	listenCert       = env.String("LISTEN_TLS_CERT")
+	listenKey        = env.String("LISTEN_TLS_KEY")
+	listenSelfSigned = env.Bool("LISTEN_TLS_SELF_SIGNED")
+	listenHosts      = env.StringFb("LISTEN_TLS_HOSTS", "localhost")
+
+	printerCA          = env.String("PRINTER_CA")
+	printerTLSInsecure = env.Bool("PRINTER_TLS_INSECURE")
+
+	// upstreamClient is used for all requests to the printers.
+	upstreamClient = mustUpstreamClient(printerCA, printerTLSInsecure)
+)
+
+// listenTLS returns whether clients connect to the proxy using TLS.
+func listenTLS() bool {
+	return listenSelfSigned || listenCert != ""
+}
+
+// listenScheme returns the scheme of the uris of the proxy.
+func listenScheme() string {
+	if listenTLS() {
+		return schemeIPPS
+	}
+
+	return schemeIPP
+}
+
+// splitScheme splits the uri into its scheme and the remainder, without "://".
+// Uris without scheme are returned as-is.
+func splitScheme(uri string) (scheme, rest string) {
+	scheme, rest, found := strings.Cut(uri, "://")
+	if !found {
+		return "", uri
+	}
+
+	return strings.ToLower(scheme), rest
+}
+
+// newUpstreamClient constructs the client used to connect to the printers. The
+// certificates in the PEM encoded caFile are trusted in addition to those of
+// the system.
+func newUpstreamClient(caFile string, insecure bool) (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA '%v'; %w", caFile, err)
+		}
+
+		if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA '%v' does not contain any PEM encoded certificates", caFile)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+func mustUpstreamClient(caFile string, insecure bool) *http.Client {
+	client, err := newUpstreamClient(caFile, insecure)
+	if err != nil {
+		panic(fmt.Errorf("invalid PRINTER_CA; %w", err))
+	}
+
+	return client
+}
+
+// listenerConfig returns the TLS configuration of the listener, or nil when
+// the listener does not use TLS. A self-signed certificate is generated when
+// requested, it is stored in the certificate and key files when these are set
+// but do not exist yet, keeping it the same across restarts.
+func listenerConfig(log zerolog.Logger) (*tls.Config, error) {
+	if !listenTLS() {
+		return nil, nil
+	}
+
+	_, err := os.Stat(listenCert)
+	generate := listenSelfSigned && (listenCert == "" || errors.Is(err, os.ErrNotExist))
+
+	var cert tls.Certificate
+	if generate {
+		var certPEM, keyPEM []byte
+		if certPEM, keyPEM, err = selfSigned(strings.Split(listenHosts, ","), time.Now()); err == nil {
+			cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		}
+
+		if err == nil && listenCert != "" && listenKey != "" {
+			if err = os.WriteFile(listenKey, keyPEM, 0600); err == nil {
+				err = os.WriteFile(listenCert, certPEM, 0644)
+			}
+		}
+	} else {
+		cert, err = tls.LoadX509KeyPair(listenCert, listenKey)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate '%v'; %w", listenCert, err)
+	}
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	log.Info().Bool("self-signed", generate).Str("sha256", hex.EncodeToString(fingerprint[:])).Msg("loaded certificate")
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// selfSigned generates a self-signed certificate, valid for a year, for the
+// hosts, which are either hostnames or ips.
+func selfSigned(hosts []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate key; %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate serial; %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"CUProxy"}, CommonName: strings.TrimSpace(hosts[0])},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, h := range hosts {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create certificate; %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot encode key; %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
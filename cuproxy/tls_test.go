@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+func TestSelfSigned(t *testing.T) {
+	certPEM, keyPEM, err := selfSigned([]string{"print.example", " 10.0.0.1"}, time.Now())
+	require.NoError(t, err)
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"print.example"}, cert.DNSNames)
+	require.Len(t, cert.IPAddresses, 1)
+	assert.Equal(t, "10.0.0.1", cert.IPAddresses[0].String())
+	assert.NoError(t, cert.VerifyHostname("print.example"))
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, oldKey, oldSelf, oldHosts := listenCert, listenKey, listenSelfSigned, listenHosts
+	t.Cleanup(func() { listenCert, listenKey, listenSelfSigned, listenHosts = oldCert, oldKey, oldSelf, oldHosts })
+
+	config, err := listenerConfig(zlog.Logger)
+	require.NoError(t, err)
+	assert.Nil(t, config, "tls is disabled by default")
+	assert.Equal(t, schemeIPP, listenScheme())
+
+	listenCert, listenKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, err = listenerConfig(zlog.Logger)
+	assert.Error(t, err, "the certificate must exist")
+
+	// The self-signed certificate is kept across restarts
+	listenSelfSigned, listenHosts = true, "127.0.0.1"
+	config, err = listenerConfig(zlog.Logger)
+	require.NoError(t, err)
+	assert.Equal(t, schemeIPPS, listenScheme())
+	again, err := listenerConfig(zlog.Logger)
+	require.NoError(t, err)
+	assert.Equal(t, config.Certificates[0].Certificate, again.Certificates[0].Certificate)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln = tls.NewListener(ln, config)
+	t.Cleanup(func() { _ = ln.Close() })
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("secure") })
+
+	// Clients trusting the certificate can connect
+	client, err := newUpstreamClient(listenCert, false)
+	require.NoError(t, err)
+	resp, err := client.Get("https://" + ln.Addr().String())
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = http.Get("https://" + ln.Addr().String())
+	assert.Error(t, err, "the certificate is not trusted by default")
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := ipp.Decode(r.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(ipp.NewResponse(req, ipp.StatusOK).Bytes())
+	}))
+	t.Cleanup(srv.Close)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644))
+
+	pool := testPool(t, "ipps://"+strings.TrimPrefix(srv.URL, "https://")+"/printers/secure")
+	old := upstreamClient
+	t.Cleanup(func() { upstreamClient = old })
+
+	upstreamClient = mustUpstreamClient("", false)
+	_, err := sendUpstream(zlog.Logger, pool[0], newUpstreamRequest(pool[0], ipp.OperationGetPrinterAttributes, ""), nil)
+	assert.Error(t, err, "the printer is not trusted")
+
+	upstreamClient = mustUpstreamClient(ca, false)
+	resp, err := sendUpstream(zlog.Logger, pool[0], newUpstreamRequest(pool[0], ipp.OperationGetPrinterAttributes, ""), nil)
+	require.NoError(t, err)
+	assert.Equal(t, ipp.StatusOK, resp.Status())
+
+	upstreamClient = mustUpstreamClient("", true)
+	_, err = sendUpstream(zlog.Logger, pool[0], newUpstreamRequest(pool[0], ipp.OperationGetPrinterAttributes, ""), nil)
+	assert.NoError(t, err, "verification can be disabled")
+
+	_, err = newUpstreamClient(filepath.Join(t.TempDir(), "missing.pem"), false)
+	assert.Error(t, err)
+	_, err = newUpstreamClient("tls_test.go", false)
+	assert.Error(t, err, "the CA must contain certificates")
+}
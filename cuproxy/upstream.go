@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+
+	"github.com/gehack/pixie/cuproxy/ipp"
+)
+
+// upstreamRequestId is the request-id of requests originating from the proxy
+// itself.
+var upstreamRequestId = new(uint32)
+
+// newUpstreamRequest constructs a request targeting the printer.
+func newUpstreamRequest(p *printer, op ipp.Operation, user string) *ipp.Message {
+	req := ipp.NewRequest(op, atomic.AddUint32(upstreamRequestId, 1))
+	attrs := req.Group(ipp.TagOperation)
+	attrs.Set("printer-uri", ipp.String(ipp.TagURI, p.uri))
+	if user != "" {
+		attrs.Set("requesting-user-name", ipp.String(ipp.TagNameWithoutLanguage, user))
+	}
+
+	return req
+}
+
+// sendUpstream sends the request, followed by the document, to the printer
+// and decodes the response.
+func sendUpstream(log zerolog.Logger, p *printer, req *ipp.Message, document sizedReader) (*ipp.Message, error) {
+	parts := []sizedReader{bytes.NewReader(req.Bytes())}
+	if document != nil {
+		parts = append(parts, document)
+	}
+
+	body, length := concat(parts...)
+	r, err := http.NewRequest(http.MethodPost, p.url(), body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request to '%v'; %w", p.name, err)
+	}
+
+	r.ContentLength = length
+	r.Header.Set("Content-Type", "application/ipp")
+	resp, err := upstreamClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send %v to '%v'; %w", req.Operation(), p.name, err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("printer '%v' responded to %v with status %v", p.name, req.Operation(), resp.StatusCode)
+	}
+
+	respMsg, err := ipp.Decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode response to %v; %w", req.Operation(), err)
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	log.Debug().Str("printer", p.name).Stringer("operation", req.Operation()).Stringer("status", respMsg.Status()).Msg("sent request to printer")
+	return respMsg, nil
+}
+
+// cancelUpstream cancels a job created on the printer, used when the document
+// of a job created through Create-Job is not forwarded.
+func cancelUpstream(log zerolog.Logger, p *printer, jobId int32, user string) error {
+	req := newUpstreamRequest(p, ipp.OperationCancelJob, user)
+	req.Group(ipp.TagOperation).Set("job-id", ipp.Integer(ipp.TagInteger, jobId))
+
+	resp, err := sendUpstream(log, p, req, nil)
+	if err == nil && !resp.Status().IsSuccessful() {
+		err = fmt.Errorf("printer refused to cancel job %v; status %v", jobId, resp.Status())
+	}
+
+	log.Err(err).Str("printer", p.name).Int32("job-id", jobId).Msg("cancelled job on printer")
+	return err
+}
+
+// respondIPP writes the message as the response to the client.
+func respondIPP(ctx *fasthttp.RequestCtx, msg *ipp.Message) {
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/ipp")
+	ctx.SetBody(msg.Bytes())
+}
+
+// rejectJob responds with the IPP status and a status-message, explaining why
+// the job is refused.
+func rejectJob(ctx *fasthttp.RequestCtx, req *ipp.Message, status ipp.Status, reason string) {
+	resp := ipp.NewResponse(req, status)
+	resp.Group(ipp.TagOperation).Set("status-message", ipp.String(ipp.TagTextWithoutLanguage, reason))
+	respondIPP(ctx, resp)
+}
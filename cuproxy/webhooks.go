@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/tuupke/pixie/env"
+)
+
+var webhookConfigFile = env.String("WEBHOOK_CONFIG")
+
+type (
+	// webhookConfig is the declarative configuration of the webhooks, loaded
+	// from WEBHOOK_CONFIG. All chains are executed in parallel, the hooks of a
+	// chain are executed in order.
+	webhookConfig struct {
+		Defaults webhookHook    `yaml:"defaults"`
+		Chains   []webhookChain `yaml:"chains"`
+	}
+
+	webhookChain struct {
+		Name  string        `yaml:"name"`
+		Hooks []webhookHook `yaml:"hooks"`
+	}
+
+	// webhookHook is a single webhook. The url, header values, credentials and
+	// body can contain `{{key}}` placeholders, which are replaced by the
+	// banner-data.
+	webhookHook struct {
+		Name     string            `yaml:"name"`
+		Method   string            `yaml:"method"`
+		URL      string            `yaml:"url"`
+		Headers  map[string]string `yaml:"headers"`
+		Username string            `yaml:"username"`
+		Password string            `yaml:"password"`
+		Bearer   string            `yaml:"bearer"`
+
+		// Body is sent instead of all banner-data, using the ContentType.
+		Body        string `yaml:"body"`
+		ContentType string `yaml:"content_type"`
+
+		Timeout time.Duration `yaml:"timeout"`
+		Retries *int          `yaml:"retries"`
+
+		// Keep maps banner-data keys to JSON-paths in the response. When set,
+		// only these values are kept instead of all values.
+		Keep map[string]string `yaml:"keep"`
+
+		// Mapping renames the flattened keys of the response, e.g.
+		// `team.display_name: team_name`. Other keys are kept as is.
+		Mapping map[string]string `yaml:"mapping"`
+
+		When webhookCondition `yaml:"when"`
+	}
+
+	// webhookCondition must hold for the hook to be called. All keys of Missing
+	// must be absent, or empty, all keys of Present must be set, and all keys of
+	// Equals must have the value.
+	webhookCondition struct {
+		Missing []string          `yaml:"missing"`
+		Present []string          `yaml:"present"`
+		Equals  map[string]string `yaml:"equals"`
+	}
+
+	// jsonPath is a parsed JSON-path, e.g. `$.team.members[0].name`.
+	jsonPath []string
+)
+
+// loadWebhookConfig reads the webhook configuration from the YAML, or JSON,
+// file.
+func loadWebhookConfig(file string) (endpointsSet, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read webhook config '%v'; %w", file, err)
+	}
+
+	return parseWebhookConfig(b)
+}
+
+// parseWebhookConfig parses and validates the webhook configuration. The
+// defaults are applied to every hook.
+func parseWebhookConfig(b []byte) (endpointsSet, error) {
+	var config webhookConfig
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot parse webhook config; %w", err)
+	}
+
+	if len(config.Chains) == 0 {
+		return nil, fmt.Errorf("webhook config does not contain any chains")
+	}
+
+	set := make(endpointsSet, 0, len(config.Chains))
+	for k, chain := range config.Chains {
+		if len(chain.Hooks) == 0 {
+			return nil, fmt.Errorf("chain %v (%v) does not contain any hooks", k+1, chain.Name)
+		}
+
+		eps := make(endpoints, 0, len(chain.Hooks))
+		for kk, hook := range chain.Hooks {
+			ep, err := hook.withDefaults(config.Defaults).endpoint()
+			if err != nil {
+				return nil, fmt.Errorf("chain %v (%v), hook %v (%v); %w", k+1, chain.Name, kk+1, hook.Name, err)
+			}
+
+			eps = append(eps, ep)
+		}
+
+		set = append(set, eps)
+	}
+
+	return set, nil
+}
+
+// withDefaults returns the hook, in which all unset fields are taken from the
+// defaults. Headers are merged.
+func (h webhookHook) withDefaults(d webhookHook) webhookHook {
+	headers := make(map[string]string, len(d.Headers)+len(h.Headers))
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	for k, v := range h.Headers {
+		headers[k] = v
+	}
+
+	h.Headers = headers
+	for _, f := range []struct{ field, def *string }{
+		{&h.Method, &d.Method}, {&h.Username, &d.Username}, {&h.Password, &d.Password},
+		{&h.Bearer, &d.Bearer}, {&h.ContentType, &d.ContentType},
+	} {
+		if *f.field == "" {
+			*f.field = *f.def
+		}
+	}
+
+	if h.Method == "" {
+		h.Method = http.MethodGet
+	}
+
+	if h.Timeout == 0 {
+		h.Timeout = d.Timeout
+	}
+
+	if h.Retries == nil {
+		h.Retries = d.Retries
+	}
+
+	return h
+}
+
+// endpoint validates the hook, and converts it into an endpoint.
+func (h webhookHook) endpoint() (endpoint, error) {
+	ep := endpoint{
+		name:        h.Name,
+		method:      strings.ToUpper(h.Method),
+		url:         h.URL,
+		headers:     h.Headers,
+		username:    h.Username,
+		password:    h.Password,
+		bearer:      h.Bearer,
+		body:        h.Body,
+		contentType: h.ContentType,
+		timeout:     h.Timeout,
+		retries:     h.Retries,
+		when:        h.When,
+	}
+
+	switch {
+	case ep.name == "":
+		return ep, fmt.Errorf("name is required")
+	case ep.url == "":
+		return ep, fmt.Errorf("url is required")
+	case ep.timeout < 0:
+		return ep, fmt.Errorf("timeout cannot be negative")
+	case ep.retries != nil && *ep.retries < 0:
+		return ep, fmt.Errorf("retries cannot be negative")
+	case ep.bearer != "" && ep.username != "":
+		return ep, fmt.Errorf("use either bearer or username, not both")
+	case ep.body != "" && ep.method == http.MethodGet:
+		return ep, fmt.Errorf("a body cannot be sent using GET")
+	case len(h.Keep) > 0 && len(h.Mapping) > 0:
+		return ep, fmt.Errorf("use either keep or mapping, not both")
+	}
+
+	if _, ok := methods[ep.method]; !ok {
+		return ep, fmt.Errorf("invalid method '%v', expected values look like GET, POST, DELETE", h.Method)
+	}
+
+	if _, err := url.Parse(ep.url); err != nil {
+		return ep, fmt.Errorf("cannot parse url '%v'; %w", ep.url, err)
+	}
+
+	if len(h.Keep) > 0 {
+		ep.keep = make(map[string]jsonPath, len(h.Keep))
+		for key, path := range h.Keep {
+			p, err := parseJSONPath(path)
+			if err != nil {
+				return ep, fmt.Errorf("keep '%v'; %w", key, err)
+			}
+
+			ep.keep[key] = p
+		}
+	}
+
+	if len(h.Mapping) > 0 {
+		ep.mapping = make(map[string]string, len(h.Mapping))
+		for from, to := range h.Mapping {
+			p, err := parseJSONPath(from)
+			if err != nil {
+				return ep, fmt.Errorf("mapping '%v'; %w", from, err)
+			}
+
+			if to == "" {
+				return ep, fmt.Errorf("mapping '%v' has no key to map to", from)
+			}
+
+			ep.mapping[p.String()] = to
+		}
+	}
+
+	return ep, nil
+}
+
+// holds returns whether the condition holds for the banner-data.
+func (c webhookCondition) holds(data bannerData) bool {
+	for _, key := range c.Missing {
+		if v, ok := data.Load(key); ok && v != "" {
+			return false
+		}
+	}
+
+	for _, key := range c.Present {
+		if v, ok := data.Load(key); !ok || v == "" {
+			return false
+		}
+	}
+
+	for key, expected := range c.Equals {
+		if v, _ := data.Load(key); v != expected {
+			return false
+		}
+	}
+
+	return true
+}
+
+// header constructs the headers of the hook, replacing the placeholders.
+func (ep endpoint) header(data *Props) http.Header {
+	header := make(http.Header, len(ep.headers)+2)
+	for k, v := range ep.headers {
+		v, _ = replaceParameters(v, data, ep.name)
+		header.Set(k, v)
+	}
+
+	if ep.bearer != "" {
+		token, _ := replaceParameters(ep.bearer, data, ep.name)
+		header.Set("Authorization", "Bearer "+token)
+	} else if ep.username != "" {
+		user, _ := replaceParameters(ep.username, data, ep.name)
+		pass, _ := replaceParameters(ep.password, data, ep.name)
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+
+	if ep.body != "" {
+		contentType := ep.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+
+		header.Set("Content-Type", contentType)
+	}
+
+	return header
+}
+
+// parseJSONPath parses a JSON-path consisting of object keys and array
+// indices, e.g. `$.team.members[0].name`. The leading `$.` is optional.
+func parseJSONPath(path string) (jsonPath, error) {
+	p := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if p == "" {
+		return nil, fmt.Errorf("empty JSON-path '%v'", path)
+	}
+
+	var segments jsonPath
+	for _, part := range strings.Split(p, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key == "" && rest == "" {
+			return nil, fmt.Errorf("empty segment in JSON-path '%v'", path)
+		}
+
+		if key != "" {
+			segments = append(segments, key)
+		}
+
+		for rest != "" {
+			index, after, found := strings.Cut(rest, "]")
+			if _, err := strconv.Atoi(index); !found || err != nil {
+				return nil, fmt.Errorf("invalid index in JSON-path '%v'", path)
+			}
+
+			segments = append(segments, index)
+			if rest = strings.TrimPrefix(after, "["); rest == after && after != "" {
+				return nil, fmt.Errorf("invalid index in JSON-path '%v'", path)
+			}
+		}
+	}
+
+	return segments, nil
+}
+
+// lookup returns the value at the path within the decoded JSON document.
+func (p jsonPath) lookup(v interface{}) (interface{}, bool) {
+	for _, segment := range p {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = node[segment]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// String returns the path as a flattened key.
+func (p jsonPath) String() string {
+	return strings.Join(p, ".")
+}
+
+// flattenJSON flattens the decoded JSON document into dotted keys, e.g.
+// `{"team": {"members": [{"name": "Ada"}]}}` results in `team.members.0.name`.
+// Arrays containing only scalars are also joined under the key of the array.
+func flattenJSON(prefix string, v interface{}, into map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+
+		return prefix + "." + key
+	}
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range node {
+			flattenJSON(join(k), vv, into)
+		}
+	case []interface{}:
+		values := make([]string, 0, len(node))
+		for i, vv := range node {
+			flattenJSON(join(strconv.Itoa(i)), vv, into)
+			if str, ok := interfaceToString(vv); ok {
+				values = append(values, str)
+			}
+		}
+
+		if prefix != "" && len(values) == len(node) {
+			into[prefix] = strings.Join(values, ", ")
+		}
+	default:
+		if str, ok := interfaceToString(node); ok && prefix != "" {
+			into[prefix] = str
+		}
+	}
+}
+
+// decodeJSON decodes the JSON document, numbers are kept as written.
+func decodeJSON(r io.Reader) (v interface{}, err error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err = dec.Decode(&v)
+	return
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadWebhookConfig(t *testing.T) {
+	set, err := loadWebhookConfig("testdata/webhooks.yaml")
+	require.NoError(t, err)
+	require.Len(t, set, 2)
+	require.Len(t, set[0], 2)
+
+	user := set[0][0]
+	assert.Equal(t, http.MethodGet, user.method)
+	assert.Equal(t, 10*time.Second, user.timeout, "defaults apply to every hook")
+	assert.Equal(t, "application/json", user.headers["Accept"])
+	assert.Equal(t, jsonPath{"team_id"}, user.keep["team_id"])
+	assert.Equal(t, []string{"team_id"}, user.when.Missing)
+	assert.Equal(t, "first_member", set[0][1].mapping["members.0.name"])
+	require.NotNil(t, set[0][1].retries)
+	assert.Equal(t, 2, *set[0][1].retries)
+	assert.Nil(t, user.retries, "retries default to WEBHOOK_RETRIES")
+	assert.Equal(t, 2*time.Second, set[1][0].timeout)
+
+	// JSON is accepted as well
+	set, err = parseWebhookConfig([]byte(`{"chains": [{"hooks": [{"name": "a", "url": "http://a/{{requesting_ip}}"}]}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, endpointsSet{{{name: "a", method: http.MethodGet, url: "http://a/{{requesting_ip}}", headers: map[string]string{}}}}, set)
+
+	_, err = loadWebhookConfig("testdata/missing.yaml")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWebhookConfigErrors(t *testing.T) {
+	for config, expected := range map[string]string{
+		``:                                "does not contain any chains",
+		`chains: [{name: x}]`:             "chain 1 (x) does not contain any hooks",
+		`chains: [{hooks: [{url: "/"}]}]`: "hook 1 (); name is required",
+		`chains: [{hooks: [{name: a}]}]`:  "url is required",
+		`chains: [{hooks: [{name: a, url: "/", method: GRAB}]}]`:                  "invalid method 'GRAB'",
+		`chains: [{hooks: [{name: a, url: "/", body: "{}"}]}]`:                    "body cannot be sent using GET",
+		`chains: [{hooks: [{name: a, url: "/", bearer: t, username: u}]}]`:        "either bearer or username",
+		`chains: [{hooks: [{name: a, url: "/", retries: -1}]}]`:                   "retries cannot be negative",
+		`chains: [{hooks: [{name: a, url: "/", timeout: soon}]}]`:                 "cannot parse webhook config",
+		`chains: [{hooks: [{name: a, url: "/", keep: {x: "$.a[b]"}}]}]`:           "keep 'x'; invalid index",
+		`chains: [{hooks: [{name: a, url: "/", keep: {x: "$"}}]}]`:                "empty JSON-path",
+		`chains: [{hooks: [{name: a, url: "/", keep: {x: y}, mapping: {y: x}}]}]`: "either keep or mapping",
+		`chains: [{hooks: [{name: a, url: "/", mapping: {y: ""}}]}]`:              "mapping 'y' has no key",
+		`chains: [{hooks: [{name: a, url: "/", unless: {missing: [x]}}]}]`:        "field unless not found",
+		`chains: [{hooks: [{name: a, url: "/"}]}, {name: b, hooks: [{name: c}]}]`: "chain 2 (b), hook 1 (c); url is required",
+	} {
+		_, err := parseWebhookConfig([]byte(config))
+		if assert.Error(t, err, config) {
+			assert.Contains(t, err.Error(), expected, config)
+		}
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	document, err := decodeJSON(strings.NewReader(`{"team": {"id": 42, "members": [{"name": "Ada"}, {"name": "Alan"}]}, "ok": true}`))
+	require.NoError(t, err)
+
+	for path, expected := range map[string]string{
+		"$.team.id":             "42",
+		"team.members[1].name":  "Alan",
+		"$.team.members.0.name": "Ada",
+		"ok":                    "true",
+	} {
+		p, err := parseJSONPath(path)
+		require.NoError(t, err, path)
+		v, found := p.lookup(document)
+		require.True(t, found, path)
+		str, _ := interfaceToString(v)
+		assert.Equal(t, expected, str, path)
+	}
+
+	for _, path := range []string{"$.team.name", "team.members[2].name", "ok.value", "team.id[0]"} {
+		p, err := parseJSONPath(path)
+		require.NoError(t, err, path)
+		_, found := p.lookup(document)
+		assert.False(t, found, path)
+	}
+}
+
+func TestWebhookCondition(t *testing.T) {
+	c := webhookCondition{Missing: []string{"team_id"}, Present: []string{"room"}, Equals: map[string]string{"site": "A"}}
+	assert.True(t, c.holds(kvs{"room": "1", "site": "A"}))
+	assert.True(t, c.holds(kvs{"room": "1", "site": "A", "team_id": ""}), "empty values are missing")
+	assert.False(t, c.holds(kvs{"room": "1", "site": "A", "team_id": "3"}))
+	assert.False(t, c.holds(kvs{"site": "A"}))
+	assert.False(t, c.holds(kvs{"room": "1", "site": "B"}))
+	assert.True(t, webhookCondition{}.holds(kvs{}))
+}
+
+func TestConfiguredWebhooks(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/user":
+			user, pass, _ := r.BasicAuth()
+			assert.Equal(t, "admin:secret", user+":"+pass)
+			_, _ = w.Write([]byte(`{"team_id": 7, "username": "team7"}`))
+		case "/teams/7":
+			assert.Equal(t, "Bearer team7", r.Header.Get("Authorization"))
+			assert.Equal(t, "nwerc", r.Header.Get("X-Contest"))
+			_, _ = w.Write([]byte(`{"display_name": "Seven", "members": [{"name": "Ada"}], "id": "7"}`))
+		case "/seat":
+			b := new(strings.Builder)
+			_, _ = io.Copy(b, r.Body)
+			assert.Equal(t, `{"team": "7"}`, b.String())
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			_, _ = w.Write([]byte(`{"seat": "A12"}`))
+		}
+	}))
+	defer srv.Close()
+
+	set, err := parseWebhookConfig([]byte(`
+defaults:
+  headers: {X-Contest: nwerc}
+chains:
+  - hooks:
+      - {name: user, url: "` + srv.URL + `/user", username: admin, password: secret, when: {missing: [team_id]}, keep: {team_id: team_id}}
+      - {name: team, url: "` + srv.URL + `/teams/{{team_id}}", bearer: "team{{team_id}}", keep: {team_name: display_name, member: "members[0].name"}}
+      - {name: seat, method: POST, url: "` + srv.URL + `/seat", body: '{"team": "{{team_id}}"}'}
+`))
+	require.NoError(t, err)
+
+	data := Load(net.ParseIP("10.11.0.1"), map[string]string{}, "webhook-config")
+	c := make(chan error, 1)
+	set[0].handle(c, zlog.Logger, data)()
+	require.NoError(t, <-c)
+
+	assert.Equal(t, []string{"/user", "/teams/7", "/seat"}, calls)
+	assert.Equal(t, kvs{"team_id": "7", "team_name": "Seven", "member": "Ada", "seat": "A12"}, kvs(data.Snapshot()))
+
+	// The team is known, the user is not looked up again
+	calls = nil
+	set[0].handle(c, zlog.Logger, data)()
+	require.NoError(t, <-c)
+	assert.Equal(t, []string{"/teams/7", "/seat"}, calls)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	webhookRetryDelay = time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = time.Second })
+
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"room": "lab"}`))
+	}))
+	defer srv.Close()
+
+	data := Load(net.ParseIP("10.11.0.2"), map[string]string{}, "webhook-retries")
+	c := make(chan error, 1)
+	retries := 2
+	endpoints{{name: "room", method: http.MethodGet, url: srv.URL, retries: &retries}}.handle(c, zlog.Logger, data)()
+	require.NoError(t, <-c)
+
+	assert.Equal(t, 3, attempts)
+	room, _ := data.Load("room")
+	assert.Equal(t, "lab", room)
+
+	// An explicit zero turns the retries of WEBHOOK_RETRIES off
+	webhookRetries = 2
+	t.Cleanup(func() { webhookRetries = 0 })
+	set, err := parseWebhookConfig([]byte(`chains: [{hooks: [{name: seat, url: "` + srv.URL + `", retries: 0}]}]`))
+	require.NoError(t, err)
+
+	attempts = 0
+	set[0].handle(c, zlog.Logger, Load(net.ParseIP("10.11.0.3"), map[string]string{}, "webhook-no-retries"))()
+	assert.Error(t, <-c)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestFlattenJSON(t *testing.T) {
+	document, err := decodeJSON(strings.NewReader(`{
+		"id": "7", "display_name": "Seven", "public": true, "location": null,
+		"affiliation": {"name": "Radboud", "country": "NLD"},
+		"group_ids": [3, 4],
+		"members": [{"name": "Ada"}, {"name": "Alan", "roles": ["coach"]}]
+	}`))
+	require.NoError(t, err)
+
+	flat := make(map[string]string)
+	flattenJSON("", document, flat)
+	assert.Equal(t, map[string]string{
+		"id":                  "7",
+		"display_name":        "Seven",
+		"public":              "true",
+		"affiliation.name":    "Radboud",
+		"affiliation.country": "NLD",
+		"group_ids":           "3, 4",
+		"group_ids.0":         "3",
+		"group_ids.1":         "4",
+		"members.0.name":      "Ada",
+		"members.1.name":      "Alan",
+		"members.1.roles":     "coach",
+		"members.1.roles.0":   "coach",
+	}, flat)
+
+	flat = make(map[string]string)
+	flattenJSON("", []interface{}{"a", map[string]interface{}{"b": "c"}}, flat)
+	assert.Equal(t, map[string]string{"0": "a", "1.b": "c"}, flat)
+}
+
+func TestWebhookMapping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id": "7", "display_name": "Seven", "affiliation": {"name": "Radboud"}, "members": [{"name": "Ada"}]}`))
+	}))
+	defer srv.Close()
+
+	set, err := parseWebhookConfig([]byte(`
+chains:
+  - hooks:
+      - name: team
+        url: "` + srv.URL + `"
+        mapping:
+          display_name: team_name
+          $.affiliation.name: affiliation
+          members[0].name: captain
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"display_name": "team_name", "affiliation.name": "affiliation", "members.0.name": "captain"}, set[0][0].mapping)
+
+	keyTemplate = "{{webhook_name}}_{{webhook_key}}"
+	t.Cleanup(func() { keyTemplate = "" })
+
+	data := Load(net.ParseIP("10.11.0.3"), map[string]string{}, "webhook-mapping")
+	c := make(chan error, 1)
+	set[0].handle(c, zlog.Logger, data)()
+	require.NoError(t, <-c)
+
+	// Mapped keys are not subject to the key template
+	for key, expected := range map[string]string{"team_id": "7", "team_name": "Seven", "affiliation": "Radboud", "captain": "Ada"} {
+		v, _ := data.Load(key)
+		assert.Equal(t, expected, v, key)
+	}
+}